@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chat-server/server"
+)
+
+const (
+	dialTimeout  = 10 * time.Second
+	writeTimeout = 10 * time.Second
+	minBackoff   = time.Second // First delay before reconnecting
+	maxBackoff   = time.Minute // Longest delay between reconnect attempts
+)
+
+var (
+	errLoginFailed  = errors.New("login failed")
+	errNoJSON       = errors.New("server does not speak the JSON-lines protocol")
+	errNotConnected = errors.New("not connected")
+)
+
+// chatClient is a user's connection to a chat server. It reconnects when the
+// connection drops and joins the user's rooms again.
+type chatClient struct {
+	addr        string
+	tlsConfig   *tls.Config // nil for plain TCP
+	password    string
+	register    bool             // Create the account on the first login
+	identity    *ecdh.PrivateKey // Key for encrypted whispers; nil when they are off
+	pins        *keyPins
+	screen      *screen
+	downloadDir string        // Where files accepted with /accept are saved
+	ready       chan struct{} // Closed once the first login succeeds
+
+	mutex      sync.Mutex
+	name       string
+	conn       net.Conn // nil while disconnected
+	state      string   // Shown in the status bar
+	json       bool     // The connection speaks the JSON-lines protocol
+	textOnly   bool     // Do not offer the JSON-lines protocol
+	active     string   // Room plain messages go to
+	rooms      map[string]bool
+	rejoin     []string                   // Rooms to join again after reconnecting, the active one last
+	names      map[string]bool            // Users seen, for completion
+	roomsSeen  map[string]bool            // Rooms seen, for completion
+	keys       map[string]*ecdh.PublicKey // Keys fetched from the key directory this session
+	pending    map[string][]string        // Whispers waiting for their recipient's key
+	changed    map[string]*ecdh.PublicKey // Keys that differ from the pinned ones, until /trust accepts them
+	verifying  map[string]bool            // Users whose fingerprint /verify is waiting for
+	pasting    bool                       // In paste mode, collecting pasteLines until a line with just "."
+	pasteLines []string
+	uploads    map[string]*upload   // Files offered with /send, by the ID of the offer
+	downloads  map[string]*download // Files being received, by transfer ID
+	quitting   bool
+}
+
+func newChatClient(addr, name, password string, tlsConfig *tls.Config, screen *screen) *chatClient {
+	return &chatClient{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		name:      name,
+		password:  password,
+		screen:    screen,
+		ready:     make(chan struct{}),
+		rooms:     make(map[string]bool),
+		names:     make(map[string]bool),
+		roomsSeen: make(map[string]bool),
+		keys:      make(map[string]*ecdh.PublicKey),
+		pending:   make(map[string][]string),
+		changed:   make(map[string]*ecdh.PublicKey),
+		verifying: make(map[string]bool),
+		uploads:   make(map[string]*upload),
+		downloads: make(map[string]*download),
+	}
+}
+
+// run connects and keeps reconnecting, backing off exponentially, until quit
+// is called. It only returns an error if the first login is refused, since
+// trying again would not help.
+func (c *chatClient) run() error {
+	backoff := minBackoff
+	everLoggedIn := false
+	for {
+		loggedIn, err := c.session()
+		if c.isQuitting() {
+			return nil
+		}
+		switch {
+		case errors.Is(err, errNoJSON):
+			c.mutex.Lock()
+			c.textOnly = true
+			c.mutex.Unlock()
+			c.screen.print(styleSystem, "The server does not offer the JSON-lines protocol; switching to plain text.")
+			continue
+		case errors.Is(err, errLoginFailed) && !everLoggedIn:
+			return err
+		}
+		if loggedIn {
+			everLoggedIn = true
+			backoff = minBackoff
+		}
+		if errors.Is(err, io.EOF) {
+			err = errors.New("connection closed by the server")
+		}
+
+		delay := backoff + rand.N(backoff/2) // Jitter, so clients of a restarted server do not all return at once
+		c.screen.print(styleError, fmt.Sprintf("Disconnected: %v. Reconnecting in %s.", err, delay.Round(100*time.Millisecond)))
+		c.setState("disconnected")
+		time.Sleep(delay)
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// session runs one connection until it drops. loggedIn reports whether the
+// server accepted the login.
+func (c *chatClient) session() (loggedIn bool, err error) {
+	c.setState("connecting to " + c.addr)
+	conn, err := c.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	c.mutex.Lock()
+	textOnly, name := c.textOnly, c.name
+	c.mutex.Unlock()
+	if textOnly {
+		return c.textSession(conn, reader, name)
+	}
+	return c.jsonSession(conn, reader, name)
+}
+
+// dial opens a TCP or TLS connection to the server
+func (c *chatClient) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if c.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", c.addr, c.tlsConfig)
+	}
+	return dialer.Dial("tcp", c.addr)
+}
+
+// jsonSession logs in with a hello frame and handles frames until the
+// connection drops. It returns errNoJSON if the server answers in plain text.
+func (c *chatClient) jsonSession(conn net.Conn, reader *bufio.Reader, name string) (bool, error) {
+	hello := server.Envelope{Type: server.FrameHello, From: name, Password: c.password, Time: time.Now()}
+	if c.register {
+		hello.Type = server.FrameRegister
+	}
+	if err := writeFrame(conn, hello); err != nil {
+		return false, err
+	}
+
+	// The server finishes its name prompt with a newline before switching to frames
+	if _, err := reader.ReadString('\n'); err != nil {
+		return false, err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	var first server.Envelope
+	if err := json.Unmarshal([]byte(line), &first); err != nil || first.Type == "" {
+		return false, errNoJSON
+	}
+	if first.Type == server.FrameError {
+		return false, fmt.Errorf("%w: %s", errLoginFailed, first.Text)
+	}
+
+	c.connected(conn, true)
+	defer c.disconnected()
+	c.handleFrame(first)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return true, err
+		}
+		var env server.Envelope
+		if err := json.Unmarshal([]byte(line), &env); err != nil {
+			c.screen.print(styleError, fmt.Sprintf("Unreadable frame from the server: %v", err))
+			continue
+		}
+		c.handleFrame(env)
+	}
+}
+
+// textSession logs in like a telnet user and shows lines until the connection
+// drops. Without frames the client cannot follow rooms, so they are not
+// joined again after a reconnect.
+func (c *chatClient) textSession(conn net.Conn, reader *bufio.Reader, name string) (bool, error) {
+	login := name
+	if c.password != "" {
+		login = fmt.Sprintf("/login %s %s", name, c.password)
+		if c.register {
+			login = fmt.Sprintf("/register %s %s", name, c.password)
+		}
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", login); err != nil {
+		return false, err
+	}
+
+	c.connected(conn, false)
+	defer c.disconnected()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return true, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		line = strings.TrimPrefix(line, "Enter your name: ")
+		st, text := describeText(line, c.currentName())
+		c.screen.print(st, text)
+	}
+}
+
+// connected makes conn the connection that typed lines are sent on
+func (c *chatClient) connected(conn net.Conn, json bool) {
+	c.mutex.Lock()
+	c.conn, c.json = conn, json
+	c.state = "connected"
+	select {
+	case <-c.ready:
+	default:
+		close(c.ready)
+	}
+	if c.active != "" {
+		c.rejoin = rejoinOrder(c.rooms, c.active)
+	}
+	c.rooms = make(map[string]bool)
+	c.active = ""
+	c.keys = make(map[string]*ecdh.PublicKey) // Users may have reconnected with other keys
+	c.pending = make(map[string][]string)
+	c.changed = make(map[string]*ecdh.PublicKey)
+	c.verifying = make(map[string]bool)
+	c.mutex.Unlock()
+	c.updateStatus()
+	if json {
+		c.publishKey()
+	}
+}
+
+// disconnected forgets the connection once it has dropped
+func (c *chatClient) disconnected() {
+	c.mutex.Lock()
+	c.conn = nil
+	c.mutex.Unlock()
+	c.dropTransfers()
+}
+
+// rejoinOrder lists rooms to join again, the active room last so it ends up active
+func rejoinOrder(rooms map[string]bool, active string) []string {
+	var order []string
+	for room := range rooms {
+		if room != active {
+			order = append(order, room)
+		}
+	}
+	sort.Strings(order)
+	return append(order, active)
+}
+
+// handleFrame follows the user's rooms and name, answers pings and shows the frame
+func (c *chatClient) handleFrame(env server.Envelope) {
+	switch env.Type {
+	case server.FramePing:
+		pong := server.Envelope{Type: server.FramePong, ID: env.ID, Time: time.Now()}
+		if err := c.sendFrame(pong); err != nil {
+			c.screen.print(styleError, fmt.Sprintf("Error answering ping: %v", err))
+		}
+		return
+	case server.FramePong:
+		return
+	case server.FrameKey:
+		c.receiveKey(env)
+		return
+	case server.FrameFile:
+		c.receiveFile(env)
+		return
+	case server.FrameChunk:
+		c.receiveChunk(env)
+		return
+	case server.FrameError:
+		c.uploadFailed(env.ID)
+	}
+
+	c.mutex.Lock()
+	if env.From != "" && env.From != c.name {
+		c.names[env.From] = true
+	}
+	if env.Room != "" {
+		c.roomsSeen[env.Room] = true
+	}
+	var rejoin []string
+	switch env.Type {
+	case server.FramePresence:
+		delete(c.keys, env.From) // They may come back with another key
+		if env.To != "" {        // A rename
+			delete(c.names, env.From)
+			if env.From == c.name {
+				c.name = env.To
+			} else {
+				c.names[env.To] = true
+			}
+		}
+	case server.FrameJoin:
+		if env.From == c.name {
+			c.rooms[env.Room] = true
+		}
+	case server.FrameLeave:
+		if env.From == c.name {
+			delete(c.rooms, env.Room)
+		}
+	case server.FrameRoom:
+		c.active = env.Room
+		c.rooms[env.Room] = true
+		rejoin, c.rejoin = c.rejoin, nil
+	}
+	name, active := c.name, c.active
+	c.mutex.Unlock()
+
+	c.updateStatus()
+	switch {
+	case env.Type == server.FrameWhisper && env.Encrypted && env.From == name:
+		// Our own encrypted whisper coming back; it was shown when it was sent
+	case env.Type == server.FrameWhisper && env.Encrypted:
+		c.screen.print(c.openWhisper(env))
+	default:
+		c.screen.print(describe(env, name, active))
+	}
+
+	// The first room frame after a reconnect says where the server put us
+	joined := false
+	for i, room := range rejoin {
+		switchBack := i == len(rejoin)-1 && joined
+		if room != active || switchBack {
+			c.sendFrame(server.Envelope{Type: server.FrameJoin, Room: room, Time: time.Now()})
+			joined = true
+		}
+	}
+}
+
+// submit sends a line typed by the user. A leading "/" runs a command and
+// "//" sends a message that starts with "/".
+func (c *chatClient) submit(text string) {
+	c.mutex.Lock()
+	json, pasting := c.json, c.pasting
+	c.mutex.Unlock()
+	if pasting {
+		if err := c.pasteLine(text); err != nil {
+			c.screen.print(styleError, fmt.Sprintf("Not sent: %v", err))
+		}
+		return
+	}
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+
+	var err error
+	// "/whisper!" sends a whisper unencrypted on purpose
+	rest, plain := strings.CutPrefix(text, "/whisper! ")
+	if plain {
+		text = "/whisper " + rest
+	}
+	to, whisper, isWhisper := parseWhisper(text)
+	switch {
+	case strings.TrimSpace(text) == "/paste":
+		c.startPaste()
+	case !json:
+		err = c.sendLine(text)
+	case strings.HasPrefix(text, "/send "):
+		err = c.sendFile(strings.TrimPrefix(text, "/send "))
+	case isWhisper && c.identity != nil && !plain:
+		err = c.whisper(to, whisper)
+	case strings.HasPrefix(text, "/verify "):
+		err = c.verify(strings.TrimSpace(strings.TrimPrefix(text, "/verify ")))
+	case strings.HasPrefix(text, "/trust "):
+		err = c.trust(strings.TrimSpace(strings.TrimPrefix(text, "/trust ")))
+	case strings.HasPrefix(text, "//"):
+		err = c.sendFrame(server.Envelope{Type: server.FrameMessage, Text: text[1:], Time: time.Now()})
+	case strings.HasPrefix(text, "/"):
+		err = c.sendFrame(server.Envelope{Type: server.FrameCommand, Text: text, Time: time.Now()})
+	default:
+		err = c.sendFrame(server.Envelope{Type: server.FrameMessage, Text: text, Time: time.Now()})
+	}
+	if err != nil {
+		c.screen.print(styleError, fmt.Sprintf("Not sent: %v", err))
+	}
+}
+
+// sendFrame writes a frame to the current connection
+func (c *chatClient) sendFrame(env server.Envelope) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return errNotConnected
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writeFrame(c.conn, env)
+}
+
+// sendLine writes a plain text line to the current connection
+func (c *chatClient) sendLine(text string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return errNotConnected
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := fmt.Fprintf(c.conn, "%s\n", text)
+	return err
+}
+
+// writeFrame writes one frame as a JSON line
+func writeFrame(w io.Writer, env server.Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// quit closes the connection for good
+func (c *chatClient) quit() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.quitting = true
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *chatClient) isQuitting() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.quitting
+}
+
+func (c *chatClient) currentName() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.name
+}
+
+func (c *chatClient) setState(state string) {
+	c.mutex.Lock()
+	c.state = state
+	c.mutex.Unlock()
+	c.updateStatus()
+}
+
+// updateStatus refreshes the status bar and the prompt, which shows the active room
+func (c *chatClient) updateStatus() {
+	c.mutex.Lock()
+	prompt := "> "
+	switch {
+	case c.pasting:
+		prompt = "[paste] "
+	case c.active != "":
+		prompt = "[#" + c.active + "] "
+	}
+	status := fmt.Sprintf(" %s @ %s | %s", c.name, c.addr, c.state)
+	if c.conn != nil {
+		protocol := "text"
+		if c.json {
+			protocol = "json"
+		}
+		rooms := make([]string, 0, len(c.rooms))
+		for room := range c.rooms {
+			rooms = append(rooms, "#"+room)
+		}
+		sort.Strings(rooms)
+		status += fmt.Sprintf(" (%s) | %s", protocol, strings.Join(rooms, " "))
+	}
+	c.mutex.Unlock()
+	c.screen.setStatus(status)
+	c.screen.setPrompt(prompt)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"chat-server/server"
+)
+
+// sealVersion is the first byte of every sealed whisper
+const sealVersion = 1
+
+// publicKeySize is the length of an X25519 public key
+const publicKeySize = 32
+
+// sealInfo separates whisper keys from anything else derived from the same secrets
+const sealInfo = "chat-client whisper v1"
+
+var errBadSeal = errors.New("malformed encrypted whisper")
+
+// loadIdentity reads the user's long-term X25519 key from path, creating it
+// on first use. Keeping it makes the fingerprint others verify stay the same.
+func loadIdentity(path string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", path, err)
+		}
+		return ecdh.X25519().NewPrivateKey(raw)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(key.Bytes()) + "\n"
+	if err := os.WriteFile(path, []byte(encoded), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// parsePublicKey decodes a base64 X25519 public key from the key directory
+func parsePublicKey(encoded string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// fingerprint formats a public key for comparing out of band, e.g. read out
+// over the phone: the first 20 bytes of its SHA-256 in groups of four hex digits
+func fingerprint(key *ecdh.PublicKey) string {
+	sum := sha256.Sum256(key.Bytes())
+	digits := fmt.Sprintf("%X", sum[:20])
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// whisperKey derives the AES-256 key of one whisper. It mixes a fresh
+// ephemeral secret with the static secret between sender and recipient, so
+// only the recipient can read the whisper and only the sender could have
+// written it.
+func whisperKey(ephemeral, static []byte, ephemeralKey, senderKey, recipientKey *ecdh.PublicKey) []byte {
+	h := sha256.New()
+	h.Write([]byte(sealInfo))
+	for _, part := range [][]byte{ephemeral, static, ephemeralKey.Bytes(), senderKey.Bytes(), recipientKey.Bytes()} {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// whisperAAD binds a sealed whisper to its sender and recipient names
+func whisperAAD(from, to string) []byte {
+	return []byte(from + "\x00" + to)
+}
+
+// seal encrypts a whisper from the owner of sender to the owner of recipient.
+// The result is base64 of: version, sender key, ephemeral key, nonce, ciphertext.
+func seal(sender *ecdh.PrivateKey, recipient *ecdh.PublicKey, from, to, text string) (string, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	ephemeralSecret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return "", err
+	}
+	staticSecret, err := sender.ECDH(recipient)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(whisperKey(ephemeralSecret, staticSecret, ephemeral.PublicKey(), sender.PublicKey(), recipient))
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	blob := []byte{sealVersion}
+	blob = append(blob, sender.PublicKey().Bytes()...)
+	blob = append(blob, ephemeral.PublicKey().Bytes()...)
+	blob = append(blob, nonce...)
+	blob = gcm.Seal(blob, nonce, []byte(text), whisperAAD(from, to))
+	return base64.StdEncoding.EncodeToString(blob), nil
+}
+
+// open decrypts a whisper sealed for recipient and returns it with the key it
+// was sealed with, which tells who wrote it
+func open(recipient *ecdh.PrivateKey, from, to, sealed string) (string, *ecdh.PublicKey, error) {
+	blob, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(blob) < 1+2*publicKeySize || blob[0] != sealVersion {
+		return "", nil, errBadSeal
+	}
+	senderKey, err := ecdh.X25519().NewPublicKey(blob[1 : 1+publicKeySize])
+	if err != nil {
+		return "", nil, errBadSeal
+	}
+	ephemeralKey, err := ecdh.X25519().NewPublicKey(blob[1+publicKeySize : 1+2*publicKeySize])
+	if err != nil {
+		return "", nil, errBadSeal
+	}
+	ephemeralSecret, err := recipient.ECDH(ephemeralKey)
+	if err != nil {
+		return "", nil, err
+	}
+	staticSecret, err := recipient.ECDH(senderKey)
+	if err != nil {
+		return "", nil, err
+	}
+	gcm, err := newGCM(whisperKey(ephemeralSecret, staticSecret, ephemeralKey, senderKey, recipient.PublicKey()))
+	if err != nil {
+		return "", nil, err
+	}
+	rest := blob[1+2*publicKeySize:]
+	if len(rest) < gcm.NonceSize() {
+		return "", nil, errBadSeal
+	}
+	text, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], whisperAAD(from, to))
+	if err != nil {
+		return "", nil, errors.New("whisper was not sealed for this key or was tampered with")
+	}
+	return string(text), senderKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyPins remembers the key first seen for each user of each server, so a
+// key swapped by the server or anyone else is noticed (trust on first use)
+type keyPins struct {
+	path string
+	keys map[string]string // "name@server" -> base64 public key
+}
+
+func loadKeyPins(path string) (*keyPins, error) {
+	pins := &keyPins{path: path, keys: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &pins.keys); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return pins, nil
+}
+
+// check pins key for user if they have none yet. It returns false if a
+// different key is pinned; that pin stays until trust replaces it.
+func (p *keyPins) check(user string, key *ecdh.PublicKey) (bool, error) {
+	encoded := base64.StdEncoding.EncodeToString(key.Bytes())
+	if old, known := p.keys[user]; known {
+		return old == encoded, nil
+	}
+	p.keys[user] = encoded
+	return true, p.save()
+}
+
+// pinned reports whether a key is pinned for user
+func (p *keyPins) pinned(user string) bool {
+	_, known := p.keys[user]
+	return known
+}
+
+// trust pins key for user in place of the key pinned before
+func (p *keyPins) trust(user string, key *ecdh.PublicKey) error {
+	p.keys[user] = base64.StdEncoding.EncodeToString(key.Bytes())
+	return p.save()
+}
+
+// save writes the pins atomically
+func (p *keyPins) save() error {
+	data, err := json.MarshalIndent(p.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// whisperCommands are the commands that send a whisper, which the client
+// encrypts when it can
+var whisperCommands = []string{"/whisper", "/w", "/tell", "/msg"}
+
+// parseWhisper splits a typed whisper command into recipient and text
+func parseWhisper(line string) (to, text string, ok bool) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 || strings.HasPrefix(fields[1], "#") || strings.TrimSpace(fields[2]) == "" {
+		return "", "", false
+	}
+	for _, command := range whisperCommands {
+		if fields[0] == command {
+			return fields[1], fields[2], true
+		}
+	}
+	return "", "", false
+}
+
+// publishKey puts the user's public key in the server's key directory
+func (c *chatClient) publishKey() {
+	if c.identity == nil {
+		return
+	}
+	key := base64.StdEncoding.EncodeToString(c.identity.PublicKey().Bytes())
+	if err := c.sendFrame(server.Envelope{Type: server.FrameKey, Key: key, Time: time.Now()}); err != nil {
+		c.screen.print(styleError, fmt.Sprintf("Error publishing key: %v", err))
+	}
+}
+
+// whisper encrypts a whisper if the recipient's key is known, or asks the
+// server for the key and sends the whisper once it arrives
+func (c *chatClient) whisper(to, text string) error {
+	c.mutex.Lock()
+	key, known := c.keys[to]
+	if !known {
+		// Keyless users are asked about every time, since they may come back with a key
+		c.pending[to] = append(c.pending[to], text)
+		first := len(c.pending[to]) == 1
+		c.mutex.Unlock()
+		if !first {
+			return nil // Already asked for the key
+		}
+		return c.sendFrame(server.Envelope{Type: server.FrameKey, To: to, Time: time.Now()})
+	}
+	name := c.name
+	c.mutex.Unlock()
+
+	sealed, err := seal(c.identity, key, name, to, text)
+	if err != nil {
+		return err
+	}
+	if err := c.sendFrame(server.Envelope{Type: server.FrameWhisper, To: to, Text: sealed, Encrypted: true, Time: time.Now()}); err != nil {
+		return err
+	}
+	c.screen.print(styleWhisper, fmt.Sprintf("%s [Whisper to %s] (e2e): %s", time.Now().Format("15:04"), to, text))
+	return nil
+}
+
+// receiveKey handles the server's answer to a key request: it checks the key
+// against the pinned one and sends the whispers that were waiting for it.
+// Whispers are never sent unencrypted on the client's own account: without a
+// trusted key they are dropped and the user can resend them with /whisper!.
+func (c *chatClient) receiveKey(env server.Envelope) {
+	user := env.From
+	var key *ecdh.PublicKey
+	if env.Key != "" {
+		var err error
+		if key, err = parsePublicKey(env.Key); err != nil {
+			c.screen.print(styleError, fmt.Sprintf("Server sent an invalid key for %s: %v", user, err))
+			return
+		}
+	}
+
+	c.mutex.Lock()
+	pending := c.pending[user]
+	delete(c.pending, user)
+	verifying := c.verifying[user]
+	delete(c.verifying, user)
+	c.mutex.Unlock()
+
+	trusted := key != nil
+	if key != nil {
+		same, err := c.pins.check(user+"@"+c.addr, key)
+		if err != nil {
+			c.screen.print(styleError, fmt.Sprintf("Error saving key of %s: %v", user, err))
+		}
+		if !same {
+			trusted = false
+			c.mutex.Lock()
+			c.changed[user] = key
+			c.mutex.Unlock()
+			c.screen.print(styleError, fmt.Sprintf("The key of %s has changed! Compare fingerprints with /verify %s and accept the new key with /trust %s only if they match.", user, user, user))
+		}
+	}
+	if trusted {
+		c.mutex.Lock()
+		c.keys[user] = key
+		delete(c.changed, user)
+		c.mutex.Unlock()
+	}
+	if verifying {
+		c.showFingerprints(user, key)
+	}
+
+	if len(pending) > 0 && !trusted {
+		notSent := pluralize(len(pending), "whisper") + " to " + user + " not sent"
+		switch {
+		case key != nil:
+			c.screen.print(styleError, notSent+".")
+		case c.pins.pinned(user + "@" + c.addr):
+			c.screen.print(styleError, fmt.Sprintf("%s has a pinned key, but the server offers none: they are offline or use a plain client, or the server is withholding it. %s; /whisper! %s <message> sends one unencrypted.", user, notSent, user))
+		default:
+			c.screen.print(styleSystem, fmt.Sprintf("%s has no encryption key (offline or a plain client); %s. Use /whisper! %s <message> to send it unencrypted.", user, notSent, user))
+		}
+		return
+	}
+	for _, text := range pending {
+		if err := c.whisper(user, text); err != nil {
+			c.screen.print(styleError, fmt.Sprintf("Not sent: %v", err))
+		}
+	}
+}
+
+// openWhisper decrypts an encrypted whisper for display
+func (c *chatClient) openWhisper(env server.Envelope) (style, string) {
+	stamp := env.Time.Local().Format("15:04")
+	if c.identity == nil {
+		return styleError, fmt.Sprintf("%s [Whisper from %s] is encrypted, but encryption is off (-e2e=false).", stamp, env.From)
+	}
+	text, senderKey, err := open(c.identity, env.From, env.To, env.Text)
+	if err != nil {
+		return styleError, fmt.Sprintf("%s Could not decrypt a whisper from %s: %v", stamp, env.From, err)
+	}
+	same, err := c.pins.check(env.From+"@"+c.addr, senderKey)
+	if err != nil {
+		c.screen.print(styleError, fmt.Sprintf("Error saving key of %s: %v", env.From, err))
+	}
+	if !same {
+		c.mutex.Lock()
+		c.changed[env.From] = senderKey
+		c.mutex.Unlock()
+		c.screen.print(styleError, fmt.Sprintf("The key of %s has changed! Compare fingerprints with /verify %s and accept the new key with /trust %s only if they match.", env.From, env.From, env.From))
+		return styleWhisper, fmt.Sprintf("%s [Whisper from %s] (e2e, unverified key): %s", stamp, env.From, text)
+	}
+	return styleWhisper, fmt.Sprintf("%s [Whisper from %s] (e2e): %s", stamp, env.From, text)
+}
+
+// verify handles /verify <user>: it shows both fingerprints to compare out
+// of band, fetching the user's key first
+func (c *chatClient) verify(user string) error {
+	if c.identity == nil {
+		return errors.New("end-to-end encryption is off (-e2e=false)")
+	}
+	c.mutex.Lock()
+	c.verifying[user] = true
+	c.mutex.Unlock()
+	return c.sendFrame(server.Envelope{Type: server.FrameKey, To: user, Time: time.Now()})
+}
+
+// trust handles /trust <user>: it pins the changed key of user in place of the
+// old one, once the fingerprints were compared with /verify
+func (c *chatClient) trust(user string) error {
+	if c.identity == nil {
+		return errors.New("end-to-end encryption is off (-e2e=false)")
+	}
+	c.mutex.Lock()
+	key, changed := c.changed[user]
+	c.mutex.Unlock()
+	if !changed {
+		return fmt.Errorf("no new key of %s to trust; /verify %s shows the current one", user, user)
+	}
+	if err := c.pins.trust(user+"@"+c.addr, key); err != nil {
+		return fmt.Errorf("saving key of %s: %v", user, err)
+	}
+	c.mutex.Lock()
+	delete(c.changed, user)
+	c.keys[user] = key
+	c.mutex.Unlock()
+	c.screen.print(styleSystem, fmt.Sprintf("Now trusting the key of %s: %s", user, fingerprint(key)))
+	return nil
+}
+
+// showFingerprints prints the user's and the other user's fingerprints
+func (c *chatClient) showFingerprints(user string, key *ecdh.PublicKey) {
+	c.screen.print(styleSystem, fmt.Sprintf("Your key:      %s", fingerprint(c.identity.PublicKey())))
+	if key == nil {
+		c.screen.print(styleSystem, fmt.Sprintf("%s has no key (offline or a plain client).", user))
+		return
+	}
+	c.screen.print(styleSystem, fmt.Sprintf("Key of %s: %s", user, fingerprint(key)))
+	c.screen.print(styleSystem, fmt.Sprintf("Ask %s to run /verify %s and compare both lines with theirs, in person or over the phone.", user, c.currentName()))
+	c.mutex.Lock()
+	_, changed := c.changed[user]
+	c.mutex.Unlock()
+	if changed {
+		c.screen.print(styleError, fmt.Sprintf("This is not the key pinned for %s. Run /trust %s only if the fingerprints match.", user, user))
+	}
+}
+
+// pluralize returns "1 whisper" or "n whispers"
+func pluralize(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
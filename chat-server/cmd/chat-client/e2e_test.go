@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"chat-server/server"
+)
+
+func newTestKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	return key
+}
+
+func encodeKey(key *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key.Bytes())
+}
+
+func TestSealOpen(t *testing.T) {
+	alice, bob, carol := newTestKey(t), newTestKey(t), newTestKey(t)
+	sealed, err := seal(alice, bob.PublicKey(), "alice", "bob", "meet at noon")
+	if err != nil {
+		t.Fatalf("seal returned error: %v", err)
+	}
+
+	// flip changes byte i of the sealed blob; negative i counts from its end
+	flip := func(i int) string {
+		blob, _ := base64.StdEncoding.DecodeString(sealed)
+		if i < 0 {
+			i += len(blob)
+		}
+		blob[i] ^= 1
+		return base64.StdEncoding.EncodeToString(blob)
+	}
+
+	tests := []struct {
+		name      string
+		recipient *ecdh.PrivateKey
+		from, to  string
+		sealed    string
+		wantErr   bool
+	}{
+		{"round trip", bob, "alice", "bob", sealed, false},
+		{"tampered ciphertext", bob, "alice", "bob", flip(-1), true},
+		{"tampered sender key", bob, "alice", "bob", flip(1), true},
+		{"wrong recipient", carol, "alice", "bob", sealed, true},
+		{"other sender name", bob, "mallory", "bob", sealed, true},
+		{"other recipient name", bob, "alice", "carol", sealed, true},
+		{"not base64", bob, "alice", "bob", "not base64!", true},
+		{"truncated", bob, "alice", "bob", sealed[:20], true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, senderKey, err := open(tt.recipient, tt.from, tt.to, tt.sealed)
+			switch {
+			case tt.wantErr && err == nil:
+				t.Errorf("open returned %q; expected an error", text)
+			case !tt.wantErr && err != nil:
+				t.Errorf("open returned error: %v", err)
+			case !tt.wantErr && (text != "meet at noon" || !senderKey.Equal(alice.PublicKey())):
+				t.Errorf("open returned %q from %s; expected \"meet at noon\" from alice's key", text, fingerprint(senderKey))
+			}
+		})
+	}
+
+	again, err := seal(alice, bob.PublicKey(), "alice", "bob", "meet at noon")
+	if err != nil {
+		t.Fatalf("seal returned error: %v", err)
+	}
+	if again == sealed {
+		t.Errorf("sealing the same whisper twice gave the same result; expected a fresh ephemeral key and nonce")
+	}
+}
+
+func TestKeyPins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_keys.json")
+	pins, err := loadKeyPins(path)
+	if err != nil {
+		t.Fatalf("loadKeyPins returned error: %v", err)
+	}
+	first, second := newTestKey(t).PublicKey(), newTestKey(t).PublicKey()
+
+	steps := []struct {
+		name  string
+		key   *ecdh.PublicKey
+		trust bool // Call trust instead of check
+		want  bool
+	}{
+		{"first key is pinned", first, false, true},
+		{"same key", first, false, true},
+		{"changed key", second, false, false},
+		{"changed key again", second, false, false},
+		{"pinned key still trusted", first, false, true},
+		{"trust the changed key", second, true, true},
+		{"old key no longer trusted", first, false, false},
+	}
+	for _, step := range steps {
+		if step.trust {
+			if err := pins.trust("bob@chat", step.key); err != nil {
+				t.Fatalf("%s: trust returned error: %v", step.name, err)
+			}
+		}
+		same, err := pins.check("bob@chat", step.key)
+		if err != nil {
+			t.Fatalf("%s: check returned error: %v", step.name, err)
+		}
+		if same != step.want {
+			t.Errorf("%s: check returned %t; expected %t", step.name, same, step.want)
+		}
+	}
+
+	reloaded, err := loadKeyPins(path)
+	if err != nil {
+		t.Fatalf("loadKeyPins returned error: %v", err)
+	}
+	if same, _ := reloaded.check("bob@chat", second); !same {
+		t.Errorf("the trusted key was not kept on disk")
+	}
+	if reloaded.pinned("carol@chat") {
+		t.Errorf("carol has a pinned key; expected none")
+	}
+}
+
+// recordConn stands in for the connection to the server and keeps what the
+// client writes
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error)      { return c.written.Write(p) }
+func (c *recordConn) SetWriteDeadline(time.Time) error { return nil }
+
+// frames returns the frames written since the last call
+func (c *recordConn) frames(t *testing.T) []server.Envelope {
+	t.Helper()
+	var frames []server.Envelope
+	scanner := bufio.NewScanner(&c.written)
+	for scanner.Scan() {
+		var env server.Envelope
+		if err := json.Unmarshal(scanner.Bytes(), &env); err != nil {
+			t.Fatalf("Client sent an invalid frame %q: %v", scanner.Text(), err)
+		}
+		frames = append(frames, env)
+	}
+	return frames
+}
+
+// newTestClient returns a client called alice with encryption on, the
+// connection it writes to and what it prints
+func newTestClient(t *testing.T) (*chatClient, *recordConn, *bytes.Buffer) {
+	t.Helper()
+	printed := new(bytes.Buffer)
+	c := newChatClient("chat:8085", "alice", "", nil, &screen{out: bufio.NewWriter(printed)})
+	pins, err := loadKeyPins(filepath.Join(t.TempDir(), "known_keys.json"))
+	if err != nil {
+		t.Fatalf("loadKeyPins returned error: %v", err)
+	}
+	conn := &recordConn{}
+	c.identity, c.pins, c.conn = newTestKey(t), pins, conn
+	return c, conn, printed
+}
+
+func TestPendingWhispers(t *testing.T) {
+	bob, other := newTestKey(t), newTestKey(t)
+
+	tests := []struct {
+		name     string
+		pinned   *ecdh.PublicKey // Key pinned for bob beforehand
+		offered  string          // Key the server answers with
+		wantSent bool
+		wantText string
+	}{
+		{"first key", nil, encodeKey(bob.PublicKey()), true, "[Whisper to bob] (e2e): hello"},
+		{"pinned key", bob.PublicKey(), encodeKey(bob.PublicKey()), true, "[Whisper to bob] (e2e): hello"},
+		{"changed key", other.PublicKey(), encodeKey(bob.PublicKey()), false, "The key of bob has changed!"},
+		{"no key", nil, "", false, "bob has no encryption key"},
+		{"no key but one pinned", bob.PublicKey(), "", false, "bob has a pinned key, but the server offers none"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, conn, printed := newTestClient(t)
+			if tt.pinned != nil {
+				c.pins.trust("bob@"+c.addr, tt.pinned)
+			}
+
+			if err := c.whisper("bob", "hello"); err != nil {
+				t.Fatalf("whisper returned error: %v", err)
+			}
+			c.whisper("bob", "hello") // Waits for the same answer
+			frames := conn.frames(t)
+			if len(frames) != 1 || frames[0].Type != server.FrameKey || frames[0].To != "bob" {
+				t.Fatalf("client sent %+v; expected a single key request for bob", frames)
+			}
+
+			c.receiveKey(server.Envelope{Type: server.FrameKey, From: "bob", Key: tt.offered})
+			frames = conn.frames(t)
+			if !tt.wantSent {
+				if len(frames) != 0 {
+					t.Errorf("client sent %+v; expected the whispers to be dropped", frames)
+				}
+			} else {
+				if len(frames) != 2 {
+					t.Fatalf("client sent %d frames; expected both whispers", len(frames))
+				}
+				for _, env := range frames {
+					if env.Type != server.FrameWhisper || env.To != "bob" || !env.Encrypted {
+						t.Fatalf("client sent %+v; expected an encrypted whisper to bob", env)
+					}
+					if text, _, err := open(bob, "alice", "bob", env.Text); err != nil || text != "hello" {
+						t.Errorf("bob opened %q, %v; expected \"hello\"", text, err)
+					}
+				}
+			}
+			if !strings.Contains(printed.String(), tt.wantText) {
+				t.Errorf("client printed %q; expected %q", printed.String(), tt.wantText)
+			}
+			if len(c.pending) != 0 {
+				t.Errorf("client still holds %v; expected no pending whispers", c.pending)
+			}
+		})
+	}
+}
+
+func TestTrustChangedKey(t *testing.T) {
+	c, conn, _ := newTestClient(t)
+	bob, other := newTestKey(t), newTestKey(t)
+	c.pins.trust("bob@"+c.addr, other.PublicKey())
+
+	if err := c.trust("bob"); err == nil {
+		t.Errorf("trust with no changed key returned no error")
+	}
+
+	// The changed key is not used until it is trusted
+	c.receiveKey(server.Envelope{Type: server.FrameKey, From: "bob", Key: encodeKey(bob.PublicKey())})
+	c.whisper("bob", "hello")
+	frames := conn.frames(t)
+	if len(frames) != 1 || frames[0].Type != server.FrameKey {
+		t.Fatalf("client sent %+v; expected it to ask for the key again", frames)
+	}
+	c.receiveKey(server.Envelope{Type: server.FrameKey, From: "bob", Key: encodeKey(bob.PublicKey())})
+	if frames := conn.frames(t); len(frames) != 0 {
+		t.Fatalf("client sent %+v; expected nothing with an untrusted key", frames)
+	}
+
+	if err := c.trust("bob"); err != nil {
+		t.Fatalf("trust returned error: %v", err)
+	}
+	c.whisper("bob", "hello")
+	frames = conn.frames(t)
+	if len(frames) != 1 || frames[0].Type != server.FrameWhisper {
+		t.Fatalf("client sent %+v; expected an encrypted whisper", frames)
+	}
+	if text, _, err := open(bob, "alice", "bob", frames[0].Text); err != nil || text != "hello" {
+		t.Errorf("bob opened %q, %v; expected \"hello\"", text, err)
+	}
+}
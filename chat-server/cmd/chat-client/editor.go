@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// key is a decoded keystroke
+type key int
+
+const (
+	keyRune key = iota
+	keyEnter
+	keyTab
+	keyBackspace
+	keyDelete
+	keyLeft
+	keyRight
+	keyUp
+	keyDown
+	keyHome
+	keyEnd
+	keyPageUp
+	keyPageDown
+	keyKillLine // Ctrl+U
+	keyKillEnd  // Ctrl+K
+	keyKillWord // Ctrl+W
+	keyRedraw   // Ctrl+L
+	keyQuit     // Ctrl+C
+	keyEOF      // Ctrl+D: quit on an empty line, delete otherwise
+	keyPaste    // Start of bracketed paste; the text runs up to pasteEnd
+	keyUnknown
+)
+
+// parseKey decodes the keystroke at the start of buf and returns how many
+// bytes it took
+func parseKey(buf []byte) (k key, r rune, size int) {
+	switch b := buf[0]; b {
+	case '\r', '\n':
+		return keyEnter, 0, 1
+	case '\t':
+		return keyTab, 0, 1
+	case 0x7f, 0x08:
+		return keyBackspace, 0, 1
+	case 0x01:
+		return keyHome, 0, 1
+	case 0x05:
+		return keyEnd, 0, 1
+	case 0x02:
+		return keyLeft, 0, 1
+	case 0x06:
+		return keyRight, 0, 1
+	case 0x10:
+		return keyUp, 0, 1
+	case 0x0e:
+		return keyDown, 0, 1
+	case 0x15:
+		return keyKillLine, 0, 1
+	case 0x0b:
+		return keyKillEnd, 0, 1
+	case 0x17:
+		return keyKillWord, 0, 1
+	case 0x0c:
+		return keyRedraw, 0, 1
+	case 0x03:
+		return keyQuit, 0, 1
+	case 0x04:
+		return keyEOF, 0, 1
+	case 0x1b:
+		return parseEscape(buf)
+	}
+	if buf[0] < 0x20 {
+		return keyUnknown, 0, 1
+	}
+	r, size = utf8.DecodeRune(buf)
+	return keyRune, r, size
+}
+
+// parseEscape decodes an escape sequence such as "\x1b[A" for the up arrow
+// or "\x1b[5~" for Page Up
+func parseEscape(buf []byte) (key, rune, int) {
+	if len(buf) < 2 || (buf[1] != '[' && buf[1] != 'O') {
+		return keyUnknown, 0, min(len(buf), 2)
+	}
+	end := 2
+	for end < len(buf) && (buf[end] >= '0' && buf[end] <= '9' || buf[end] == ';') {
+		end++
+	}
+	if end == len(buf) {
+		return keyUnknown, 0, end
+	}
+	params := string(buf[2:end])
+	k := keyUnknown
+	switch buf[end] {
+	case 'A':
+		k = keyUp
+	case 'B':
+		k = keyDown
+	case 'C':
+		k = keyRight
+	case 'D':
+		k = keyLeft
+	case 'H':
+		k = keyHome
+	case 'F':
+		k = keyEnd
+	case '~':
+		switch params {
+		case "1", "7":
+			k = keyHome
+		case "4", "8":
+			k = keyEnd
+		case "3":
+			k = keyDelete
+		case "5":
+			k = keyPageUp
+		case "6":
+			k = keyPageDown
+		case "200":
+			k = keyPaste
+		}
+	}
+	return k, 0, end + 1
+}
+
+// editor is the input line with its history and Tab completion
+type editor struct {
+	input  []rune
+	cursor int
+
+	history  []string
+	recalled int    // Position in history while browsing it, len(history) otherwise
+	draft    []rune // The line being typed before browsing the history
+
+	matches    []string // Candidates of the completion in progress, cycled by Tab
+	match      int
+	matchStart int // Where the completed word starts
+	matchEnd   int // Where the inserted candidate ends
+}
+
+// historyLimit is how many sent lines Up and Down can recall
+const historyLimit = 200
+
+func (e *editor) insert(r rune) {
+	e.input = append(e.input, 0)
+	copy(e.input[e.cursor+1:], e.input[e.cursor:])
+	e.input[e.cursor] = r
+	e.cursor++
+}
+
+func (e *editor) backspace() {
+	if e.cursor > 0 {
+		e.input = append(e.input[:e.cursor-1], e.input[e.cursor:]...)
+		e.cursor--
+	}
+}
+
+func (e *editor) delete() {
+	if e.cursor < len(e.input) {
+		e.input = append(e.input[:e.cursor], e.input[e.cursor+1:]...)
+	}
+}
+
+// killWord deletes the word before the cursor, like Ctrl+W in a shell
+func (e *editor) killWord() {
+	start := e.cursor
+	for start > 0 && e.input[start-1] == ' ' {
+		start--
+	}
+	for start > 0 && e.input[start-1] != ' ' {
+		start--
+	}
+	e.input = append(e.input[:start], e.input[e.cursor:]...)
+	e.cursor = start
+}
+
+// take returns the finished line, clears the editor and remembers the line
+func (e *editor) take() string {
+	text := string(e.input)
+	if strings.TrimSpace(text) != "" && (len(e.history) == 0 || e.history[len(e.history)-1] != text) {
+		e.history = append(e.history, text)
+		if len(e.history) > historyLimit {
+			e.history = e.history[1:]
+		}
+	}
+	e.input, e.cursor = nil, 0
+	e.recalled, e.draft = len(e.history), nil
+	return text
+}
+
+// recall moves through the history, back for negative step
+func (e *editor) recall(step int) {
+	next := e.recalled + step
+	if next < 0 || next > len(e.history) {
+		return
+	}
+	if e.recalled == len(e.history) {
+		e.draft = append([]rune(nil), e.input...)
+	}
+	e.recalled = next
+	if next == len(e.history) {
+		e.input = append([]rune(nil), e.draft...)
+	} else {
+		e.input = []rune(e.history[next])
+	}
+	e.cursor = len(e.input)
+}
+
+// complete replaces the word before the cursor with its next candidate.
+// It returns the candidates when a new completion starts.
+func (e *editor) complete(candidates func(word string, first bool) []string) []string {
+	started := e.matches == nil
+	if started {
+		start := e.cursor
+		for start > 0 && e.input[start-1] != ' ' {
+			start--
+		}
+		e.matches = candidates(string(e.input[start:e.cursor]), start == 0)
+		if len(e.matches) == 0 {
+			e.matches = nil
+			return nil
+		}
+		e.matchStart, e.matchEnd, e.match = start, e.cursor, -1
+	}
+	e.match = (e.match + 1) % len(e.matches)
+	replacement := []rune(e.matches[e.match] + " ")
+	rest := append([]rune(nil), e.input[e.matchEnd:]...)
+	e.input = append(append(e.input[:e.matchStart], replacement...), rest...)
+	e.matchEnd = e.matchStart + len(replacement)
+	e.cursor = e.matchEnd
+	if started {
+		return e.matches
+	}
+	return nil
+}
+
+// pasteEnd ends text pasted into the terminal
+var pasteEnd = []byte("\x1b[201~")
+
+// commandNames are offered by Tab at the start of a line
+var commandNames = []string{
+	"/accept", "/away", "/ban", "/clear", "/decline", "/deop", "/files", "/help", "/history", "/inbox",
+	"/invite", "/invite-only", "/join", "/kick", "/leave", "/me", "/mentions", "/msg", "/mute", "/nick",
+	"/op", "/paste", "/quit", "/read", "/register", "/rooms", "/search", "/send", "/topic", "/trust",
+	"/unban", "/unmute", "/verify", "/whisper", "/whisper!", "/who", "/whois",
+}
+
+// candidates lists completions of word: commands at the start of the line,
+// rooms after "#" and user names otherwise, with or without "@"
+func (c *chatClient) candidates(word string, first bool) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var pool []string
+	prefix := ""
+	switch {
+	case first && strings.HasPrefix(word, "/"):
+		pool = commandNames
+	case strings.HasPrefix(word, "#"):
+		prefix, word = "#", word[1:]
+		for room := range c.roomsSeen {
+			pool = append(pool, room)
+		}
+	default:
+		if strings.HasPrefix(word, "@") {
+			prefix, word = "@", word[1:]
+		}
+		for name := range c.names {
+			pool = append(pool, name)
+		}
+	}
+
+	var matches []string
+	for _, candidate := range pool {
+		if strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(word)) {
+			matches = append(matches, prefix+candidate)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// readKeys edits the input line in the split view until the user quits
+func (c *chatClient) readKeys(in io.Reader) {
+	e := &editor{}
+	buf := make([]byte, 256)
+	var pasted []byte // Text pasted so far, while pasting
+	pasting := false
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; {
+			if pasting {
+				before := len(pasted)
+				pasted = append(pasted, buf[i:n]...)
+				end := bytes.Index(pasted, pasteEnd)
+				if end < 0 {
+					break
+				}
+				i += end + len(pasteEnd) - before
+				c.pasted(e, string(pasted[:end]))
+				pasted, pasting = nil, false
+				continue
+			}
+
+			k, r, size := parseKey(buf[i:n])
+			i += size
+			if k != keyTab {
+				e.matches = nil
+			}
+
+			switch k {
+			case keyRune:
+				e.insert(r)
+			case keyEnter:
+				text := e.take()
+				if isQuit(text) {
+					return
+				}
+				c.submit(text)
+			case keyTab:
+				if matches := e.complete(c.candidates); len(matches) > 1 {
+					c.screen.print(styleSystem, strings.Join(matches, "  "))
+				}
+			case keyBackspace:
+				e.backspace()
+			case keyDelete:
+				e.delete()
+			case keyLeft:
+				e.cursor = max(e.cursor-1, 0)
+			case keyRight:
+				e.cursor = min(e.cursor+1, len(e.input))
+			case keyHome:
+				e.cursor = 0
+			case keyEnd:
+				e.cursor = len(e.input)
+			case keyUp:
+				e.recall(-1)
+			case keyDown:
+				e.recall(1)
+			case keyPageUp:
+				c.screen.page(1)
+			case keyPageDown:
+				c.screen.page(-1)
+			case keyKillLine:
+				e.input, e.cursor = nil, 0
+			case keyKillEnd:
+				e.input = e.input[:e.cursor]
+			case keyKillWord:
+				e.killWord()
+			case keyRedraw:
+				c.screen.redraw()
+			case keyPaste:
+				pasting = true
+			case keyQuit:
+				return
+			case keyEOF:
+				if len(e.input) == 0 {
+					return
+				}
+				e.delete()
+			}
+		}
+		c.screen.setInput(e.input, e.cursor)
+	}
+}
+
+// readLines sends lines from a pipe or a terminal the split view cannot drive.
+// Lines are only read once logged in, so piped input is not lost.
+func (c *chatClient) readLines(in *bufio.Reader) {
+	<-c.ready
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if isQuit(scanner.Text()) {
+			return
+		}
+		c.submit(scanner.Text())
+	}
+}
+
+// isQuit reports whether a typed line asks to leave the client
+func isQuit(text string) bool {
+	text = strings.TrimSpace(text)
+	return text == "/quit" || text == "/exit"
+}
@@ -0,0 +1,156 @@
+// Command chat-client is an interactive terminal client for chat-server.
+//
+// It keeps the scrollback above a status bar and an input line, completes
+// commands, names and rooms with Tab, colors whispers, notices and mentions,
+// reconnects with backoff when the connection drops and encrypts whispers end
+// to end. It speaks the JSON-lines protocol and falls back to plain text if
+// the server does not.
+package main
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8085", "chat server address")
+	name := flag.String("name", "", "user name (asked for if empty)")
+	askPassword := flag.Bool("password", false, "ask for the account password (or set CHAT_PASSWORD)")
+	register := flag.Bool("register", false, "create an account for -name with the password")
+	useTLS := flag.Bool("tls", false, "connect with TLS")
+	caFile := flag.String("ca", "", "PEM CA bundle for verifying the server (default: system roots)")
+	certFile := flag.String("cert", "", "PEM client certificate, for servers that require one")
+	keyFile := flag.String("key", "", "PEM private key of -cert")
+	insecure := flag.Bool("insecure", false, "do not verify the server certificate")
+	textOnly := flag.Bool("text", false, "speak plain text even if the server offers JSON")
+	noColor := flag.Bool("no-color", false, "do not color the scrollback (also NO_COLOR or TERM=dumb)")
+	scrollback := flag.Int("scrollback", 1000, "lines kept in the scrollback")
+	e2e := flag.Bool("e2e", true, "encrypt whispers end to end when the recipient has a key")
+	keyDir := flag.String("key-dir", defaultKeyDir(), "directory for your encryption key and the keys you have seen")
+	downloadDir := flag.String("download-dir", defaultDownloadDir(), "directory where files you /accept are saved")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(out, "\nThe split view works on Linux, macOS and the BSDs. Elsewhere, or when stdin is")
+		fmt.Fprintln(out, "not a terminal, lines are read and printed as they are.")
+	}
+	flag.Parse()
+
+	stdin := bufio.NewReader(os.Stdin)
+	if *name == "" {
+		fmt.Print("Name: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			fatalf("reading name: %v", err)
+		}
+		*name = strings.TrimSpace(line)
+	}
+	password := os.Getenv("CHAT_PASSWORD")
+	if *askPassword || (*register && password == "") {
+		var err error
+		if password, err = readPassword(stdin); err != nil {
+			fatalf("reading password: %v", err)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if *useTLS {
+		tlsConfig = &tls.Config{InsecureSkipVerify: *insecure}
+		if *caFile != "" {
+			pem, err := os.ReadFile(*caFile)
+			if err != nil {
+				fatalf("reading CA bundle: %v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				fatalf("no certificates found in %s", *caFile)
+			}
+		}
+		if *certFile != "" {
+			cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+			if err != nil {
+				fatalf("loading client certificate: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	var identity *ecdh.PrivateKey
+	var pins *keyPins
+	if *e2e {
+		var err error
+		if identity, err = loadIdentity(filepath.Join(*keyDir, "identity")); err != nil {
+			fatalf("loading encryption key: %v", err)
+		}
+		if pins, err = loadKeyPins(filepath.Join(*keyDir, "known_keys.json")); err != nil {
+			fatalf("loading known keys: %v", err)
+		}
+	}
+
+	color := !*noColor && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+	scr := newScreen(os.Stdin, os.Stdout, color, *scrollback)
+	client := newChatClient(*addr, *name, password, tlsConfig, scr)
+	client.register = *register
+	client.textOnly = *textOnly
+	client.identity, client.pins = identity, pins
+	client.downloadDir = *downloadDir
+
+	go func() {
+		err := client.run()
+		scr.close()
+		if err != nil {
+			fatalf("%v", err)
+		}
+		os.Exit(0)
+	}()
+
+	if scr.interactive() {
+		resized := make(chan os.Signal, 1)
+		notifyResize(resized)
+		go func() {
+			for range resized {
+				scr.resize()
+			}
+		}()
+		client.readKeys(stdin)
+	} else {
+		client.readLines(stdin)
+	}
+	client.quit()
+	scr.close()
+}
+
+// readPassword asks for a password without echoing it
+func readPassword(stdin *bufio.Reader) (string, error) {
+	fmt.Print("Password: ")
+	if restore, err := noEcho(int(os.Stdin.Fd())); err == nil {
+		defer func() {
+			restore()
+			fmt.Println()
+		}()
+	}
+	line, err := stdin.ReadString('\n')
+	return strings.TrimSpace(line), err
+}
+
+// defaultKeyDir is where keys are kept unless -key-dir says otherwise
+func defaultKeyDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".chat-client"
+	}
+	return filepath.Join(dir, "chat-client")
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "chat-client: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"chat-server/server"
+)
+
+// describe turns a frame into a scrollback line for the user name, whose
+// active room is active. Lines from other rooms are marked with the room.
+func describe(env server.Envelope, name, active string) (style, string) {
+	stamp := env.Time.Local().Format("15:04")
+	switch {
+	case env.Time.IsZero():
+		stamp = time.Now().Format("15:04")
+	case env.History:
+		stamp = env.Time.Local().Format("Jan 2 15:04")
+	}
+	room := ""
+	if env.Room != "" && env.Room != active {
+		room = "[#" + env.Room + "] "
+	}
+
+	switch env.Type {
+	case server.FrameMessage:
+		text := fmt.Sprintf("%s: %s", env.From, env.Text)
+		switch {
+		case env.Action:
+			text = fmt.Sprintf("* %s %s", env.From, env.Text)
+		case env.Paste:
+			text = fmt.Sprintf("%s pasted:\n  %s", env.From, strings.ReplaceAll(env.Text, "\n", "\n  "))
+		}
+		st := styleNormal
+		switch {
+		case env.History:
+			st = styleHistory
+		case env.From == name:
+			st = styleOwn
+		case env.Mention, mentions(env.Text, name):
+			st = styleMention
+		}
+		return st, stamp + " " + room + text
+	case server.FrameResult:
+		text := fmt.Sprintf("%s: %s", env.From, env.Text)
+		if env.Action {
+			text = fmt.Sprintf("* %s %s", env.From, env.Text)
+		}
+		return styleHistory, fmt.Sprintf("%s #%s %s", env.Time.Local().Format("Jan 2 15:04"), env.Room, strings.ReplaceAll(text, "\n", "\n  "))
+	case server.FrameWhisper:
+		if env.From == name {
+			return styleWhisper, fmt.Sprintf("%s [Whisper to %s]: %s", stamp, env.To, env.Text)
+		}
+		return styleWhisper, fmt.Sprintf("%s [Whisper from %s]: %s", stamp, env.From, env.Text)
+	case server.FrameMention:
+		return styleMention, stamp + " " + env.Text
+	case server.FrameJoin, server.FrameLeave, server.FramePresence:
+		return styleEvent, stamp + " " + room + env.Text
+	case server.FrameError:
+		return styleError, stamp + " " + env.Text
+	default:
+		return styleSystem, stamp + " " + room + env.Text
+	}
+}
+
+// describeText styles a line rendered by the server for plain text clients
+func describeText(line, name string) (style, string) {
+	stamp := time.Now().Format("15:04")
+	switch {
+	case strings.HasPrefix(line, "[Whisper "):
+		return styleWhisper, stamp + " " + line
+	case strings.HasPrefix(line, name+": "), strings.HasPrefix(line, "* "+name+" "):
+		return styleOwn, stamp + " " + line
+	case mentions(line, name):
+		return styleMention, stamp + " " + line
+	default:
+		return styleNormal, stamp + " " + line
+	}
+}
+
+// mentions reports whether text contains name as a whole word, with or
+// without a leading @, ignoring case
+func mentions(text, name string) bool {
+	if name == "" {
+		return false
+	}
+	text, name = strings.ToLower(text), strings.ToLower(name)
+	for from := 0; from < len(text); {
+		i := strings.Index(text[from:], name)
+		if i < 0 {
+			return false
+		}
+		start, end := from+i, from+i+len(name)
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if !isNameRune(before) && !isNameRune(after) {
+			return true
+		}
+		from = start + 1
+	}
+	return false
+}
+
+// isNameRune reports whether r can continue a user name. Dots are left out
+// so "thanks alice." still counts as a mention.
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-'
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// style is how a line of the scrollback is colored
+type style int
+
+const (
+	styleNormal  style = iota
+	styleOwn           // Messages the user sent
+	styleWhisper       // Private messages in either direction
+	styleMention       // Messages that mention the user
+	styleSystem        // Notices from the server or the client
+	styleError         // Failed requests and lost connections
+	styleEvent         // Users joining, leaving and changing names
+	styleHistory       // Messages replayed from the room log
+)
+
+// styleCodes are the ANSI SGR parameters of each style
+var styleCodes = [...]string{
+	styleNormal:  "",
+	styleOwn:     "1",
+	styleWhisper: "35",
+	styleMention: "1;33",
+	styleSystem:  "36",
+	styleError:   "1;31",
+	styleEvent:   "90",
+	styleHistory: "2",
+}
+
+// line is one entry of the scrollback
+type line struct {
+	text  string
+	style style
+}
+
+// screen draws the scrollback above a status bar and the input line. When
+// stdin or stdout is not a terminal it just prints plain lines.
+type screen struct {
+	mutex   sync.Mutex
+	out     *bufio.Writer
+	fd      int  // Terminal whose size and mode are used
+	raw     bool // Drawing the split view; false for plain lines
+	color   bool
+	restore func()
+
+	width, height int
+	lines         []line
+	limit         int // Most lines kept in the scrollback
+	scroll        int // Lines scrolled back from the newest one
+
+	status string
+	prompt string
+	input  []rune
+	cursor int
+}
+
+// newScreen takes over the terminal if there is one
+func newScreen(in, out *os.File, color bool, limit int) *screen {
+	s := &screen{out: bufio.NewWriter(out), fd: int(in.Fd()), limit: limit}
+	if !isTerminal(int(in.Fd())) || !isTerminal(int(out.Fd())) {
+		return s
+	}
+	restore, err := makeRaw(s.fd)
+	if err != nil {
+		return s
+	}
+	s.raw, s.color, s.restore = true, color, restore
+	s.out.WriteString("\x1b[?1049h") // Switch to the alternate screen
+	s.out.WriteString("\x1b[?2004h") // Mark pasted text, so a pasted block can be sent as one message
+	s.resize()
+	return s
+}
+
+// close gives the terminal back in the state it was found
+func (s *screen) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.raw {
+		return
+	}
+	s.out.WriteString("\x1b[?2004l\x1b[?1049l")
+	s.out.Flush()
+	s.restore()
+	s.raw = false
+}
+
+// interactive reports whether keys are read one at a time for the split view
+func (s *screen) interactive() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.raw
+}
+
+// resize picks up the terminal's size and redraws everything
+func (s *screen) resize() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	width, height, err := terminalSize(s.fd)
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+	s.width, s.height = width, height
+	s.draw()
+}
+
+// print adds text to the scrollback, a line per line break. Control
+// characters are dropped so a hostile server cannot take over the terminal.
+func (s *screen) print(st style, text string) {
+	lines := strings.Split(text, "\n")
+	for i, text := range lines {
+		lines[i] = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, text)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.raw {
+		for _, text := range lines {
+			fmt.Fprintln(s.out, text)
+		}
+		s.out.Flush()
+		return
+	}
+	for _, text := range lines {
+		s.lines = append(s.lines, line{text: text, style: st})
+	}
+	if excess := len(s.lines) - s.limit; excess > 0 {
+		s.lines = append(s.lines[:0], s.lines[excess:]...)
+	}
+	if s.scroll > 0 {
+		s.scroll = min(s.scroll+len(lines), len(s.lines)-1) // Keep the view where the user left it
+	}
+	s.draw()
+}
+
+// setStatus changes the text of the status bar
+func (s *screen) setStatus(status string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = status
+	s.draw()
+}
+
+// setPrompt changes the text in front of the input line
+func (s *screen) setPrompt(prompt string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.prompt = prompt
+	s.draw()
+}
+
+// setInput shows the line being edited
+func (s *screen) setInput(input []rune, cursor int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.input = append(s.input[:0], input...)
+	s.cursor = cursor
+	s.draw()
+}
+
+// page scrolls the scrollback by n screens, back for positive n
+func (s *screen) page(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.scroll += n * max(s.height-3, 1)
+	s.scroll = max(min(s.scroll, len(s.lines)-1), 0)
+	s.draw()
+}
+
+// redraw repaints the whole screen, e.g. after another program scribbled on it
+func (s *screen) redraw() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.out.WriteString("\x1b[2J")
+	s.draw()
+}
+
+// draw paints the split view; the caller holds the mutex
+func (s *screen) draw() {
+	rows := s.height - 2
+	if !s.raw || rows < 1 || s.width < 1 {
+		return
+	}
+
+	// Wrap lines from the newest one in view backwards until the view is full
+	var view []string
+	for i := len(s.lines) - 1 - s.scroll; i >= 0 && len(view) < rows; i-- {
+		wrapped := s.wrap(s.lines[i])
+		for j := len(wrapped) - 1; j >= 0 && len(view) < rows; j-- {
+			view = append(view, wrapped[j])
+		}
+	}
+
+	s.out.WriteString("\x1b[?25l") // Hide the cursor while drawing
+	for row := 0; row < rows; row++ {
+		fmt.Fprintf(s.out, "\x1b[%d;1H", row+1)
+		if i := rows - 1 - row; i < len(view) {
+			s.out.WriteString(view[i])
+		}
+		s.out.WriteString("\x1b[K")
+	}
+
+	status := s.status
+	if s.scroll > 0 {
+		status += fmt.Sprintf(" -- scrolled back %d lines (PgDn for newer)", s.scroll)
+	}
+	fmt.Fprintf(s.out, "\x1b[%d;1H\x1b[7m%s\x1b[0m", rows+1, fit(status, s.width))
+
+	// Scroll the input line sideways to keep the cursor on screen
+	prompt := []rune(s.prompt)
+	room := max(s.width-len(prompt)-1, 1)
+	start := max(s.cursor-room, 0)
+	end := min(len(s.input), start+room)
+	fmt.Fprintf(s.out, "\x1b[%d;1H%s%s\x1b[K", rows+2, s.prompt, string(s.input[start:end]))
+	fmt.Fprintf(s.out, "\x1b[%d;%dH\x1b[?25h", rows+2, len(prompt)+s.cursor-start+1)
+	s.out.Flush()
+}
+
+// wrap splits a line into rows of the screen's width, colored by its style.
+// Every character is assumed to take one column.
+func (s *screen) wrap(l line) []string {
+	runes := []rune(l.text)
+	var rows []string
+	for len(runes) > s.width {
+		rows = append(rows, string(runes[:s.width]))
+		runes = runes[s.width:]
+	}
+	rows = append(rows, string(runes))
+	if code := styleCodes[l.style]; s.color && code != "" {
+		for i := range rows {
+			rows[i] = "\x1b[" + code + "m" + rows[i] + "\x1b[0m"
+		}
+	}
+	return rows
+}
+
+// fit pads or cuts text to exactly width characters
+func fit(text string, width int) string {
+	runes := []rune(text)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return text + strings.Repeat(" ", width-len(runes))
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"chat-server/server"
+)
+
+// upload is a file offered with /send, streamed once the server agrees
+type upload struct {
+	path string
+	name string
+	size int64
+}
+
+// download is a file being received after /accept
+type download struct {
+	file     *os.File
+	from     string
+	size     int64
+	received int64
+}
+
+// startPaste enters paste mode: lines are collected until a line with just ".".
+// Plain text servers explain paste mode themselves once the block arrives.
+func (c *chatClient) startPaste() {
+	c.mutex.Lock()
+	c.pasting, c.pasteLines = true, nil
+	json := c.json
+	c.mutex.Unlock()
+	if json {
+		c.screen.print(styleSystem, "Paste mode: type or paste your lines, then a line with just '.' to send them as one message.")
+	}
+	c.updateStatus()
+}
+
+// pasteLine adds a line to the block in paste mode, or sends the block
+func (c *chatClient) pasteLine(text string) error {
+	c.mutex.Lock()
+	if strings.TrimSpace(text) != "." {
+		c.pasteLines = append(c.pasteLines, text)
+		c.mutex.Unlock()
+		return nil
+	}
+	lines := c.pasteLines
+	c.pasting, c.pasteLines = false, nil
+	c.mutex.Unlock()
+	c.updateStatus()
+	return c.sendPaste(lines)
+}
+
+// pasted handles text pasted into the terminal in one go. A single line goes
+// into the input line; several lines are sent as one block, or added to the
+// block in paste mode.
+func (c *chatClient) pasted(e *editor, text string) {
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if len(lines) == 1 {
+		for _, r := range lines[0] {
+			if r == '\t' || r >= ' ' {
+				e.insert(r)
+			}
+		}
+		return
+	}
+
+	c.mutex.Lock()
+	pasting := c.pasting
+	if pasting {
+		c.pasteLines = append(c.pasteLines, lines...)
+	}
+	c.mutex.Unlock()
+	if pasting {
+		c.screen.print(styleSystem, fmt.Sprintf("Added %s; end the paste with a line with just '.'.", pluralize(len(lines), "line")))
+		return
+	}
+	if err := c.sendPaste(lines); err != nil {
+		c.screen.print(styleError, fmt.Sprintf("Not sent: %v", err))
+	}
+}
+
+// sendPaste sends lines as one message. Plain text servers get the lines
+// between "/paste" and ".", which they put together themselves.
+func (c *chatClient) sendPaste(lines []string) error {
+	c.mutex.Lock()
+	json := c.json
+	c.mutex.Unlock()
+	if json {
+		return c.sendFrame(server.Envelope{Type: server.FrameMessage, Text: strings.Join(lines, "\n"), Paste: true, Time: time.Now()})
+	}
+	for _, line := range append(append([]string{"/paste"}, lines...), ".") {
+		if err := c.sendLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendFile offers a file for "/send <user|#room> <path>". The upload starts
+// when the server answers with a file frame carrying the same ID.
+func (c *chatClient) sendFile(args string) error {
+	target, path, _ := strings.Cut(strings.TrimSpace(args), " ")
+	path = strings.TrimSpace(path)
+	if target == "" || path == "" {
+		return errors.New("usage: /send <user|#room> <file>")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+	id := hex.EncodeToString(idBytes)
+	u := &upload{path: path, name: filepath.Base(path), size: info.Size()}
+	offer := server.Envelope{Type: server.FrameFile, ID: id, File: u.name, Size: u.size, Time: time.Now()}
+	if strings.HasPrefix(target, "#") {
+		offer.Room = target[1:]
+	} else {
+		offer.To = target
+	}
+
+	c.mutex.Lock()
+	c.uploads[id] = u
+	c.mutex.Unlock()
+	return c.sendFrame(offer)
+}
+
+// receiveFile handles a file frame: the go-ahead for one of our uploads, or
+// an offer from someone else
+func (c *chatClient) receiveFile(env server.Envelope) {
+	c.mutex.Lock()
+	u := c.uploads[env.ID]
+	c.mutex.Unlock()
+	stamp := time.Now().Format("15:04")
+	if u != nil && env.From == "" {
+		c.screen.print(styleSystem, stamp+" "+env.Text)
+		go c.upload(env.ID, u)
+		return
+	}
+	c.screen.print(styleWhisper, stamp+" "+env.Text)
+}
+
+// uploadFailed forgets an upload the server refused
+func (c *chatClient) uploadFailed(id string) {
+	c.mutex.Lock()
+	delete(c.uploads, id)
+	c.mutex.Unlock()
+}
+
+// upload streams a file the server agreed to take in chunk frames
+func (c *chatClient) upload(id string, u *upload) {
+	defer c.uploadFailed(id)
+	file, err := os.Open(u.path)
+	if err != nil {
+		c.screen.print(styleError, fmt.Sprintf("Upload of %s failed: %v", u.name, err))
+		return
+	}
+	defer file.Close()
+
+	buf := make([]byte, server.FileChunkSize)
+	for sent := int64(0); sent < u.size; {
+		n, err := io.ReadFull(file, buf[:min(int64(len(buf)), u.size-sent)])
+		if err != nil {
+			c.screen.print(styleError, fmt.Sprintf("Upload of %s failed: the file changed while it was being sent (%v).", u.name, err))
+			return
+		}
+		chunk := server.Envelope{Type: server.FrameChunk, ID: id, Data: base64.StdEncoding.EncodeToString(buf[:n]), Time: time.Now()}
+		if err := c.sendFrame(chunk); err != nil {
+			c.screen.print(styleError, fmt.Sprintf("Upload of %s failed: %v", u.name, err))
+			return
+		}
+		sent += int64(n)
+	}
+}
+
+// receiveChunk writes a chunk of an accepted file to the download directory.
+// The first chunk names the file.
+func (c *chatClient) receiveChunk(env server.Envelope) {
+	c.mutex.Lock()
+	d := c.downloads[env.ID]
+	c.mutex.Unlock()
+	if d == nil {
+		file, err := createDownload(c.downloadDir, env.File)
+		if err != nil {
+			c.screen.print(styleError, fmt.Sprintf("Cannot save %s: %v", env.File, err))
+			return
+		}
+		d = &download{file: file, from: env.From, size: env.Size}
+		c.mutex.Lock()
+		c.downloads[env.ID] = d
+		c.mutex.Unlock()
+	}
+
+	data, err := base64.StdEncoding.DecodeString(env.Data)
+	if err == nil {
+		_, err = d.file.Write(data)
+	}
+	d.received += int64(len(data))
+	if err == nil && d.received < d.size {
+		return
+	}
+
+	c.mutex.Lock()
+	delete(c.downloads, env.ID)
+	c.mutex.Unlock()
+	if closeErr := d.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(d.file.Name())
+		c.screen.print(styleError, fmt.Sprintf("Download of %s failed: %v", filepath.Base(d.file.Name()), err))
+		return
+	}
+	c.screen.print(styleSystem, fmt.Sprintf("Saved %s from %s to %s.", formatSize(d.size), d.from, d.file.Name()))
+}
+
+// dropTransfers abandons uploads and deletes partial downloads when the
+// connection drops, since the server forgets them
+func (c *chatClient) dropTransfers() {
+	c.mutex.Lock()
+	downloads := c.downloads
+	c.uploads = make(map[string]*upload)
+	c.downloads = make(map[string]*download)
+	c.mutex.Unlock()
+	for _, d := range downloads {
+		d.file.Close()
+		os.Remove(d.file.Name())
+		c.screen.print(styleError, fmt.Sprintf("Download of %s was interrupted.", filepath.Base(d.file.Name())))
+	}
+}
+
+// createDownload creates a new file in dir for a download called name,
+// adding a number to the name rather than overwriting an existing file
+func createDownload(dir, name string) (*os.File, error) {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == ".." || name == "/" {
+		return nil, fmt.Errorf("invalid file name")
+	}
+	ext := filepath.Ext(name)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+		}
+		file, err := os.OpenFile(filepath.Join(dir, candidate), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if !errors.Is(err, os.ErrExist) {
+			return file, err
+		}
+	}
+}
+
+// defaultDownloadDir is ~/Downloads if it exists, the working directory otherwise
+func defaultDownloadDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		dir := filepath.Join(home, "Downloads")
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return "."
+}
+
+// formatSize formats a byte count for people
+func formatSize(n int64) string {
+	switch {
+	case n < 1024:
+		return pluralize(int(n), "byte")
+	case n < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	}
+}
@@ -0,0 +1,11 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// ioctl requests that read and write the terminal settings
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+)
@@ -0,0 +1,30 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// errNoTerminal is returned on systems where the split view is not supported;
+// the client then falls back to reading and printing plain lines.
+var errNoTerminal = errors.New("terminal control is not supported on this system")
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errNoTerminal
+}
+
+func noEcho(fd int) (restore func(), err error) {
+	return nil, errNoTerminal
+}
+
+func terminalSize(fd int) (width, height int, err error) {
+	return 0, 0, errNoTerminal
+}
+
+func notifyResize(c chan<- os.Signal) {}
@@ -2,12 +2,217 @@ package main
 
 import (
 	"chat-server/server" // Import the server package
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// settings collects the Key=value pairs of repeated -set flags
+type settings []string
+
+func (s *settings) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *settings) Set(value string) error {
+	if key, _, ok := strings.Cut(value, "="); !ok || key == "" {
+		return errors.New("want Key=value, e.g. MaxConnsPerIP=20")
+	}
+	*s = append(*s, value)
+	return nil
+}
+
 func main() {
-	chatServer := server.NewServer()
-	port := "8085" // You can change the port here
-	log.Printf("Starting chat server on port %s...", port)
-	chatServer.Start(port)
+	defaults := server.DefaultConfig()
+	configFile := flag.String("config", "", "JSON config file, re-read on SIGHUP")
+	listen := flag.String("listen", defaults.ListenAddr, "chat listen address")
+	port := flag.String("port", "", "chat port; short for -listen :PORT")
+	defaultRoom := flag.String("default-room", defaults.DefaultRoom, "room new users start in")
+	motd := flag.String("motd", "", "message of the day shown after login")
+	logLevel := flag.String("log-level", defaults.LogLevel.String(), "least severe messages to log: debug, info, warn or error")
+	wsAddr := flag.String("ws-addr", defaults.WebSocketAddr, "WebSocket and web client listen address (empty disables it)")
+	adminAddr := flag.String("admin-addr", defaults.AdminAddr, "admin API listen address (empty disables it)")
+	dataDir := flag.String("data", "data", "directory for accounts, rooms, history, mailboxes, mentions and file transfers")
+	nodeName := flag.String("node", "", "name of this node in a cluster (default host:port)")
+	clusterAddr := flag.String("cluster-addr", "", "listen address for links from other nodes")
+	peers := flag.String("peers", "", "comma-separated cluster addresses of the other nodes")
+	clusterSecret := flag.String("cluster-secret", "", "shared secret of the cluster; other users can read it with ps, so prefer -cluster-secret-file or CHAT_CLUSTER_SECRET")
+	clusterSecretFile := flag.String("cluster-secret-file", "", "file holding the shared secret of the cluster")
+	pingInterval := flag.Duration("ping-interval", defaults.PingInterval, "ping JSON clients that are silent for this long (0 disables pings)")
+	idleKick := flag.Duration("idle-kick", 0, "disconnect users who send nothing for this long (0 never kicks them)")
+	bots := flag.String("bots", "", "comma-separated bots to run: echo, dice")
+	alertKeywords := flag.String("alert-keywords", "", "comma-separated keywords that trigger an alert whisper")
+	alertTo := flag.String("alert-to", "", "comma-separated users who receive keyword alerts")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file; enables TLS together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "PEM private key file")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM CA bundle for verifying client certificates")
+	tlsRequireClientCert := flag.Bool("tls-require-client-cert", false, "reject clients without a valid certificate")
+	genCert := flag.String("gen-cert", "", "write a self-signed certificate for these comma-separated hosts to -tls-cert/-tls-key and exit")
+	var sets settings
+	flag.Var(&sets, "set", "set any Config field, e.g. -set MaxConnsPerIP=20 -set MessageRate=5 (repeatable; applied after the other flags)")
+	flag.Parse()
+
+	if *genCert != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatalf("-gen-cert needs -tls-cert and -tls-key")
+		}
+		if err := server.GenerateSelfSignedCert(*tlsCert, *tlsKey, strings.Split(*genCert, ",")); err != nil {
+			log.Fatalf("Error generating certificate: %v", err)
+		}
+		log.Printf("Wrote self-signed certificate to %s and key to %s", *tlsCert, *tlsKey)
+		return
+	}
+
+	// loadConfig layers the defaults, the config file, CHAT_* environment
+	// variables and the flags given on the command line, each overriding the last
+	loadConfig := func() (server.Config, error) {
+		cfg := server.DefaultConfig()
+		if *configFile != "" {
+			if err := server.LoadConfigFile(*configFile, &cfg); err != nil {
+				return cfg, err
+			}
+		}
+		if err := server.ApplyEnv(&cfg, os.LookupEnv); err != nil {
+			return cfg, err
+		}
+		var err error
+		fail := func(e error) {
+			if err == nil {
+				err = e
+			}
+		}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "listen":
+				cfg.ListenAddr = *listen
+			case "port":
+				cfg.ListenAddr = ":" + *port
+			case "default-room":
+				cfg.DefaultRoom = *defaultRoom
+			case "motd":
+				cfg.MOTD = *motd
+			case "log-level":
+				level, levelErr := server.ParseLogLevel(*logLevel)
+				if levelErr != nil {
+					fail(levelErr)
+				}
+				cfg.LogLevel = level
+			case "ws-addr":
+				cfg.WebSocketAddr = *wsAddr
+			case "admin-addr":
+				cfg.AdminAddr = *adminAddr
+			case "data":
+				cfg.SetDataDir(*dataDir)
+			case "node":
+				cfg.NodeName = *nodeName
+			case "cluster-addr":
+				cfg.ClusterAddr = *clusterAddr
+			case "peers":
+				cfg.ClusterPeers = nil
+				if *peers != "" {
+					cfg.ClusterPeers = strings.Split(*peers, ",")
+				}
+			case "cluster-secret":
+				cfg.ClusterSecret = *clusterSecret
+			case "cluster-secret-file":
+				data, readErr := os.ReadFile(*clusterSecretFile)
+				if readErr != nil {
+					fail(fmt.Errorf("reading cluster secret: %v", readErr))
+				}
+				cfg.ClusterSecret = strings.TrimSpace(string(data))
+			case "ping-interval":
+				cfg.PingInterval = *pingInterval
+			case "idle-kick":
+				cfg.IdleKickAfter = *idleKick
+			case "tls-cert":
+				cfg.TLSCertFile = *tlsCert
+			case "tls-key":
+				cfg.TLSKeyFile = *tlsKey
+			case "tls-client-ca":
+				cfg.TLSClientCAFile = *tlsClientCA
+			case "tls-require-client-cert":
+				cfg.TLSRequireClientCert = *tlsRequireClientCert
+			}
+		})
+		for _, setting := range sets {
+			key, value, _ := strings.Cut(setting, "=")
+			if setErr := server.SetConfigValue(&cfg, key, value); setErr != nil {
+				fail(fmt.Errorf("-set %s: %v", key, setErr))
+			}
+		}
+		if err == nil {
+			err = cfg.Validate()
+		}
+		return cfg, err
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+
+	chatServer := server.NewServerWithConfig(cfg)
+	var plugins []server.Plugin
+	for _, bot := range strings.Split(*bots, ",") {
+		switch strings.TrimSpace(bot) {
+		case "":
+		case "echo":
+			plugins = append(plugins, server.EchoBot())
+		case "dice":
+			plugins = append(plugins, server.DiceBot())
+		default:
+			log.Fatalf("Unknown bot '%s'", bot)
+		}
+	}
+	if *alertKeywords != "" {
+		plugins = append(plugins, server.KeywordAlertBot(strings.Split(*alertKeywords, ","), strings.Split(*alertTo, ",")))
+	}
+	for _, plugin := range plugins {
+		if err := chatServer.RegisterPlugin(plugin); err != nil {
+			log.Fatalf("Error registering plugin: %v", err)
+		}
+	}
+
+	log.Printf("Starting chat server on %s...", cfg.ListenAddr)
+	if err := chatServer.Listen(cfg.ListenAddr); err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+
+	// Reload the configuration on SIGHUP; shut down gracefully on Ctrl+C or SIGTERM
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				break
+			}
+			cfg, err := loadConfig()
+			if err != nil {
+				log.Printf("Error reloading configuration: %v", err)
+				continue
+			}
+			if err := chatServer.Reload(cfg); err != nil {
+				log.Printf("Error reloading configuration: %v", err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := chatServer.Shutdown(ctx); err != nil {
+			log.Printf("Error during shutdown: %v", err)
+		}
+	}()
+
+	if err := chatServer.Serve(); err != nil {
+		log.Fatalf("Error serving: %v", err)
+	}
+	<-stopped
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSettings(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"MaxConnsPerIP=20", false},
+		{"MOTD=a=b", false},
+		{"MOTD=", false},
+		{"MaxConnsPerIP", true},
+		{"=20", true},
+		{"", true},
+	}
+
+	var sets settings
+	var want []string
+	for _, tt := range tests {
+		err := sets.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) returned %v; expected error %t", tt.value, err, tt.wantErr)
+		}
+		if err == nil {
+			want = append(want, tt.value)
+		}
+	}
+	if got := sets.String(); got != strings.Join(want, " ") {
+		t.Errorf("settings are %q; expected %q", got, strings.Join(want, " "))
+	}
+}
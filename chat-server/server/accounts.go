@@ -0,0 +1,206 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	passwordIterations = 100000
+	passwordSaltSize   = 16
+	passwordKeySize    = 32
+	minPasswordLength  = 6
+)
+
+var (
+	errAccountExists   = errors.New("name is already registered")
+	errBadCredentials  = errors.New("invalid name or password")
+	errPasswordTooWeak = fmt.Errorf("password must be at least %d characters", minPasswordLength)
+)
+
+// Account is a registered user stored in the accounts file
+type Account struct {
+	Name       string    `json:"name"`
+	Salt       string    `json:"salt"` // Hex-encoded random salt
+	Hash       string    `json:"hash"` // Hex-encoded PBKDF2-HMAC-SHA256 of the password
+	Iterations int       `json:"iterations"`
+	Created    time.Time `json:"created"`
+}
+
+// accountStore keeps registered accounts in a JSON file
+type accountStore struct {
+	path     string
+	accounts map[string]*Account
+	mutex    sync.Mutex
+}
+
+func newAccountStore(path string) *accountStore {
+	store := &accountStore{
+		path:     path,
+		accounts: make(map[string]*Account),
+	}
+	if path == "" {
+		return store
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logErrorf("Error reading accounts file %s: %v", path, err)
+		}
+		return store
+	}
+	var accounts []*Account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		logErrorf("Error parsing accounts file %s: %v", path, err)
+		return store
+	}
+	for _, account := range accounts {
+		key := accountKey(account.Name)
+		if other, ok := store.accounts[key]; ok {
+			logWarnf("Ignoring account '%s' in %s: it differs from '%s' only in case", account.Name, path, other.Name)
+			continue
+		}
+		store.accounts[key] = account
+	}
+	return store
+}
+
+// accountKey folds the case of a name, so names that differ only in case
+// belong to the same account
+func accountKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// Exists reports whether name belongs to a registered account, ignoring case
+func (a *accountStore) Exists(name string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, ok := a.accounts[accountKey(name)]
+	return ok
+}
+
+// Matching returns the registered names that equal name, ignoring case
+func (a *accountStore) Matching(name string) []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if account, ok := a.accounts[accountKey(name)]; ok {
+		return []string{account.Name}
+	}
+	return nil
+}
+
+// Register creates a new account and saves the accounts file
+func (a *accountStore) Register(name, password string) error {
+	if len(password) < minPasswordLength {
+		return errPasswordTooWeak
+	}
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	key := accountKey(name)
+	if _, ok := a.accounts[key]; ok {
+		return errAccountExists
+	}
+	account := &Account{
+		Name:       name,
+		Salt:       hex.EncodeToString(salt),
+		Hash:       hex.EncodeToString(pbkdf2SHA256([]byte(password), salt, passwordIterations, passwordKeySize)),
+		Iterations: passwordIterations,
+		Created:    time.Now(),
+	}
+	a.accounts[key] = account
+	if err := a.save(); err != nil {
+		delete(a.accounts, key)
+		return err
+	}
+	return nil
+}
+
+// Authenticate checks a password against the stored hash. name may differ
+// from the account's in case; the account's own spelling is returned.
+func (a *accountStore) Authenticate(name, password string) (string, error) {
+	a.mutex.Lock()
+	account, ok := a.accounts[accountKey(name)]
+	a.mutex.Unlock()
+	if !ok {
+		return "", errBadCredentials
+	}
+
+	salt, err := hex.DecodeString(account.Salt)
+	if err != nil {
+		return "", errBadCredentials
+	}
+	want, err := hex.DecodeString(account.Hash)
+	if err != nil {
+		return "", errBadCredentials
+	}
+	got := pbkdf2SHA256([]byte(password), salt, account.Iterations, len(want))
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return "", errBadCredentials
+	}
+	return account.Name, nil
+}
+
+// save writes all accounts to disk. The caller must hold a.mutex.
+func (a *accountStore) save() error {
+	if a.path == "" {
+		return nil
+	}
+	accounts := make([]*Account, 0, len(a.accounts))
+	for _, account := range a.accounts {
+		accounts = append(accounts, account)
+	}
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o755); err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// pbkdf2SHA256 derives a key from password as specified in RFC 8018
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// The first two are the PBKDF2-HMAC-SHA256 vectors of RFC 7914, section 11
+	tests := []struct {
+		password, salt string
+		iterations     int
+		keyLen         int
+		want           string
+	}{
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, 64, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		{"password", "salt", 1, 32, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, 32, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, 32, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, 40, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+	}
+
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations, tt.keyLen))
+		if got != tt.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d, %d) = %s; expected %s", tt.password, tt.salt, tt.iterations, tt.keyLen, got, tt.want)
+		}
+	}
+}
+
+func TestAccountStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	store := newAccountStore(path)
+	if err := store.Register("Alice", "secretpass1"); err != nil {
+		t.Fatalf("Register(\"Alice\") returned error: %v", err)
+	}
+
+	registerTests := []struct {
+		name, password string
+		wantErr        error
+	}{
+		{"Alice", "secretpass2", errAccountExists},
+		{"alice", "secretpass2", errAccountExists},
+		{"bob", "short", errPasswordTooWeak},
+	}
+	for _, tt := range registerTests {
+		if err := store.Register(tt.name, tt.password); !errors.Is(err, tt.wantErr) {
+			t.Errorf("Register(%q, %q) returned %v; expected %v", tt.name, tt.password, err, tt.wantErr)
+		}
+	}
+
+	// A reloaded store must agree with the one that wrote the file
+	for _, s := range []*accountStore{store, newAccountStore(path)} {
+		authTests := []struct {
+			name, password string
+			wantName       string
+			wantErr        error
+		}{
+			{"Alice", "secretpass1", "Alice", nil},
+			{"ALICE", "secretpass1", "Alice", nil},
+			{"Alice", "secretpass2", "", errBadCredentials},
+			{"bob", "secretpass1", "", errBadCredentials},
+		}
+		for _, tt := range authTests {
+			name, err := s.Authenticate(tt.name, tt.password)
+			if name != tt.wantName || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Authenticate(%q, %q) = %q, %v; expected %q, %v", tt.name, tt.password, name, err, tt.wantName, tt.wantErr)
+			}
+		}
+
+		if !s.Exists("alice") || s.Exists("bob") {
+			t.Errorf("Exists(\"alice\") = %t and Exists(\"bob\") = %t; expected true and false", s.Exists("alice"), s.Exists("bob"))
+		}
+		if got := s.Matching("aLiCe"); len(got) != 1 || got[0] != "Alice" {
+			t.Errorf("Matching(\"aLiCe\") = %q; expected [Alice]", got)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AdminClient describes a connected client in the admin API
+type AdminClient struct {
+	Name         string    `json:"name"`
+	Room         string    `json:"room"` // Active room
+	Rooms        []string  `json:"rooms"`
+	RemoteAddr   string    `json:"remote_addr"`
+	Protocol     string    `json:"protocol"`
+	Registered   bool      `json:"registered"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	ConnectedFor string    `json:"connected_for"`
+	LastActive   time.Time `json:"last_active"`
+	Idle         bool      `json:"idle"`
+	Away         string    `json:"away,omitempty"`
+}
+
+// AdminRoom describes a room in the admin API
+type AdminRoom struct {
+	Name       string   `json:"name"`
+	Members    []string `json:"members"`
+	Owner      string   `json:"owner,omitempty"`
+	Moderators []string `json:"moderators,omitempty"`
+	Topic      string   `json:"topic,omitempty"`
+	InviteOnly bool     `json:"invite_only,omitempty"`
+	Banned     []string `json:"banned,omitempty"`
+}
+
+// AdminPeer describes a linked cluster node in the admin API
+type AdminPeer struct {
+	Node  string   `json:"node"`
+	Addr  string   `json:"addr"`
+	Users []string `json:"users"`
+}
+
+// AdminState is the full server state returned by GET /state
+type AdminState struct {
+	Time    time.Time     `json:"time"`
+	Node    string        `json:"node,omitempty"`
+	Clients []AdminClient `json:"clients"`
+	Rooms   []AdminRoom   `json:"rooms"`
+	Peers   []AdminPeer   `json:"peers"`
+}
+
+// startAdmin serves the admin API on addr. Without an AdminToken it only
+// listens on loopback.
+func (s *Server) startAdmin(addr string) error {
+	if s.config().AdminToken == "" && !isLoopback(addr) {
+		return fmt.Errorf("starting admin API: %s is not a loopback address; set AdminToken to serve the admin API there", addr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", s.adminOnly(http.MethodGet, s.handleAdminState))
+	mux.HandleFunc("/clients", s.adminOnly(http.MethodGet, s.handleAdminClients))
+	mux.HandleFunc("/rooms", s.adminOnly(http.MethodGet, s.handleAdminRooms))
+	mux.HandleFunc("/peers", s.adminOnly(http.MethodGet, s.handleAdminPeers))
+	mux.HandleFunc("/kick", s.adminOnly(http.MethodPost, s.handleAdminKick))
+	mux.HandleFunc("/announce", s.adminOnly(http.MethodPost, s.handleAdminAnnounce))
+	mux.HandleFunc("/metrics", s.adminOnly(http.MethodGet, s.handleMetrics))
+	mux.HandleFunc("/export", s.adminOnly(http.MethodGet, s.handleAdminExport))
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("starting admin API: %v", err)
+	}
+	httpServer := &http.Server{Handler: mux, ReadHeaderTimeout: httpHeaderTimeout, IdleTimeout: httpIdleTimeout}
+
+	s.mutex.Lock()
+	s.adminServer = httpServer
+	s.adminAddr = listener.Addr()
+	s.mutex.Unlock()
+
+	logInfof("Admin API started on %s", listener.Addr())
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logInfof("Admin API stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// AdminAddr returns the address of the admin API, or nil if it is not running
+func (s *Server) AdminAddr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.adminAddr
+}
+
+// isLoopback reports whether a listen address only accepts local connections
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && isLoopbackHost(host)
+}
+
+// isLoopbackHost reports whether host, without a port, is "localhost" or a
+// loopback IP address
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminOnly wraps an admin handler with method and token checks. Requests
+// made by web pages are refused, and so are POSTs that are not JSON, so a page
+// the operator visits cannot use the API behind their back. Without a token,
+// requests must also name a loopback host: a page on another domain that
+// resolves to 127.0.0.1 (DNS rebinding) sends no Origin on its own GETs, but
+// it cannot change the Host header from its own domain.
+func (s *Server) adminOnly(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Origin") != "" {
+			http.Error(w, "Requests from web pages are not allowed", http.StatusForbidden)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]") // No port
+		}
+		if s.config().AdminToken == "" && !isLoopbackHost(host) {
+			http.Error(w, "Without an AdminToken the admin API only answers to localhost", http.StatusForbidden)
+			return
+		}
+		if method == http.MethodPost {
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		if token := s.config().AdminToken; token != "" {
+			got := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// writeJSON sends v as an indented JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logErrorf("Error writing admin response: %v", err)
+	}
+}
+
+// snapshot copies the server state for the admin API
+func (s *Server) snapshot() AdminState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	state := AdminState{Time: now, Clients: []AdminClient{}, Rooms: []AdminRoom{}}
+	for _, client := range s.clients {
+		protocol := "text"
+		if client.protocol == ProtocolJSON {
+			protocol = "json"
+		}
+		state.Clients = append(state.Clients, AdminClient{
+			Name:         client.name(),
+			Room:         client.room,
+			Rooms:        client.roomNames(),
+			RemoteAddr:   client.conn.RemoteAddr().String(),
+			Protocol:     protocol,
+			Registered:   client.registered,
+			ConnectedAt:  client.connectedAt,
+			ConnectedFor: now.Sub(client.connectedAt).Round(time.Second).String(),
+			LastActive:   client.lastActiveAt(),
+			Idle:         s.idleFor(client, now) > 0,
+			Away:         client.away,
+		})
+	}
+	sort.Slice(state.Clients, func(i, j int) bool { return state.Clients[i].Name < state.Clients[j].Name })
+
+	for roomName, roomClients := range s.rooms {
+		room := AdminRoom{Name: roomName, Members: []string{}}
+		for name := range roomClients {
+			room.Members = append(room.Members, name)
+		}
+		sort.Strings(room.Members)
+		if meta, ok := s.roomState.rooms[roomName]; ok {
+			room.Owner = meta.Owner
+			room.Topic = meta.Topic
+			room.InviteOnly = meta.InviteOnly
+			for name := range meta.Moderators {
+				room.Moderators = append(room.Moderators, name)
+			}
+			for name := range meta.Banned {
+				room.Banned = append(room.Banned, name)
+			}
+			sort.Strings(room.Moderators)
+			sort.Strings(room.Banned)
+		}
+		state.Rooms = append(state.Rooms, room)
+	}
+	sort.Slice(state.Rooms, func(i, j int) bool { return state.Rooms[i].Name < state.Rooms[j].Name })
+	state.Node = s.cluster.node
+	state.Peers = s.peerNodes()
+	return state
+}
+
+// handleAdminState serves GET /state
+func (s *Server) handleAdminState(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.snapshot())
+}
+
+// handleAdminClients serves GET /clients
+func (s *Server) handleAdminClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.snapshot().Clients)
+}
+
+// handleAdminRooms serves GET /rooms
+func (s *Server) handleAdminRooms(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.snapshot().Rooms)
+}
+
+// handleAdminPeers serves GET /peers
+func (s *Server) handleAdminPeers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.peerNodes())
+}
+
+// handleAdminKick serves POST /kick {"user": "...", "reason": "..."}
+func (s *Server) handleAdminKick(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User   string `json:"user"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.User == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `expected {"user": "...", "reason": "..."}`})
+		return
+	}
+
+	s.mutex.Lock()
+	client, ok := s.usernames[req.User]
+	s.mutex.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("user '%s' not found", req.User)})
+		return
+	}
+
+	if req.Reason != "" {
+		client.errorf("You were disconnected by an administrator: %s", req.Reason)
+	} else {
+		client.errorf("You were disconnected by an administrator.")
+	}
+	go client.close() // Flush the notice; the reader then unregisters the client
+	logInfof("Admin kicked %s (%s).", req.User, req.Reason)
+	writeJSON(w, http.StatusOK, map[string]string{"kicked": req.User})
+}
+
+// handleAdminAnnounce serves POST /announce {"text": "..."}
+func (s *Server) handleAdminAnnounce(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Text == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `expected {"text": "..."}`})
+		return
+	}
+
+	recipients := s.announceAll(req.Text)
+	logInfof("Admin announcement to %d clients: %s", recipients, req.Text)
+	writeJSON(w, http.StatusOK, map[string]int{"recipients": recipients})
+}
+
+// handleAdminExport serves GET /export?q=...&room=...&from=...&since=...&format=text.
+// It writes every indexed message that matches, oldest first, as JSON lines,
+// or as a plain text transcript with format=text. All parameters are optional.
+func (s *Server) handleAdminExport(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q, err := newSearchQuery(params.Get("q"), params.Get("room"), params.Get("from"), params.Get("since"), time.Now())
+	if err != nil {
+		// Only since can fail to parse
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be a date such as 2024-05-01 or 2024-05-01T14:00, today, yesterday or an age such as 12h or 3d"})
+		return
+	}
+	format := params.Get("format")
+	if format != "" && format != "json" && format != "text" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format must be json or text"})
+		return
+	}
+
+	results, _ := s.search.search(q, nil, 0)
+	if format == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	enc := json.NewEncoder(w)
+	for i := len(results) - 1; i >= 0; i-- {
+		if format == "text" {
+			env := Envelope{Type: FrameResult, Time: results[i].Time, Room: results[i].Room, From: results[i].From,
+				Text: results[i].Text, Action: results[i].Action, Paste: results[i].Paste}
+			_, err = fmt.Fprintln(w, env.render("", ""))
+		} else {
+			err = enc.Encode(results[i])
+		}
+		if err != nil {
+			logErrorf("Error writing export: %v", err)
+			return
+		}
+	}
+	logInfof("Admin exported %s", pluralize(len(results), "message"))
+}
+
+// announceAll sends a server-wide announcement to every connected client
+func (s *Server) announceAll(text string) int {
+	env := newEnvelope(FrameSystem)
+	env.From = "server"
+	env.Text = "[Announcement] " + text
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, client := range s.clients {
+		if err := client.send(env); err != nil {
+			logErrorf("Error sending announcement to %s: %v", client.name(), err)
+		}
+	}
+	return len(s.clients)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// adminRequest sends a request to the admin API of s and returns the status
+// and body of the response
+func adminRequest(t *testing.T, s *Server, method, path, host string, header map[string]string, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://"+s.AdminAddr().String()+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error building request: %v", err)
+	}
+	if host != "" {
+		req.Host = host
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	client := &http.Client{Timeout: testTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Error calling the admin API: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading the admin response: %v", err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestAdminChecks(t *testing.T) {
+	jsonType := map[string]string{"Content-Type": "application/json"}
+
+	tests := []struct {
+		name         string
+		token        string
+		method, path string
+		host         string // "" sends the listen address
+		header       map[string]string
+		body         string
+		wantStatus   int
+	}{
+		{"loopback address", "", "GET", "/state", "", nil, "", http.StatusOK},
+		{"localhost", "", "GET", "/state", "localhost:8087", nil, "", http.StatusOK},
+		{"localhost without a port", "", "GET", "/clients", "LOCALHOST", nil, "", http.StatusOK},
+		{"IPv6 loopback", "", "GET", "/state", "[::1]:8087", nil, "", http.StatusOK},
+		{"rebound domain", "", "GET", "/export", "evil.example:8087", nil, "", http.StatusForbidden},
+		{"rebound domain without a port", "", "GET", "/state", "evil.example", nil, "", http.StatusForbidden},
+		{"other address", "", "GET", "/state", "192.0.2.1:8087", nil, "", http.StatusForbidden},
+		{"web page", "", "GET", "/state", "", map[string]string{"Origin": "http://127.0.0.1:8087"}, "", http.StatusForbidden},
+		{"wrong method", "", "POST", "/state", "", jsonType, "{}", http.StatusMethodNotAllowed},
+		{"form post", "", "POST", "/announce", "", map[string]string{"Content-Type": "text/plain"}, `{"text":"hi"}`, http.StatusUnsupportedMediaType},
+		{"announce", "", "POST", "/announce", "", jsonType, `{"text":"hi"}`, http.StatusOK},
+		{"bad announce", "", "POST", "/announce", "", jsonType, `{}`, http.StatusBadRequest},
+		{"kick unknown user", "", "POST", "/kick", "", jsonType, `{"user":"nobody"}`, http.StatusNotFound},
+		{"no token", "secret", "GET", "/state", "", nil, "", http.StatusUnauthorized},
+		{"wrong token", "secret", "GET", "/state", "", map[string]string{"Authorization": "Bearer wrong"}, "", http.StatusUnauthorized},
+		{"token from any host", "secret", "GET", "/state", "chat.example:8087", map[string]string{"Authorization": "Bearer secret"}, "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startTestServer(t, func(cfg *Config) {
+				cfg.AdminAddr = "127.0.0.1:0"
+				cfg.AdminToken = tt.token
+			})
+			status, body := adminRequest(t, s, tt.method, tt.path, tt.host, tt.header, tt.body)
+			if status != tt.wantStatus {
+				t.Errorf("%s %s returned %d (%q); expected %d", tt.method, tt.path, status, strings.TrimSpace(body), tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdminStartup(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AdminToken = ""
+	s := NewServerWithConfig(cfg)
+	if err := s.startAdmin("0.0.0.0:0"); err == nil {
+		t.Errorf("startAdmin served the API beyond loopback without a token")
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	s := startTestServer(t, func(cfg *Config) { cfg.AdminAddr = "127.0.0.1:0" })
+	alice := loginJSON(t, s, "alice")
+	bob := loginJSON(t, s, "bob")
+	alice.sendFrame(Envelope{Type: FrameMessage, Text: "hello"})
+	bob.waitFor("hello")
+	alice.sendFrame(Envelope{Type: FrameWhisper, To: "bob", Text: "psst"})
+	bob.waitFor("psst")
+
+	status, body := adminRequest(t, s, "GET", "/metrics", "", nil, "")
+	if status != http.StatusOK {
+		t.Fatalf("GET /metrics returned %d", status)
+	}
+	for _, want := range []string{
+		"# TYPE chat_connected_clients gauge\nchat_connected_clients 2\n",
+		"chat_connections_total 2\n",
+		"chat_whispers_total 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+
+	status, body = adminRequest(t, s, "GET", "/clients", "", nil, "")
+	var clients []AdminClient
+	if err := json.Unmarshal([]byte(body), &clients); status != http.StatusOK || err != nil || len(clients) != 2 {
+		t.Errorf("GET /clients returned %d with %d clients (%v); expected 200 with 2", status, len(clients), err)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// EchoBot repeats messages that start with "!echo " back to the room
+func EchoBot() Plugin {
+	return Plugin{
+		Name: "echobot",
+		OnMessage: func(ctx context.Context, ev *Event) {
+			if text, ok := strings.CutPrefix(ev.Text, "!echo "); ok {
+				ev.Say("%s", text)
+			}
+		},
+	}
+}
+
+// KeywordAlertBot whispers an alert to every recipient who is online when a
+// message in any room contains one of the keywords (case-insensitive)
+func KeywordAlertBot(keywords, recipients []string) Plugin {
+	lowered := make([]string, 0, len(keywords))
+	for _, keyword := range keywords {
+		if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+			lowered = append(lowered, keyword)
+		}
+	}
+	return Plugin{
+		Name: "alertbot",
+		OnMessage: func(ctx context.Context, ev *Event) {
+			text := strings.ToLower(ev.Text)
+			for _, keyword := range lowered {
+				if !strings.Contains(text, keyword) {
+					continue
+				}
+				for _, recipient := range recipients {
+					if recipient != ev.User {
+						ev.Whisper(recipient, "'%s' mentioned in room '%s' by %s: %s", keyword, ev.Room, ev.User, ev.Text)
+					}
+				}
+				return
+			}
+		},
+	}
+}
+
+// DiceBot adds /roll [NdM[+K]], which rolls dice for everyone in the room to see
+func DiceBot() Plugin {
+	return Plugin{
+		Name: "dicebot",
+		Commands: []Command{NewCommand(CommandSpec{
+			Name:    "roll",
+			Usage:   "[NdM[+K]]",
+			Help:    "Roll dice for the room, e.g. /roll 2d6+1",
+			MaxArgs: 1,
+		}, func(ctx *CommandContext) {
+			spec := "1d6"
+			if len(ctx.Args) == 1 {
+				spec = ctx.Args[0]
+			}
+			count, sides, modifier, err := parseDice(spec)
+			if err != nil {
+				ctx.Error("%v", err)
+				return
+			}
+
+			rolls := make([]string, count)
+			total := modifier
+			for i := range rolls {
+				roll := rand.Intn(sides) + 1
+				rolls[i] = strconv.Itoa(roll)
+				total += roll
+			}
+			detail := strings.Join(rolls, " + ")
+			if modifier > 0 {
+				detail += fmt.Sprintf(" + %d", modifier)
+			} else if modifier < 0 {
+				detail += fmt.Sprintf(" - %d", -modifier)
+			}
+			ctx.Announce("%s rolled %s: %s = %d", ctx.User(), spec, detail, total)
+		})},
+	}
+}
+
+// parseDice parses dice notation such as "d20", "3d6" or "2d8-1"
+func parseDice(spec string) (count, sides, modifier int, err error) {
+	invalid := fmt.Errorf("invalid dice '%s'; use NdM[+K], e.g. 2d6+1", spec)
+	countPart, rest, ok := strings.Cut(strings.ToLower(spec), "d")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+	count = 1
+	if countPart != "" {
+		if count, err = strconv.Atoi(countPart); err != nil {
+			return 0, 0, 0, invalid
+		}
+	}
+	sidesPart := rest
+	if i := strings.IndexAny(rest, "+-"); i >= 0 {
+		sidesPart = rest[:i]
+		if modifier, err = strconv.Atoi(rest[i:]); err != nil {
+			return 0, 0, 0, invalid
+		}
+	}
+	if sides, err = strconv.Atoi(sidesPart); err != nil {
+		return 0, 0, 0, invalid
+	}
+	if count < 1 || count > 100 || sides < 2 || sides > 1000 {
+		return 0, 0, 0, fmt.Errorf("roll between 1 and 100 dice with 2 to 1000 sides")
+	}
+	return count, sides, modifier, nil
+}
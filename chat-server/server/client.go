@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy decides what happens when a client's outbound queue is full
+type OverflowPolicy string
+
+const (
+	OverflowDropOldest OverflowPolicy = "drop-oldest" // Discard the oldest queued line to make room
+	OverflowDisconnect OverflowPolicy = "disconnect"  // Drop the client as a slow consumer
+)
+
+var (
+	errQueueClosed  = errors.New("connection is closing")
+	errSlowConsumer = errors.New("outbound queue full, disconnected as slow consumer")
+)
+
+// outbound is the bounded write queue of a client, drained by its own writer
+// goroutine so a stalled peer never blocks the rest of the server.
+type outbound struct {
+	metrics      *metrics
+	queue        chan []byte
+	policy       OverflowPolicy
+	writeTimeout time.Duration
+	closed       bool
+	dropped      int // Lines discarded under OverflowDropOldest
+	mutex        sync.Mutex
+	done         chan struct{} // Closed when the writer goroutine has exited
+}
+
+// newClient creates a client for conn and starts its writer goroutine
+func (s *Server) newClient(conn net.Conn) *Client {
+	cfg := s.config()
+	client := &Client{
+		conn:  conn,
+		room:  cfg.DefaultRoom,
+		rooms: make(map[string]bool),
+		out: &outbound{
+			metrics:      s.metrics,
+			queue:        make(chan []byte, cfg.SendQueueSize),
+			policy:       cfg.OverflowPolicy,
+			writeTimeout: cfg.WriteTimeout,
+			done:         make(chan struct{}),
+		},
+		flood:       s.newFloodGuard(),
+		connectedAt: time.Now(),
+	}
+	client.shown.Store(client.room)
+	client.touch()
+	client.lastRead.Store(client.lastActive.Load())
+	go client.writeLoop()
+	return client
+}
+
+// write queues raw bytes for the client without blocking
+func (c *Client) write(data []byte) error {
+	c.out.mutex.Lock()
+	defer c.out.mutex.Unlock()
+
+	if c.out.closed {
+		return errQueueClosed
+	}
+	select {
+	case c.out.queue <- data:
+		return nil
+	default:
+	}
+
+	if c.out.policy == OverflowDisconnect {
+		c.out.closed = true
+		close(c.out.queue)
+		c.conn.Close() // Ends the reader, which unregisters the client
+		c.out.metrics.droppedWrites.Add(1)
+		logWarnf("Disconnecting %s (%s): %v", c.name(), c.conn.RemoteAddr(), errSlowConsumer)
+		return errSlowConsumer
+	}
+
+	// Drop the oldest line; the writer may have made room in the meantime
+	select {
+	case <-c.out.queue:
+		c.out.dropped++
+		c.out.metrics.droppedWrites.Add(1)
+		if c.out.dropped == 1 || c.out.dropped%100 == 0 {
+			logWarnf("Outbound queue of %s is full, %d lines dropped so far", c.name(), c.out.dropped)
+		}
+	default:
+	}
+	select {
+	case c.out.queue <- data:
+		return nil
+	default:
+		c.out.metrics.droppedWrites.Add(1)
+		return errSlowConsumer
+	}
+}
+
+// writeLoop sends queued lines to the connection until the queue is closed
+func (c *Client) writeLoop() {
+	defer close(c.out.done)
+
+	var writeErr error
+	for data := range c.out.queue {
+		if writeErr != nil {
+			continue // Keep draining so senders never block
+		}
+		if c.out.writeTimeout > 0 {
+			c.conn.SetWriteDeadline(time.Now().Add(c.out.writeTimeout))
+		}
+		if _, err := c.conn.Write(data); err != nil {
+			writeErr = err
+			if !errors.Is(err, net.ErrClosed) {
+				logErrorf("Error writing to %s: %v", c.name(), err)
+			}
+			c.conn.Close() // A peer that cannot keep up is disconnected
+		}
+	}
+}
+
+// closeQueue stops accepting new lines; the writer exits after flushing the rest
+func (c *Client) closeQueue() {
+	c.out.mutex.Lock()
+	defer c.out.mutex.Unlock()
+
+	if !c.out.closed {
+		c.out.closed = true
+		close(c.out.queue)
+	}
+}
+
+// close flushes the outbound queue and closes the connection. Flushing is
+// bounded by the write timeout.
+func (c *Client) close() {
+	c.closeQueue()
+	<-c.out.done
+	c.conn.Close()
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// newTestClient returns a client whose writer is not running yet, so lines stay queued
+func newTestClient(size int, policy OverflowPolicy) (*Client, *recordConn) {
+	conn := &recordConn{}
+	client := &Client{
+		conn: conn,
+		out: &outbound{
+			metrics: newMetrics(),
+			queue:   make(chan []byte, size),
+			policy:  policy,
+			done:    make(chan struct{}),
+		},
+	}
+	return client, conn
+}
+
+// queued drains and returns the lines waiting in a client's queue
+func queued(client *Client) []string {
+	var lines []string
+	for {
+		select {
+		case data, ok := <-client.out.queue:
+			if !ok {
+				return lines
+			}
+			lines = append(lines, string(data))
+		default:
+			return lines
+		}
+	}
+}
+
+func TestOutboundOverflow(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      OverflowPolicy
+		wantErr     error
+		wantQueued  []string
+		wantClosed  bool
+		wantDropped uint64
+	}{
+		{"drop oldest", OverflowDropOldest, nil, []string{"2", "3"}, false, 1},
+		{"disconnect", OverflowDisconnect, errSlowConsumer, []string{"1", "2"}, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := newTestClient(2, tt.policy)
+			client.write([]byte("1"))
+			client.write([]byte("2"))
+			if err := client.write([]byte("3")); !errors.Is(err, tt.wantErr) {
+				t.Errorf("write to a full queue returned %v; expected %v", err, tt.wantErr)
+			}
+			if got := queued(client); strings.Join(got, ",") != strings.Join(tt.wantQueued, ",") {
+				t.Errorf("queue holds %q; expected %q", got, tt.wantQueued)
+			}
+			if conn.closed != tt.wantClosed {
+				t.Errorf("connection closed is %t; expected %t", conn.closed, tt.wantClosed)
+			}
+			if got := client.out.metrics.droppedWrites.Load(); got != tt.wantDropped {
+				t.Errorf("%d dropped writes counted; expected %d", got, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestOutboundFlushOnClose(t *testing.T) {
+	client, conn := newTestClient(8, OverflowDropOldest)
+	client.write([]byte("hello\n"))
+	client.write([]byte("bye\n"))
+	go client.writeLoop()
+	client.close()
+
+	if got := conn.written.String(); got != "hello\nbye\n" {
+		t.Errorf("connection got %q before closing; expected %q", got, "hello\nbye\n")
+	}
+	if !conn.closed {
+		t.Errorf("connection is still open after close")
+	}
+	if err := client.write([]byte("late\n")); !errors.Is(err, errQueueClosed) {
+		t.Errorf("write after close returned %v; expected %v", err, errQueueClosed)
+	}
+}
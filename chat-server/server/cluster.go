@@ -0,0 +1,915 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Frame types of the peer link protocol spoken between nodes of a cluster
+const (
+	peerHello      = "hello"       // First frames on a link: node name and nonce in clear, then sealed with connected users
+	peerClaim      = "claim"       // A user is logging in; ask peers whether the name is free
+	peerClaimReply = "claim-reply" // Answer to a claim, OK is false if the name is taken
+	peerUserJoin   = "user-join"   // A user connected to the sending node
+	peerUserMove   = "user-move"   // A user of the sending node joined, left or switched rooms
+	peerUserLeave  = "user-leave"  // A user disconnected, or a claim was given up
+	peerUserAway   = "user-away"   // A user of the sending node went away or came back
+	peerUserKey    = "user-key"    // A user of the sending node published a public key
+	peerRoom       = "room"        // A frame for everyone in a room
+	peerDeliver    = "deliver"     // A frame for one user connected to the receiving node
+	peerRoomState  = "room-state"  // Owner, moderators, bans, mutes and topic of a room after a change
+	peerRemove     = "remove"      // A moderator kicked or banned a user of the receiving node from a room
+)
+
+const (
+	peerHelloTimeout = 10 * time.Second // How long a new link may take to say hello
+	peerClaimTimeout = 3 * time.Second  // How long a login waits for peers to confirm a name
+	peerQueueSize    = 1024             // Frames buffered per link before it is dropped as stalled
+	peerMaxBackoff   = 30 * time.Second // Longest wait between attempts to reach a peer
+	peerMaxHello     = 4 * 1024         // Longest cleartext line, read before the peer has proven the secret
+	peerMaxFrame     = 8 * 1024 * 1024  // Longest sealed line; a sealed hello lists every user of its node
+)
+
+var errPeerFrameTooLong = errors.New("peer frame too long")
+
+// peerFrame is one line of the peer link protocol
+type peerFrame struct {
+	Type   string     `json:"type"`
+	Node   string     `json:"node,omitempty"`
+	Nonce  []byte     `json:"nonce,omitempty"`
+	ID     string     `json:"id,omitempty"`
+	OK     bool       `json:"ok,omitempty"`
+	User   string     `json:"user,omitempty"`
+	Room   string     `json:"room,omitempty"`
+	Rooms  []string   `json:"rooms,omitempty"`
+	Away   string     `json:"away,omitempty"`
+	Key    string     `json:"key,omitempty"`
+	Users  []peerUser `json:"users,omitempty"`
+	Frame  *Envelope  `json:"frame,omitempty"`
+	Meta   *roomMeta  `json:"meta,omitempty"`
+	By     string     `json:"by,omitempty"`
+	Action string     `json:"action,omitempty"` // "kicked" or "banned"
+	Reason string     `json:"reason,omitempty"`
+}
+
+// peerUser is a user connected to a node, as announced in a hello frame
+type peerUser struct {
+	Name  string   `json:"name"`
+	Room  string   `json:"room"` // Active room
+	Rooms []string `json:"rooms,omitempty"`
+	Away  string   `json:"away,omitempty"`
+	Key   string   `json:"key,omitempty"` // Public key for encrypted whispers
+}
+
+// peerUserOf describes a local client to other nodes. The caller must hold s.mutex.
+func peerUserOf(client *Client) peerUser {
+	return peerUser{Name: client.name(), Room: client.room, Rooms: client.roomNames(), Away: client.away, Key: client.publicKey}
+}
+
+// frame announces the user in a user-join or user-move frame
+func (u peerUser) frame(frameType string) peerFrame {
+	return peerFrame{Type: frameType, User: u.Name, Room: u.Room, Rooms: u.Rooms, Away: u.Away, Key: u.Key}
+}
+
+// remoteUser is a user connected to another node of the cluster
+type remoteUser struct {
+	node  string
+	room  string   // Active room; empty while the user's login is still in progress
+	rooms []string // Every room the user is in
+	away  string   // Away message, or "" when present
+	key   string   // Public key for encrypted whispers, or "" if none was published
+}
+
+// inRoom reports whether the user is in a room
+func (u remoteUser) inRoom(roomName string) bool {
+	for _, r := range u.rooms {
+		if r == roomName {
+			return true
+		}
+	}
+	return false
+}
+
+// cluster holds the links to the other nodes and what they told us.
+// Lock order: s.mutex before cluster.mutex.
+type cluster struct {
+	node     string
+	listener net.Listener
+	links    map[string]*peerLink  // Established links by node name
+	open     map[*peerLink]bool    // Every open link, including ones still saying hello
+	users    map[string]remoteUser // Users of other nodes, and names they have reserved
+	claims   map[string]bool       // Names of local logins waiting for peers to confirm them
+	replies  map[string]chan bool  // Claim ID -> answers from peers
+	closing  bool
+	mutex    sync.Mutex
+	quit     chan struct{}  // Closed on shutdown to stop the dialers
+	wg       sync.WaitGroup // Running link and dialer goroutines
+}
+
+func newCluster() *cluster {
+	return &cluster{
+		links:   make(map[string]*peerLink),
+		open:    make(map[*peerLink]bool),
+		users:   make(map[string]remoteUser),
+		claims:  make(map[string]bool),
+		replies: make(map[string]chan bool),
+		quit:    make(chan struct{}),
+	}
+}
+
+// peerLink is a connection to another node with its own writer goroutine
+type peerLink struct {
+	conn   net.Conn
+	node   string // Name of the node at the other end, known after its hello
+	dialer string // Name of the node that opened the link
+	out    chan []byte
+	sealer *linkCipher // Seals outgoing frames once the clear hellos are exchanged
+	closed bool
+	mutex  sync.Mutex
+}
+
+// send queues a frame for the peer. A peer that cannot keep up is dropped;
+// it resynchronizes when the link is reopened.
+func (l *peerLink) send(f peerFrame) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		logErrorf("Error encoding peer frame: %v", err)
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	line := append(data, '\n')
+	if l.sealer != nil {
+		line = l.sealer.seal(data)
+	}
+	select {
+	case l.out <- line:
+	default:
+		logWarnf("Peer link to %s is stalled, dropping it", l.conn.RemoteAddr())
+		l.closed = true
+		close(l.out)
+		l.conn.Close()
+	}
+}
+
+// writeLoop sends queued frames until the link is closed
+func (l *peerLink) writeLoop() {
+	defer l.conn.Close()
+	for data := range l.out {
+		l.conn.SetWriteDeadline(time.Now().Add(peerHelloTimeout))
+		if _, err := l.conn.Write(data); err != nil {
+			l.conn.Close()
+		}
+	}
+}
+
+// close stops the writer and closes the connection
+func (l *peerLink) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.out)
+		l.conn.Close()
+	}
+}
+
+// closeAfterFlush stops accepting frames; the writer closes the connection
+// once it has sent the ones already queued
+func (l *peerLink) closeAfterFlush() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.out)
+	}
+}
+
+// setSealer seals every frame sent from now on
+func (l *peerLink) setSealer(sealer *linkCipher) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sealer = sealer
+}
+
+// startCluster accepts links from other nodes on Config.ClusterAddr and keeps
+// links open to every node in Config.ClusterPeers.
+func (s *Server) startCluster() error {
+	cfg := s.config()
+	if cfg.ClusterSecret == "" {
+		return errors.New("starting cluster: ClusterSecret must be set to link nodes")
+	}
+	c := s.cluster
+	c.node = cfg.NodeName
+	if c.node == "" {
+		c.node = defaultNodeName(s.Addr())
+	}
+
+	if cfg.ClusterAddr != "" {
+		listener, err := net.Listen("tcp", cfg.ClusterAddr)
+		if err != nil {
+			return fmt.Errorf("starting cluster listener: %v", err)
+		}
+		c.mutex.Lock()
+		c.listener = listener
+		c.mutex.Unlock()
+		logInfof("Node %s accepting peers on %s", c.node, listener.Addr())
+
+		c.wg.Add(1)
+		go s.acceptPeers(listener)
+	}
+	for _, addr := range cfg.ClusterPeers {
+		c.wg.Add(1)
+		go s.dialPeer(addr)
+	}
+	return nil
+}
+
+// defaultNodeName names a node after its host and chat port
+func defaultNodeName(addr net.Addr) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return host + ":" + strconv.Itoa(tcpAddr.Port)
+	}
+	return host
+}
+
+// ClusterAddr returns the address other nodes link to, or nil if it is not listening
+func (s *Server) ClusterAddr() net.Addr {
+	s.cluster.mutex.Lock()
+	defer s.cluster.mutex.Unlock()
+	if s.cluster.listener == nil {
+		return nil
+	}
+	return s.cluster.listener.Addr()
+}
+
+// NodeName returns the name of this node in the cluster
+func (s *Server) NodeName() string {
+	return s.cluster.node
+}
+
+// acceptPeers serves links opened by other nodes
+func (s *Server) acceptPeers(listener net.Listener) {
+	defer s.cluster.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logErrorf("Error accepting peer: %v", err)
+			continue
+		}
+		s.cluster.wg.Add(1)
+		go func() {
+			defer s.cluster.wg.Done()
+			s.runLink(conn, false)
+		}()
+	}
+}
+
+// dialPeer keeps a link open to the node at addr, retrying with backoff
+func (s *Server) dialPeer(addr string) {
+	defer s.cluster.wg.Done()
+
+	backoff := time.Second
+	node := ""
+	for {
+		// Skip dialing while the peer is linked through a connection it opened
+		if node == "" || !s.linkedTo(node) {
+			conn, err := net.DialTimeout("tcp", addr, peerHelloTimeout)
+			if err != nil {
+				logErrorf("Error connecting to peer %s: %v (retrying in %s)", addr, err, backoff)
+			} else if linked := s.runLink(conn, true); linked != "" {
+				node = linked
+				backoff = time.Second
+			}
+		}
+
+		select {
+		case <-s.cluster.quit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > peerMaxBackoff {
+			backoff = peerMaxBackoff
+		}
+	}
+}
+
+// linkedTo reports whether a link to node is established
+func (s *Server) linkedTo(node string) bool {
+	s.cluster.mutex.Lock()
+	defer s.cluster.mutex.Unlock()
+	_, ok := s.cluster.links[node]
+	return ok
+}
+
+// runLink exchanges hellos on a new peer connection and then handles its
+// frames until it closes. It returns the peer's node name, or "" if the
+// handshake failed.
+//
+// Both ends first send their node name and a random nonce in clear. Every
+// later frame is sealed with keys derived from the cluster secret and both
+// nonces, so only a node that knows the secret can open the second hello,
+// and the secret itself never crosses the link.
+func (s *Server) runLink(conn net.Conn, dialed bool) string {
+	c := s.cluster
+	link := &peerLink{conn: conn, out: make(chan []byte, peerQueueSize)}
+	c.mutex.Lock()
+	if c.closing {
+		c.mutex.Unlock()
+		conn.Close()
+		return ""
+	}
+	c.open[link] = true
+	c.mutex.Unlock()
+	go link.writeLoop()
+	defer s.removeLink(link)
+
+	nonce := make([]byte, peerNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		logErrorf("Error creating nonce for peer %s: %v", conn.RemoteAddr(), err)
+		return ""
+	}
+	link.send(peerFrame{Type: peerHello, Node: c.node, Nonce: nonce})
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(peerHelloTimeout))
+	hello, err := readPeerFrame(reader, nil)
+	if err != nil {
+		logErrorf("Error reading hello from peer %s: %v", conn.RemoteAddr(), err)
+		return ""
+	}
+	if hello.Type != peerHello || hello.Node == "" || len(hello.Nonce) != peerNonceSize {
+		logWarnf("Peer %s did not say hello", conn.RemoteAddr())
+		return ""
+	}
+	if hello.Node == c.node {
+		logWarnf("Peer %s has the same node name as this node", conn.RemoteAddr())
+		return ""
+	}
+
+	dialerNonce, acceptorNonce := nonce, hello.Nonce
+	if !dialed {
+		dialerNonce, acceptorNonce = hello.Nonce, nonce
+	}
+	sendKey, receiveKey := linkKeys(s.config().ClusterSecret, dialerNonce, acceptorNonce)
+	if !dialed {
+		sendKey, receiveKey = receiveKey, sendKey
+	}
+	sealer, err := newLinkCipher(sendKey)
+	if err != nil {
+		logErrorf("Error sealing link to peer %s: %v", conn.RemoteAddr(), err)
+		return ""
+	}
+	opener, err := newLinkCipher(receiveKey)
+	if err != nil {
+		logErrorf("Error sealing link to peer %s: %v", conn.RemoteAddr(), err)
+		return ""
+	}
+	link.setSealer(sealer)
+	link.send(peerFrame{Type: peerHello, Node: c.node, Users: s.localUsers()})
+
+	sealedHello, err := readPeerFrame(reader, opener)
+	if err != nil {
+		logWarnf("Peer %s (%s) failed the cluster secret check: %v", hello.Node, conn.RemoteAddr(), err)
+		return ""
+	}
+	conn.SetReadDeadline(time.Time{})
+	if sealedHello.Type != peerHello || sealedHello.Node != hello.Node {
+		logWarnf("Peer %s (%s) did not say hello", hello.Node, conn.RemoteAddr())
+		return ""
+	}
+	hello = sealedHello
+
+	link.node = hello.Node
+	link.dialer = hello.Node
+	if dialed {
+		link.dialer = c.node
+	}
+	if !s.addLink(link) {
+		return hello.Node
+	}
+	logInfof("Linked to node %s (%s)", link.node, conn.RemoteAddr())
+	for _, user := range hello.Users {
+		s.addRemoteUser(link, user)
+	}
+	s.sendRoomStates(link)
+
+	for {
+		f, err := readPeerFrame(reader, opener)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logInfof("Link to node %s closed: %v", link.node, err)
+			}
+			return hello.Node
+		}
+		s.handlePeerFrame(link, f)
+	}
+}
+
+// readPeerFrame reads one line of the peer link protocol, opening it with
+// opener unless it is one of the clear hellos. Lines are bounded, clear ones
+// tightly, so a peer cannot make the node buffer without limit.
+func readPeerFrame(reader *bufio.Reader, opener *linkCipher) (peerFrame, error) {
+	var f peerFrame
+	max := peerMaxFrame
+	if opener == nil {
+		max = peerMaxHello
+	}
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > max {
+			return f, errPeerFrameTooLong
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return f, err
+		}
+	}
+	if opener != nil {
+		var err error
+		if line, err = opener.open(line); err != nil {
+			return f, err
+		}
+	}
+	if err := json.Unmarshal(line, &f); err != nil {
+		return f, fmt.Errorf("invalid peer frame: %v", err)
+	}
+	return f, nil
+}
+
+// addLink makes an established link the route to its node. When two nodes
+// dialed each other, both keep the link opened by the node with the smaller
+// name. It returns false if link was dropped in favor of an existing one.
+func (s *Server) addLink(link *peerLink) bool {
+	c := s.cluster
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if existing, ok := c.links[link.node]; ok {
+		if existing.dialer < link.dialer {
+			link.closeAfterFlush() // Our hello still tells the dialer who we are
+			return false
+		}
+		existing.close() // Its removeLink sees it was replaced and keeps the users
+	}
+	c.links[link.node] = link
+	return true
+}
+
+// removeLink forgets a closed link. If it was the route to its node, the
+// users of that node are gone and their rooms are told.
+func (s *Server) removeLink(link *peerLink) {
+	link.close()
+
+	c := s.cluster
+	c.mutex.Lock()
+	delete(c.open, link)
+	if link.node == "" || c.links[link.node] != link {
+		c.mutex.Unlock()
+		return
+	}
+	delete(c.links, link.node)
+	var lost []peerUser
+	for name, user := range c.users {
+		if user.node == link.node {
+			delete(c.users, name)
+			if user.room != "" {
+				lost = append(lost, peerUser{Name: name, Rooms: user.rooms})
+			}
+		}
+	}
+	c.mutex.Unlock()
+
+	logInfof("Lost link to node %s, %d users gone", link.node, len(lost))
+	for _, user := range lost {
+		env := newEnvelope(FramePresence)
+		env.From = user.Name
+		env.Text = fmt.Sprintf("%s has left the chat.", user.Name)
+		s.deliverToRooms(user.Rooms, env)
+	}
+}
+
+// peerBroadcast sends a frame to every linked node
+func (s *Server) peerBroadcast(f peerFrame) {
+	s.cluster.mutex.Lock()
+	defer s.cluster.mutex.Unlock()
+	for _, link := range s.cluster.links {
+		link.send(f)
+	}
+}
+
+// localUsers lists the users connected to this node for a hello frame
+func (s *Server) localUsers() []peerUser {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	users := make([]peerUser, 0, len(s.usernames))
+	for _, client := range s.usernames {
+		users = append(users, peerUserOf(client))
+	}
+	return users
+}
+
+// sendRoomStates tells a newly linked node the state of every room
+func (s *Server) sendRoomStates(link *peerLink) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, meta := range s.roomState.rooms {
+		link.send(peerFrame{Type: peerRoomState, Meta: meta})
+	}
+}
+
+// applyRoomState takes the state of a room from another node if it changed
+// there after it last changed here
+func (s *Server) applyRoomState(meta *roomMeta) {
+	if meta.Name == "" {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if local, ok := s.roomState.rooms[meta.Name]; ok && !meta.Updated.After(local.Updated) {
+		return
+	}
+	if meta.isEmpty() {
+		delete(s.roomState.rooms, meta.Name)
+	} else {
+		s.roomState.rooms[meta.Name] = meta
+		s.roomState.get(meta.Name) // Fill in the maps left out of the frame
+	}
+	s.roomState.save()
+}
+
+// roomInUse reports whether users of other nodes are in a room
+func (c *cluster) roomInUse(roomName string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, user := range c.users {
+		if user.inRoom(roomName) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeRemoteUser asks the node of a user who is in a room there to kick or
+// ban them. It returns false if no other node has the user in the room.
+func (s *Server) removeRemoteUser(target, roomName, action, by, reason string) bool {
+	c := s.cluster
+	c.mutex.Lock()
+	user, ok := c.users[target]
+	link, linked := c.links[user.node]
+	c.mutex.Unlock()
+	if !ok || !linked || !user.inRoom(roomName) {
+		return false
+	}
+	link.send(peerFrame{Type: peerRemove, User: target, Room: roomName, By: by, Action: action, Reason: reason})
+	return true
+}
+
+// handlePeerFrame acts on a frame received from a linked node
+func (s *Server) handlePeerFrame(link *peerLink, f peerFrame) {
+	c := s.cluster
+	switch f.Type {
+	case peerClaim:
+		link.send(peerFrame{Type: peerClaimReply, ID: f.ID, OK: s.grantClaim(link.node, f.User)})
+
+	case peerClaimReply:
+		c.mutex.Lock()
+		if replies, ok := c.replies[f.ID]; ok {
+			select {
+			case replies <- f.OK:
+			default: // Buffered for one answer per link; ignore extras
+			}
+		}
+		c.mutex.Unlock()
+
+	case peerUserJoin, peerUserMove:
+		s.addRemoteUser(link, peerUser{Name: f.User, Room: f.Room, Rooms: f.Rooms, Away: f.Away, Key: f.Key})
+
+	case peerUserAway:
+		c.mutex.Lock()
+		if user, ok := c.users[f.User]; ok && user.node == link.node {
+			user.away = f.Away
+			c.users[f.User] = user
+		}
+		c.mutex.Unlock()
+
+	case peerUserKey:
+		c.mutex.Lock()
+		if user, ok := c.users[f.User]; ok && user.node == link.node {
+			user.key = f.Key
+			c.users[f.User] = user
+		}
+		c.mutex.Unlock()
+
+	case peerUserLeave:
+		c.mutex.Lock()
+		if user, ok := c.users[f.User]; ok && user.node == link.node {
+			delete(c.users, f.User)
+		}
+		c.mutex.Unlock()
+
+	case peerRoom:
+		if f.Frame == nil {
+			return
+		}
+		if len(f.Rooms) > 0 {
+			s.deliverToRooms(f.Rooms, *f.Frame)
+			return
+		}
+		if f.Frame.Type == FrameMessage {
+			s.history.Append(historyEntry(*f.Frame))
+			s.indexMessage(*f.Frame)
+		}
+		s.deliverToRoom(f.Frame.Room, *f.Frame)
+
+	case peerDeliver:
+		if f.Frame == nil {
+			return
+		}
+		s.mutex.Lock()
+		target, ok := s.usernames[f.User]
+		s.mutex.Unlock()
+		if !ok {
+			if f.Frame.Type == FrameWhisper { // The user left before the whisper arrived
+				notice := newEnvelope(FrameError)
+				notice.Text = fmt.Sprintf("User '%s' not found.", f.User)
+				link.send(peerFrame{Type: peerDeliver, User: f.Frame.From, Frame: &notice})
+			}
+			return
+		}
+		if err := target.send(*f.Frame); err != nil {
+			logErrorf("Error delivering frame from node %s to %s: %v", link.node, f.User, err)
+		} else if f.Frame.Type == FrameWhisper && f.Frame.To == f.User {
+			s.metrics.whispers.Add(1)
+		}
+
+	case peerRoomState:
+		if f.Meta != nil {
+			s.applyRoomState(f.Meta)
+		}
+
+	case peerRemove:
+		// Parting a room changes the client's active room, which only the
+		// message loop may touch
+		s.runOnLoop(func() {
+			s.mutex.Lock()
+			target, ok := s.rooms[f.Room][f.User]
+			s.mutex.Unlock()
+			if ok {
+				s.removeUser(target, f.Room, f.Action, f.By, f.Reason)
+			}
+		})
+
+	default:
+		logWarnf("Ignoring unknown peer frame '%s' from node %s", f.Type, link.node)
+	}
+}
+
+// grantClaim decides whether node may give name to a user logging in there,
+// and reserves the name for it if so
+func (s *Server) grantClaim(node, name string) bool {
+	c := s.cluster
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, local := lookupName(s.usernames, name); local {
+		return false
+	}
+	if user, ok := lookupName(c.users, name); ok && user.node != node {
+		return false
+	}
+	if claimed, _ := lookupName(c.claims, name); claimed && c.node < node {
+		return false // Both logins are in progress; the smaller node name wins
+	}
+	c.users[name] = remoteUser{node: node}
+	return true
+}
+
+// addRemoteUser records where a user of another node is. If the same name is
+// connected here, which happens when nodes that were apart are linked, the
+// user on the node with the smaller name keeps it.
+func (s *Server) addRemoteUser(link *peerLink, user peerUser) {
+	name := user.Name
+	if len(user.Rooms) == 0 && user.Room != "" {
+		user.Rooms = []string{user.Room}
+	}
+	c := s.cluster
+	s.mutex.Lock()
+	local, clash := lookupName(s.usernames, name)
+	c.mutex.Lock()
+	if clash && c.node < link.node {
+		c.mutex.Unlock()
+		s.mutex.Unlock()
+		return // The other node disconnects its user
+	}
+	c.users[name] = remoteUser{node: link.node, room: user.Room, rooms: user.Rooms, away: user.Away, key: user.Key}
+	c.mutex.Unlock()
+	s.mutex.Unlock()
+
+	if clash {
+		local.errorf("Name '%s' is in use on another node of the cluster. Disconnecting.", name)
+		logWarnf("Disconnecting %s: name is also in use on node %s", name, link.node)
+		go local.close() // The reader then unregisters the client
+	}
+}
+
+// reserveName claims a name for a user logging in, first on this node and then
+// with every linked node. It returns false if the name is taken, in any case.
+// A reserved name is held until the client is registered or releaseName is called.
+func (s *Server) reserveName(name string) bool {
+	c := s.cluster
+	s.mutex.Lock()
+	c.mutex.Lock()
+	_, local := lookupName(s.usernames, name)
+	_, remote := lookupName(c.users, name)
+	if claimed, _ := lookupName(c.claims, name); local || remote || claimed {
+		c.mutex.Unlock()
+		s.mutex.Unlock()
+		return false
+	}
+	c.claims[name] = true
+	links := make([]*peerLink, 0, len(c.links))
+	for _, link := range c.links {
+		links = append(links, link)
+	}
+	id := nextID()
+	replies := make(chan bool, len(links))
+	c.replies[id] = replies
+	c.mutex.Unlock()
+	s.mutex.Unlock()
+
+	for _, link := range links {
+		link.send(peerFrame{Type: peerClaim, ID: id, User: name})
+	}
+	granted := true
+	timeout := time.NewTimer(peerClaimTimeout)
+	defer timeout.Stop()
+wait:
+	for range links {
+		select {
+		case ok := <-replies:
+			if !ok {
+				granted = false
+				break wait
+			}
+		case <-timeout.C:
+			// A silent peer is about to lose its link; linking again resolves clashes
+			logWarnf("Peers did not confirm name '%s' in time, allowing it", name)
+			break wait
+		}
+	}
+
+	c.mutex.Lock()
+	delete(c.replies, id)
+	c.mutex.Unlock()
+	if !granted {
+		s.releaseName(name)
+	}
+	return granted
+}
+
+// lookupName finds a user in a map keyed by name, ignoring case, so that names
+// differing only in case cannot be online at the same time
+func lookupName[V any](users map[string]V, name string) (V, bool) {
+	key, ok := nameKey(users, name)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return users[key], true
+}
+
+// nameKey returns the key under which a map keyed by name holds name,
+// ignoring case
+func nameKey[V any](names map[string]V, name string) (string, bool) {
+	if _, ok := names[name]; ok {
+		return name, true
+	}
+	for other := range names {
+		if strings.EqualFold(other, name) {
+			return other, true
+		}
+	}
+	return "", false
+}
+
+// deleteName removes name from a map keyed by name, in any case, and reports
+// whether it was there
+func deleteName[V any](names map[string]V, name string) bool {
+	found := false
+	for other := range names {
+		if strings.EqualFold(other, name) {
+			delete(names, other)
+			found = true
+		}
+	}
+	return found
+}
+
+// releaseName gives up a name reserved by reserveName that was never registered
+func (s *Server) releaseName(name string) {
+	s.cluster.mutex.Lock()
+	delete(s.cluster.claims, name)
+	s.cluster.mutex.Unlock()
+	s.peerBroadcast(peerFrame{Type: peerUserLeave, User: name})
+}
+
+// remoteAway returns the away message of a user connected to another node
+func (s *Server) remoteAway(name string) string {
+	s.cluster.mutex.Lock()
+	defer s.cluster.mutex.Unlock()
+	user, _ := lookupName(s.cluster.users, name)
+	return user.away
+}
+
+// remoteKey returns the public key of a user connected to another node
+func (s *Server) remoteKey(name string) string {
+	s.cluster.mutex.Lock()
+	defer s.cluster.mutex.Unlock()
+	user, _ := lookupName(s.cluster.users, name)
+	return user.key
+}
+
+// remoteRoute returns the link to the node a user is connected to
+func (s *Server) remoteRoute(name string) (*peerLink, bool) {
+	s.cluster.mutex.Lock()
+	defer s.cluster.mutex.Unlock()
+	user, ok := lookupName(s.cluster.users, name)
+	if !ok || user.room == "" {
+		return nil, false
+	}
+	link, ok := s.cluster.links[user.node]
+	return link, ok
+}
+
+// peerNodes lists the linked nodes and their users, for the admin API
+func (s *Server) peerNodes() []AdminPeer {
+	c := s.cluster
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	peers := []AdminPeer{}
+	for node, link := range c.links {
+		peer := AdminPeer{Node: node, Addr: link.conn.RemoteAddr().String(), Users: []string{}}
+		for name, user := range c.users {
+			if user.node == node && user.room != "" {
+				peer.Users = append(peer.Users, name)
+			}
+		}
+		sort.Strings(peer.Users)
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Node < peers[j].Node })
+	return peers
+}
+
+// stopCluster closes the cluster listener and every peer link
+func (s *Server) stopCluster() {
+	c := s.cluster
+	c.mutex.Lock()
+	if c.closing {
+		c.mutex.Unlock()
+		return
+	}
+	c.closing = true
+	close(c.quit)
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	links := make([]*peerLink, 0, len(c.open))
+	for link := range c.open {
+		links = append(links, link)
+	}
+	c.mutex.Unlock()
+
+	for _, link := range links {
+		link.close()
+	}
+}
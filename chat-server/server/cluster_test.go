@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestClusterWithoutSecret(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SetDataDir(t.TempDir())
+	cfg.WebSocketAddr, cfg.AdminAddr = "", ""
+	cfg.LogLevel = LogError
+	cfg.ClusterAddr = "127.0.0.1:0"
+
+	s := NewServerWithConfig(cfg)
+	err := s.Listen(":0")
+	if err == nil {
+		s.Shutdown(context.Background())
+		t.Fatalf("Listen with a cluster but no ClusterSecret returned no error")
+	}
+	if !strings.Contains(err.Error(), "ClusterSecret") {
+		t.Errorf("Listen returned %q; expected it to mention ClusterSecret", err)
+	}
+}
+
+// startTestCluster starts two linked nodes and waits until each sees the other
+func startTestCluster(t *testing.T) (first, second *Server) {
+	t.Helper()
+	first = startTestServer(t, func(cfg *Config) {
+		cfg.NodeName = "first"
+		cfg.ClusterAddr = "127.0.0.1:0"
+		cfg.ClusterSecret = "test secret"
+	})
+	second = startTestServer(t, func(cfg *Config) {
+		cfg.NodeName = "second"
+		cfg.ClusterPeers = []string{first.ClusterAddr().String()}
+		cfg.ClusterSecret = "test secret"
+	})
+
+	waitUntil(t, "the nodes to link", func() bool {
+		return len(first.peerNodes()) > 0 && len(second.peerNodes()) > 0
+	})
+	return first, second
+}
+
+func TestClusterNameClaimAndRelay(t *testing.T) {
+	first, second := startTestCluster(t)
+	alice := loginJSON(t, first, "alice")
+	bob := loginJSON(t, second, "bob")
+
+	t.Run("name claimed on another node", func(t *testing.T) {
+		for _, s := range []*Server{first, second} {
+			c := dial(t, s)
+			c.sendLine("alice")
+			c.waitFor("Name 'alice' is already taken.")
+			c.conn.Close()
+		}
+	})
+
+	tests := []struct {
+		name  string
+		from  *testConn
+		to    *testConn
+		frame Envelope
+		want  Envelope
+	}{
+		{"room message to the second node", alice, bob,
+			Envelope{Type: FrameMessage, Text: "hello from first"},
+			Envelope{Type: FrameMessage, From: "alice", Room: "general", Text: "hello from first"}},
+		{"room message to the first node", bob, alice,
+			Envelope{Type: FrameMessage, Text: "hello from second"},
+			Envelope{Type: FrameMessage, From: "bob", Room: "general", Text: "hello from second"}},
+		{"whisper to the second node", alice, bob,
+			Envelope{Type: FrameWhisper, To: "bob", Text: "psst"},
+			Envelope{Type: FrameWhisper, From: "alice", To: "bob", Text: "psst"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.from.sendFrame(tt.frame)
+			env := tt.to.waitFrame(func(env Envelope) bool { return env.Type == tt.want.Type && env.Text == tt.want.Text })
+			if env.From != tt.want.From || env.To != tt.want.To || env.Room != tt.want.Room || env.Text != tt.want.Text {
+				t.Errorf("got %+v; expected %+v", env, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterKickRemoteUser(t *testing.T) {
+	first, second := startTestCluster(t)
+	alice := loginJSON(t, first, "alice")
+	bob := loginJSON(t, second, "bob")
+
+	alice.sendFrame(Envelope{Type: FrameCommand, Text: "/join lobby"})
+	alice.waitFor("You are now the owner of room 'lobby'.")
+	bob.sendFrame(Envelope{Type: FrameCommand, Text: "/join lobby"})
+	alice.waitFor("bob has joined the room.")
+
+	alice.sendFrame(Envelope{Type: FrameCommand, Text: "/kick bob enough"})
+	bob.waitFor("You were kicked from room 'lobby' by alice: enough")
+	alice.waitFor("bob was kicked by alice: enough")
+	env := bob.waitFrame(func(env Envelope) bool { return env.Type == FrameRoom })
+	if env.Room != "general" {
+		t.Errorf("bob is talking in room '%s' after the kick; expected general", env.Room)
+	}
+}
+
+func TestReadPeerFrameLimit(t *testing.T) {
+	key := make([]byte, 32)
+	sealer, err := newLinkCipher(key)
+	if err != nil {
+		t.Fatalf("newLinkCipher returned error: %v", err)
+	}
+	opener, _ := newLinkCipher(key)
+	hello := `{"type":"hello","node":"first"}` + "\n"
+	long := `{"type":"hello","node":"` + strings.Repeat("x", peerMaxHello) + `"}` + "\n"
+
+	tests := []struct {
+		name    string
+		line    string
+		opener  *linkCipher
+		wantErr error
+	}{
+		{"clear hello", hello, nil, nil},
+		{"clear line too long", long, nil, errPeerFrameTooLong},
+		{"clear line without an end", strings.Repeat("x", 2*peerMaxHello), nil, errPeerFrameTooLong},
+		{"sealed line longer than a clear one may be", string(sealer.seal([]byte(long[:len(long)-1]))), opener, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readPeerFrame(bufio.NewReader(strings.NewReader(tt.line)), tt.opener)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("readPeerFrame returned %v; expected %v", err, tt.wantErr)
+			}
+		})
+	}
+}
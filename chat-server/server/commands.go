@@ -0,0 +1,565 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Permission is what a client needs to run a command
+type Permission int
+
+const (
+	PermissionAnyone     Permission = iota
+	PermissionRegistered            // Logged in to a registered account
+	PermissionModerator             // Moderator or owner of the current room
+	PermissionOwner                 // Owner of the current room
+)
+
+// CommandSpec describes a slash command for the registry and for /help
+type CommandSpec struct {
+	Name       string   // Without the leading slash
+	Aliases    []string // Other names the command answers to
+	Usage      string   // Arguments as shown by /help, e.g. "<user> <message>"
+	Help       string   // One-line description
+	MinArgs    int      // Fewer arguments print the usage
+	MaxArgs    int      // The last argument takes the rest of the line; -1 splits every word; "quotes" group words
+	Permission Permission
+}
+
+// Command is a slash command that can be added to a server with RegisterCommand
+type Command interface {
+	Spec() CommandSpec
+	Run(ctx *CommandContext)
+}
+
+// CommandContext is a single invocation of a command. Commands run on the
+// server's message loop, one at a time.
+type CommandContext struct {
+	Client *Client
+	Name   string   // The name or alias the command was invoked with
+	Args   []string // Arguments split as declared by the command's spec
+	Line   string   // Everything after the command name, trimmed
+
+	server *Server
+	done   <-chan struct{}
+	plugin *pluginRun // Set for plugin commands
+}
+
+// Done is closed when a plugin command has run out of time. The command is
+// abandoned if it has not returned soon after, so long-running commands should
+// watch it. It is nil for built-in commands.
+func (ctx *CommandContext) Done() <-chan struct{} {
+	return ctx.done
+}
+
+// Reply sends an informational notice to the client that ran the command
+func (ctx *CommandContext) Reply(format string, args ...interface{}) {
+	ctx.Client.systemf(format, args...)
+}
+
+// Error tells the client that ran the command that it failed
+func (ctx *CommandContext) Error(format string, args ...interface{}) {
+	ctx.Client.errorf(format, args...)
+}
+
+// Say posts a chat message to the client's active room as the client
+func (ctx *CommandContext) Say(text string) {
+	ctx.plugin.act(func() {
+		ctx.server.sendChatMessage(ctx.Client, ctx.Client.room, text, false)
+	})
+}
+
+// Announce sends a system notice to everyone in the client's active room
+func (ctx *CommandContext) Announce(format string, args ...interface{}) {
+	ctx.plugin.act(func() {
+		ctx.server.announce(ctx.Client.room, format, args...)
+	})
+}
+
+// User returns the name of the client that ran the command
+func (ctx *CommandContext) User() string {
+	return ctx.Client.name()
+}
+
+// Room returns the active room of the client that ran the command
+func (ctx *CommandContext) Room() string {
+	room, _ := ctx.Client.shown.Load().(string) // Safe even once abandoned
+	return room
+}
+
+// funcCommand adapts a function to the Command interface
+type funcCommand struct {
+	spec CommandSpec
+	run  func(ctx *CommandContext)
+}
+
+func (c funcCommand) Spec() CommandSpec       { return c.spec }
+func (c funcCommand) Run(ctx *CommandContext) { c.run(ctx) }
+
+// NewCommand creates a command from a spec and a function that runs it
+func NewCommand(spec CommandSpec, run func(ctx *CommandContext)) Command {
+	return funcCommand{spec: spec, run: run}
+}
+
+// commandRegistry maps command names and aliases to commands
+type commandRegistry struct {
+	byName   map[string]Command
+	commands []Command // In registration order, for /help
+	mutex    sync.RWMutex
+}
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{byName: make(map[string]Command)}
+}
+
+// add registers cmd under its name and aliases
+func (r *commandRegistry) add(cmd Command) error {
+	spec := cmd.Spec()
+	names := append([]string{spec.Name}, spec.Aliases...)
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, " /") {
+			return fmt.Errorf("invalid command name '%s'", name)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, name := range names {
+		if _, taken := r.byName[name]; taken {
+			return fmt.Errorf("command '/%s' is already registered", name)
+		}
+	}
+	for _, name := range names {
+		r.byName[name] = cmd
+	}
+	r.commands = append(r.commands, cmd)
+	return nil
+}
+
+// lookup finds a command by name or alias
+func (r *commandRegistry) lookup(name string) (Command, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	cmd, ok := r.byName[name]
+	return cmd, ok
+}
+
+// list returns every registered command in registration order
+func (r *commandRegistry) list() []Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]Command(nil), r.commands...)
+}
+
+// RegisterCommand adds a slash command. It fails if the name or an alias is taken.
+func (s *Server) RegisterCommand(cmd Command) error {
+	return s.commands.add(cmd)
+}
+
+// splitArgs splits a command line into at most max arguments, the last of
+// which takes the rest of the line as written; with max < 0 every word is an
+// argument. An argument may be quoted with double quotes to hold spaces, and a
+// backslash takes the next character literally.
+func splitArgs(line string, max int) []string {
+	var args []string
+	for line = strings.TrimSpace(line); line != "" && (max < 0 || len(args) < max); {
+		if len(args) == max-1 {
+			args = append(args, line)
+			break
+		}
+		var arg string
+		arg, line = nextArg(line)
+		args = append(args, arg)
+		line = strings.TrimSpace(line)
+	}
+	return args
+}
+
+// nextArg takes the first argument off a command line and returns it without
+// its quotes and backslashes, along with the rest of the line
+func nextArg(line string) (string, string) {
+	var arg strings.Builder
+	quoted, escaped := false, false
+	for i, r := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			return arg.String(), line[i:]
+		default:
+			arg.WriteRune(r)
+		}
+	}
+	if escaped {
+		arg.WriteByte('\\') // A backslash at the end stands for itself
+	}
+	return arg.String(), ""
+}
+
+// usage formats how to call a command
+func (spec CommandSpec) usage() string {
+	if spec.Usage == "" {
+		return "/" + spec.Name
+	}
+	return "/" + spec.Name + " " + spec.Usage
+}
+
+// runCommand parses a slash command line, checks permissions and runs the command
+func (s *Server) runCommand(client *Client, line string) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	cmd, ok := s.commands.lookup(name)
+	if !ok {
+		client.errorf("Unknown command '/%s'. Type /help for a list of commands.", name)
+		return
+	}
+	spec := cmd.Spec()
+
+	rest = strings.TrimSpace(rest)
+	args := splitArgs(rest, spec.MaxArgs)
+	if len(args) < spec.MinArgs || (spec.MaxArgs == 0 && rest != "") {
+		client.errorf("Usage: %s", spec.usage())
+		return
+	}
+	if !s.permitted(client, spec) {
+		return
+	}
+	cmd.Run(&CommandContext{Client: client, Name: name, Args: args, Line: rest, server: s})
+}
+
+// permitted checks that client may run a command, and tells the client if not
+func (s *Server) permitted(client *Client, spec CommandSpec) bool {
+	switch spec.Permission {
+	case PermissionRegistered:
+		if !client.registered {
+			client.errorf("You need a registered account to use /%s.", spec.Name)
+			return false
+		}
+	case PermissionModerator, PermissionOwner:
+		minRole := roleModerator
+		if spec.Permission == PermissionOwner {
+			minRole = roleOwner
+		}
+		s.mutex.Lock()
+		meta := s.moderatedRoom(client, minRole)
+		s.mutex.Unlock()
+		return meta != nil
+	}
+	return true
+}
+
+// registerBuiltinCommands adds the commands every server has
+func (s *Server) registerBuiltinCommands() {
+	builtins := []Command{
+		NewCommand(CommandSpec{Name: "help", Aliases: []string{"?"}, Usage: "[command]", MaxArgs: 1,
+			Help: "List commands, or describe one"}, s.showHelp),
+		NewCommand(CommandSpec{Name: "whisper", Aliases: []string{"w", "tell"}, Usage: "<user> <message>", MinArgs: 2, MaxArgs: 2,
+			Help: "Send a private message"}, func(ctx *CommandContext) {
+			s.sendWhisper(ctx.Client, ctx.Args[0], ctx.Args[1])
+		}),
+		NewCommand(CommandSpec{Name: "me", Usage: "<action>", MinArgs: 1, MaxArgs: 1,
+			Help: "Describe what you are doing, e.g. /me waves"}, func(ctx *CommandContext) {
+			s.sendChatMessage(ctx.Client, ctx.Client.room, ctx.Line, true)
+		}),
+		NewCommand(CommandSpec{Name: "msg", Usage: "#<room> <message>", MinArgs: 2, MaxArgs: 2,
+			Help: "Post to another of your rooms; /msg <user> <message> whispers"}, s.postToRoom),
+		NewCommand(CommandSpec{Name: "join", Usage: "<room>", MinArgs: 1, MaxArgs: 1,
+			Help: "Join a room, or switch to one you are in, and make it your active room"}, func(ctx *CommandContext) {
+			s.joinRoom(ctx.Client, ctx.Line)
+		}),
+		NewCommand(CommandSpec{Name: "leave", Usage: "[room]", MaxArgs: 1,
+			Help: "Leave your active room or another one"}, func(ctx *CommandContext) {
+			s.leaveRoom(ctx.Client, ctx.Line)
+		}),
+		NewCommand(CommandSpec{Name: "who", Usage: "[room]", MaxArgs: 1,
+			Help: "List the users in your room or another one"}, s.showWho),
+		NewCommand(CommandSpec{Name: "whois", Usage: "<user>", MinArgs: 1, MaxArgs: 1,
+			Help: "Show who a user is and what they are up to"}, s.showWhois),
+		NewCommand(CommandSpec{Name: "rooms",
+			Help: "List rooms with their member counts and topics"}, s.showRooms),
+		NewCommand(CommandSpec{Name: "away", Usage: "[message]", MaxArgs: 1,
+			Help: "Mark yourself away, or back if you were away"}, s.setAway),
+		NewCommand(CommandSpec{Name: "nick", Usage: "<name>", MinArgs: 1, MaxArgs: 1,
+			Help: "Change your name"}, func(ctx *CommandContext) {
+			s.changeNick(ctx.Client, ctx.Line)
+		}),
+		NewCommand(CommandSpec{Name: "history", Usage: "[n]", MaxArgs: 1,
+			Help: "Show older messages of your room"}, func(ctx *CommandContext) {
+			count := s.config().HistoryReplay
+			if len(ctx.Args) == 1 {
+				n, err := strconv.Atoi(ctx.Args[0])
+				if err != nil || n <= 0 {
+					ctx.Error("Usage: /history [n]")
+					return
+				}
+				count = n
+			}
+			s.showHistory(ctx.Client, count)
+		}),
+		NewCommand(CommandSpec{Name: "mentions", Usage: "[n]", MaxArgs: 1,
+			Help: "List the last n messages that mentioned you"}, func(ctx *CommandContext) {
+			s.showMentions(ctx.Client, ctx.Line)
+		}),
+		NewCommand(CommandSpec{Name: "search", Usage: "<words> [#room] [from:user] [since:date]", MinArgs: 1, MaxArgs: -1,
+			Help: "Find messages in the room logs; end a word with * to match its start"}, func(ctx *CommandContext) {
+			s.searchMessages(ctx.Client, ctx.Args)
+		}),
+		NewCommand(CommandSpec{Name: "register", Usage: "<password>", MinArgs: 1, MaxArgs: 1,
+			Help: "Reserve your current name with a password"}, func(ctx *CommandContext) {
+			s.registerAccount(ctx.Client, ctx.Line)
+		}),
+		NewCommand(CommandSpec{Name: "inbox",
+			Help: "List the whispers left for you while you were offline"}, func(ctx *CommandContext) {
+			s.showInbox(ctx.Client)
+		}),
+		NewCommand(CommandSpec{Name: "read", Usage: "[n]", MaxArgs: 1,
+			Help: "Read your unread messages, or message n of /inbox"}, func(ctx *CommandContext) {
+			s.readMail(ctx.Client, ctx.Line)
+		}),
+		NewCommand(CommandSpec{Name: "clear",
+			Help: "Empty your mailbox"}, func(ctx *CommandContext) {
+			s.clearMail(ctx.Client)
+		}),
+		NewCommand(CommandSpec{Name: "paste",
+			Help: "Post the lines that follow, up to a line with just '.', as one message"}, func(ctx *CommandContext) {
+			ctx.Error("Your client sends multi-line pastes itself; over telnet, type /paste on a line of its own.")
+		}),
+		NewCommand(CommandSpec{Name: "send", Usage: "<user|#room> <file>", MinArgs: 2, MaxArgs: 2,
+			Help: "Offer a file to a user or a room"}, func(ctx *CommandContext) {
+			ctx.Error("Sending files needs a client that can upload them, such as chat-client.")
+		}),
+		NewCommand(CommandSpec{Name: "accept", Usage: "[id]", MaxArgs: 1,
+			Help: "Download a file offered to you, by default the newest one"}, func(ctx *CommandContext) {
+			s.answerOffer(ctx.Client, ctx.Line, true)
+		}),
+		NewCommand(CommandSpec{Name: "decline", Usage: "[id]", MaxArgs: 1,
+			Help: "Turn down a file offered to you, by default the newest one"}, func(ctx *CommandContext) {
+			s.answerOffer(ctx.Client, ctx.Line, false)
+		}),
+		NewCommand(CommandSpec{Name: "files",
+			Help: "List the files offered to you"}, func(ctx *CommandContext) {
+			s.showOffers(ctx.Client)
+		}),
+		NewCommand(CommandSpec{Name: "topic", Usage: "[text|-]", MaxArgs: 1,
+			Help: "Show the topic of your room; moderators can set or clear it"}, func(ctx *CommandContext) {
+			s.setTopic(ctx.Client, ctx.Line)
+		}),
+		NewCommand(CommandSpec{Name: "op", Usage: "<user>", MinArgs: 1, MaxArgs: 1, Permission: PermissionOwner,
+			Help: "Make a user a moderator of your room"}, func(ctx *CommandContext) {
+			s.setModerator(ctx.Client, ctx.Line, true)
+		}),
+		NewCommand(CommandSpec{Name: "deop", Usage: "<user>", MinArgs: 1, MaxArgs: 1, Permission: PermissionOwner,
+			Help: "Take away a user's moderator rights"}, func(ctx *CommandContext) {
+			s.setModerator(ctx.Client, ctx.Line, false)
+		}),
+		NewCommand(CommandSpec{Name: "kick", Usage: "<user> [reason]", MinArgs: 1, MaxArgs: 2, Permission: PermissionModerator,
+			Help: "Send a user out of your room"}, func(ctx *CommandContext) {
+			s.kickUser(ctx.Client, ctx.Line)
+		}),
+		NewCommand(CommandSpec{Name: "ban", Usage: "<user> [reason]", MinArgs: 1, MaxArgs: 2, Permission: PermissionModerator,
+			Help: "Keep a user out of your room"}, func(ctx *CommandContext) {
+			s.banUser(ctx.Client, ctx.Line)
+		}),
+		NewCommand(CommandSpec{Name: "unban", Usage: "<user>", MinArgs: 1, MaxArgs: 1, Permission: PermissionModerator,
+			Help: "Lift a ban"}, func(ctx *CommandContext) {
+			s.unbanUser(ctx.Client, ctx.Line)
+		}),
+		NewCommand(CommandSpec{Name: "mute", Usage: "<user> <duration>", MinArgs: 2, MaxArgs: 2, Permission: PermissionModerator,
+			Help: "Silence a user for a while, e.g. /mute bob 10m"}, func(ctx *CommandContext) {
+			s.muteUser(ctx.Client, ctx.Line, false)
+		}),
+		NewCommand(CommandSpec{Name: "unmute", Usage: "<user>", MinArgs: 1, MaxArgs: 1, Permission: PermissionModerator,
+			Help: "Let a muted user speak again"}, func(ctx *CommandContext) {
+			s.muteUser(ctx.Client, ctx.Line, true)
+		}),
+		NewCommand(CommandSpec{Name: "invite-only", Usage: "[on|off]", MaxArgs: 1, Permission: PermissionModerator,
+			Help: "Only admit moderators and invited users"}, func(ctx *CommandContext) {
+			s.setInviteOnly(ctx.Client, ctx.Line)
+		}),
+		NewCommand(CommandSpec{Name: "invite", Usage: "<user>", MinArgs: 1, MaxArgs: 1, Permission: PermissionModerator,
+			Help: "Let a user into your invite-only room once"}, func(ctx *CommandContext) {
+			s.inviteUser(ctx.Client, ctx.Line)
+		}),
+	}
+	for _, cmd := range builtins {
+		if err := s.commands.add(cmd); err != nil {
+			logErrorf("Error registering built-in command: %v", err)
+		}
+	}
+}
+
+// showHelp handles /help [command]
+func (s *Server) showHelp(ctx *CommandContext) {
+	if len(ctx.Args) == 1 {
+		cmd, ok := s.commands.lookup(strings.TrimPrefix(ctx.Args[0], "/"))
+		if !ok {
+			ctx.Error("Unknown command '%s'.", ctx.Args[0])
+			return
+		}
+		spec := cmd.Spec()
+		ctx.Reply("Usage: %s", spec.usage())
+		if spec.Help != "" {
+			ctx.Reply("%s.", spec.Help)
+		}
+		if len(spec.Aliases) > 0 {
+			ctx.Reply("Also: /%s", strings.Join(spec.Aliases, ", /"))
+		}
+		if who := permissionName(spec.Permission); who != "" {
+			ctx.Reply("Only for %s.", who)
+		}
+		return
+	}
+
+	ctx.Reply("--- Commands ---")
+	for _, cmd := range s.commands.list() {
+		spec := cmd.Spec()
+		line := fmt.Sprintf("%-28s %s", spec.usage(), spec.Help)
+		if who := permissionName(spec.Permission); who != "" {
+			line += " (" + who + ")"
+		}
+		ctx.Reply("%s", line)
+	}
+	ctx.Reply("--- Use /help <command> for details; start a message with // to send a line beginning with / ---")
+}
+
+// permissionName describes who may use a command, or "" for anyone
+func permissionName(p Permission) string {
+	switch p {
+	case PermissionRegistered:
+		return "registered users"
+	case PermissionModerator:
+		return "moderators"
+	case PermissionOwner:
+		return "room owners"
+	default:
+		return ""
+	}
+}
+
+// postToRoom handles /msg #<room> <message>, which posts to one of the
+// client's rooms without making it active. Without the # it is a whisper.
+func (s *Server) postToRoom(ctx *CommandContext) {
+	roomName, ok := strings.CutPrefix(ctx.Args[0], "#")
+	if !ok {
+		s.sendWhisper(ctx.Client, ctx.Args[0], ctx.Args[1])
+		return
+	}
+	s.mutex.Lock()
+	member := ctx.Client.rooms[roomName]
+	s.mutex.Unlock()
+	if !member {
+		ctx.Error("You are not in room '%s'. Use /join %s first.", roomName, roomName)
+		return
+	}
+	s.sendChatMessage(ctx.Client, roomName, ctx.Args[1], false)
+}
+
+// changeNick handles /nick. The name changes in every room the client is in at
+// once. Guests keep their room rights under the new name; registered users
+// leave their account behind.
+//
+// Linked nodes may take a few seconds to confirm the new name, so the claim is
+// made off the message loop and finishNick completes the change on it.
+func (s *Server) changeNick(client *Client, newName string) {
+	oldName := client.name()
+	switch {
+	case newName == oldName:
+		client.errorf("You are already called '%s'.", newName)
+		return
+	case s.accounts.Exists(newName):
+		client.errorf("Name '%s' is registered. Log in with it instead.", newName)
+		return
+	}
+	if err := s.checkName(newName); err != nil {
+		client.errorf("Invalid name: %v.", err)
+		return
+	}
+	s.mutex.Lock()
+	roomNames := client.roomNames()
+	s.mutex.Unlock()
+	for _, roomName := range roomNames {
+		if left := s.mutedFor(client, roomName); left > 0 {
+			client.errorf("You cannot change your name while muted in room '%s'.", roomName)
+			return
+		}
+	}
+
+	go func() {
+		granted := s.reserveName(newName)
+		s.runOnLoop(func() { s.finishNick(client, newName, granted) })
+	}()
+}
+
+// finishNick renames a client once the new name is confirmed or refused.
+// It runs on the message loop.
+func (s *Server) finishNick(client *Client, newName string, granted bool) {
+	if !granted {
+		client.errorf("Name '%s' is already taken. Please choose another.", newName)
+		return
+	}
+
+	s.mutex.Lock()
+	if s.clients[client.conn] != client { // Disconnected while the peers were asked
+		s.mutex.Unlock()
+		s.releaseName(newName)
+		return
+	}
+	oldName := client.name()
+	delete(s.usernames, oldName)
+	s.usernames[newName] = client
+	s.cluster.mutex.Lock()
+	delete(s.cluster.claims, newName) // The name is now held by usernames
+	s.cluster.mutex.Unlock()
+	for roomName := range client.rooms {
+		if roomClients, ok := s.rooms[roomName]; ok {
+			delete(roomClients, oldName)
+			roomClients[newName] = client
+		}
+		meta, ok := s.roomState.rooms[roomName]
+		if !ok || client.registered {
+			continue
+		}
+		changed := false
+		if meta.Owner == oldName {
+			meta.Owner = newName
+			changed = true
+		}
+		if meta.Moderators[oldName] {
+			delete(meta.Moderators, oldName)
+			meta.Moderators[newName] = true
+			changed = true
+		}
+		if changed {
+			s.roomChanged(meta)
+		}
+	}
+	client.setName(newName)
+	s.transfers.withdraw(oldName)
+	wasRegistered := client.registered
+	client.registered = false
+	member := peerUserOf(client)
+	s.mutex.Unlock()
+
+	s.peerBroadcast(peerFrame{Type: peerUserLeave, User: oldName})
+	s.peerBroadcast(member.frame(peerUserJoin))
+	if !wasRegistered {
+		s.mailbox.MarkSeen(oldName, remoteIP(client.conn.RemoteAddr().String()))
+	}
+
+	if wasRegistered {
+		client.systemf("You are no longer logged in to account '%s'.", oldName)
+	}
+	env := newEnvelope(FramePresence)
+	env.From = oldName
+	env.To = newName
+	env.Text = fmt.Sprintf("%s is now known as %s.", oldName, newName)
+	s.broadcastToRooms(member.Rooms, env)
+	logDebugf("Client %s is now known as %s.", oldName, newName)
+}
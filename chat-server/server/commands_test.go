@@ -0,0 +1,184 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		max  int
+		want []string
+	}{
+		{"", 2, nil},
+		{"   ", -1, nil},
+		{"one", 2, []string{"one"}},
+		{"bob  hello there ", 2, []string{"bob", "hello there"}},
+		{"bob hello there", 1, []string{"bob hello there"}},
+		{"bob hello", 0, nil},
+		{"a  b\tc", -1, []string{"a", "b", "c"}},
+		{`"two words" rest of it`, 2, []string{"two words", "rest of it"}},
+		{`a"b c"d e`, 2, []string{"ab cd", "e"}},
+		{`"" x`, 2, []string{"", "x"}},
+		{`"unterminated quote`, -1, []string{"unterminated quote"}},
+		{`two\ words rest`, 2, []string{"two words", "rest"}},
+		{`say \"hi\" x`, -1, []string{"say", `"hi"`, "x"}},
+		{`back\\slash x`, -1, []string{`back\slash`, "x"}},
+		{`trailing\`, -1, []string{`trailing\`}},
+		{`bob "quotes stay" in the rest`, 2, []string{"bob", `"quotes stay" in the rest`}},
+	}
+
+	for _, tt := range tests {
+		if got := splitArgs(tt.line, tt.max); !slices.Equal(got, tt.want) {
+			t.Errorf("splitArgs(%q, %d) = %q; expected %q", tt.line, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestCommandRegistry(t *testing.T) {
+	r := newCommandRegistry()
+	run := func(ctx *CommandContext) {}
+
+	tests := []struct {
+		spec    CommandSpec
+		wantErr string
+	}{
+		{CommandSpec{Name: "roll", Aliases: []string{"dice"}}, ""},
+		{CommandSpec{Name: "dice"}, "command '/dice' is already registered"},
+		{CommandSpec{Name: "toss", Aliases: []string{"roll"}}, "command '/roll' is already registered"},
+		{CommandSpec{Name: ""}, "invalid command name ''"},
+		{CommandSpec{Name: "two words"}, "invalid command name 'two words'"},
+		{CommandSpec{Name: "flip", Aliases: []string{"/f"}}, "invalid command name '/f'"},
+	}
+	for _, tt := range tests {
+		err := r.add(NewCommand(tt.spec, run))
+		if got := errText(err); got != tt.wantErr {
+			t.Errorf("add(%+v) returned %q; expected %q", tt.spec, got, tt.wantErr)
+		}
+	}
+
+	// A failed registration leaves no name behind
+	for name, want := range map[string]bool{"roll": true, "dice": true, "toss": false, "flip": false} {
+		if _, ok := r.lookup(name); ok != want {
+			t.Errorf("lookup(%q) found a command: %t; expected %t", name, ok, want)
+		}
+	}
+	if n := len(r.list()); n != 1 {
+		t.Errorf("registry lists %d commands; expected 1", n)
+	}
+}
+
+// errText returns the text of err, or "" for nil
+func errText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestRunCommand(t *testing.T) {
+	s := startTestServer(t, func(cfg *Config) { cfg.CommandRate = 0 })
+	for _, cmd := range []Command{
+		NewCommand(CommandSpec{Name: "echo", Aliases: []string{"e"}, Usage: "<word> [rest]", MinArgs: 1, MaxArgs: 2},
+			func(ctx *CommandContext) { ctx.Reply("%s: %s", ctx.Name, strings.Join(ctx.Args, " | ")) }),
+		NewCommand(CommandSpec{Name: "secret", Permission: PermissionRegistered},
+			func(ctx *CommandContext) { ctx.Reply("the secret") }),
+	} {
+		if err := s.RegisterCommand(cmd); err != nil {
+			t.Fatalf("RegisterCommand returned error: %v", err)
+		}
+	}
+	loginJSON(t, s, "alice") // Owns the default room
+	bob := loginJSON(t, s, "bob")
+
+	tests := []struct {
+		name, line, want string
+	}{
+		{"unknown command", "/frobnicate now", "Unknown command '/frobnicate'. Type /help for a list of commands."},
+		{"arguments", "/echo a b  c", "echo: a | b  c"},
+		{"alias and quotes", `/e "two words" rest`, "e: two words | rest"},
+		{"too few arguments", "/echo   ", "Usage: /echo \\u003cword\\u003e [rest]"}, // As escaped in JSON
+		{"arguments to a command that takes none", "/rooms please", "Usage: /rooms"},
+		{"alias of a built-in", "/? w", "Also: /w, /tell"},
+		{"registered only", "/secret", "You need a registered account to use /secret."},
+		{"moderators only", "/kick alice", "Only moderators of room 'general' can do that."},
+		{"owner only", "/op bob", "Only the owner of room 'general' can do that."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bob.sendFrame(Envelope{Type: FrameCommand, Text: tt.line})
+			bob.waitFor(tt.want)
+		})
+	}
+}
+
+func TestChangeNick(t *testing.T) {
+	s := startTestServer(t, func(cfg *Config) { cfg.CommandRate = 0 })
+	alice := loginJSON(t, s, "alice")
+	bob := loginJSON(t, s, "bob")
+	alice.sendFrame(Envelope{Type: FrameCommand, Text: "/join dev"})
+	alice.waitFor("You are now the owner of room 'dev'.")
+	bob.sendFrame(Envelope{Type: FrameCommand, Text: "/join dev"})
+	alice.waitFor("bob has joined the room.")
+
+	alice.sendFrame(Envelope{Type: FrameCommand, Text: "/nick zed"})
+	bob.waitFor("alice is now known as zed.")
+
+	s.mutex.Lock()
+	for _, roomName := range []string{"general", "dev"} {
+		_, renamed := s.rooms[roomName]["zed"]
+		_, stale := s.rooms[roomName]["alice"]
+		if !renamed || stale {
+			t.Errorf("room '%s' holds zed: %t, alice: %t; expected only zed", roomName, renamed, stale)
+		}
+	}
+	if meta := s.roomState.find("dev"); meta == nil || meta.Owner != "zed" {
+		t.Errorf("room 'dev' has state %+v; expected zed to keep ownership", meta)
+	}
+	_, stale := s.usernames["alice"]
+	s.mutex.Unlock()
+	s.cluster.mutex.Lock()
+	claims := len(s.cluster.claims)
+	s.cluster.mutex.Unlock()
+	if stale || claims != 0 {
+		t.Errorf("alice is still online: %t, with %d names claimed; expected neither", stale, claims)
+	}
+
+	// zed talks under the new name in both rooms, and anyone may take the old one
+	alice.sendFrame(Envelope{Type: FrameMessage, Text: "renamed"})
+	got := bob.waitFrame(func(env Envelope) bool { return env.Text == "renamed" })
+	if got.From != "zed" || got.Room != "dev" {
+		t.Errorf("bob got %q from %s in room '%s'; expected it from zed in room 'dev'", got.Text, got.From, got.Room)
+	}
+	loginJSON(t, s, "alice")
+}
+
+func TestChangeNickRace(t *testing.T) {
+	s := startTestServer(t, nil)
+	observer := loginJSON(t, s, "observer")
+	racers := []*testConn{loginJSON(t, s, "bob"), loginJSON(t, s, "carol")}
+
+	for _, c := range racers {
+		c.sendFrame(Envelope{Type: FrameCommand, Text: "/nick dave"})
+	}
+	renamed := observer.waitFor("is now known as dave.")
+	winner, loser := "bob", "carol"
+	if strings.Contains(renamed, "carol is now known as dave.") {
+		winner, loser = "carol", "bob"
+	}
+	byName := map[string]*testConn{"bob": racers[0], "carol": racers[1]}
+	byName[winner].waitFor(winner + " is now known as dave.")
+	byName[loser].waitFor("Name 'dave' is already taken. Please choose another.")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dave, ok := s.usernames["dave"]
+	_, loserOnline := s.usernames[loser]
+	_, winnerOnline := s.usernames[winner]
+	if !ok || dave.name() != "dave" || !loserOnline || winnerOnline || len(s.usernames) != 3 {
+		t.Errorf("after the race %s is dave: %t, %s kept their name: %t, %d users online; expected %s renamed and %s unchanged",
+			winner, ok && !winnerOnline, loser, loserOnline, len(s.usernames), winner, loser)
+	}
+}
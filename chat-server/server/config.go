@@ -0,0 +1,239 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Config holds the tunable settings of a chat server
+type Config struct {
+	ListenAddr  string   // Listen address of the chat port
+	DefaultRoom string   // Room clients start in and fall back to
+	MOTD        string   // Message of the day shown to clients after they log in ("" shows none)
+	LogLevel    LogLevel // Least severe kind of message logged
+
+	SendQueueSize  int            // Outbound lines buffered per client
+	WriteTimeout   time.Duration  // Deadline for a single write to a client (0 disables it)
+	OverflowPolicy OverflowPolicy // What to do when a client's outbound queue is full
+
+	WebSocketAddr  string   // Listen address of the WebSocket gateway and web client ("" disables it)
+	AllowedOrigins []string // Pages besides the bundled web client that may open WebSockets, e.g. "https://chat.example.com"
+	AdminAddr      string   // Listen address of the admin HTTP API; keep it on loopback ("" disables it)
+	AdminToken     string   // Bearer token required by the admin API ("" requires none)
+
+	MessageRate          float64       // Chat lines per second allowed per client (0 disables the limit)
+	MessageBurst         int           // Chat lines a client may send at once
+	CommandRate          float64       // Commands per second allowed per client (0 disables the limit)
+	CommandBurst         int           // Commands a client may send at once
+	FloodMuteAfter       int           // Rejected lines before a client is muted (0 never mutes)
+	FloodMuteDuration    time.Duration // How long a flooding client is muted
+	FloodDisconnectAfter int           // Rejected lines before a client is disconnected (0 never disconnects)
+	FloodStrikeReset     time.Duration // Rejected lines are forgiven after this long without new ones
+	MaxConnsPerIP        int           // Concurrent connections allowed per remote IP (0 is unlimited)
+	MaxLineLength        int           // Longest line accepted from a client in bytes; longer ones are dropped (0 is unlimited)
+	UserNames            NamePolicy    // What user names may look like
+	RoomNames            NamePolicy    // What room names may look like
+	MaxPasteLines        int           // Longest block accepted by /paste, in lines
+	MaxPasteSize         int           // Longest block accepted by /paste, in bytes
+
+	LoginTimeout  time.Duration // How long a new connection may take to log in (0 waits forever)
+	ReadTimeout   time.Duration // Drop clients that send nothing at all, pongs included, for this long (0 disables it)
+	TCPKeepAlive  time.Duration // Period of TCP keepalive probes on chat connections (0 uses Go's default, negative disables them)
+	PingInterval  time.Duration // JSON clients that are silent for this long are sent a ping (0 disables pings)
+	PongTimeout   time.Duration // How long a JSON client has to answer a ping before it is dropped
+	IdleKickAfter time.Duration // Disconnect users who send nothing for this long (0 never kicks them)
+
+	AccountsFile string // JSON file holding registered accounts ("" keeps them in memory only)
+	AllowGuests  bool   // Let clients join under any unregistered name without a password
+
+	RoomsFile string // JSON file holding room owners, moderators, bans and topics ("" keeps them in memory only)
+
+	TLSCertFile          string // PEM certificate; together with TLSKeyFile enables TLS on all listeners
+	TLSKeyFile           string // PEM private key
+	TLSClientCAFile      string // PEM CA bundle used to verify client certificates ("" disables them)
+	TLSRequireClientCert bool   // Reject clients without a valid certificate
+
+	HistoryDir    string // Directory for the per-room message logs ("" disables persistence)
+	HistoryLimit  int    // Maximum number of messages kept per room
+	HistoryReplay int    // Number of messages replayed on connect and /join
+
+	MailboxFile    string        // JSON file holding whispers for offline users ("" keeps them in memory only)
+	MailboxLimit   int           // Messages kept per mailbox (0 is unlimited)
+	MailboxSeenFor time.Duration // Guests can get mail for this long after they disconnect, if they come back from the same address
+
+	MentionsFile string // JSON file holding the recent @mentions of each user ("" keeps them in memory only)
+	MentionLimit int    // Mentions kept per user for /mentions
+
+	TransferDir      string        // Directory where files sent with /send wait for their recipients ("" disables file transfers)
+	MaxFileSize      int64         // Largest file accepted by /send, in bytes
+	MaxTransferBytes int64         // Most bytes the files waiting in TransferDir may take up together (0 is unlimited)
+	TransferExpiry   time.Duration // Offers nobody answers within this long are withdrawn and their files deleted
+
+	IdleAfter time.Duration // Users who sent nothing for this long are shown as idle (0 never shows it)
+
+	PluginTimeout time.Duration // How long a plugin hook may run before it is abandoned (0 waits forever)
+
+	NodeName      string   // Name of this node in a cluster ("" uses the host name and chat port)
+	ClusterAddr   string   // Listen address for links from other nodes ("" accepts none)
+	ClusterPeers  []string // Cluster addresses of the other nodes to link to
+	ClusterSecret string   // Shared secret every node of the cluster must present
+}
+
+// DefaultConfig returns the settings used by NewServer
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:  ":8085",
+		DefaultRoom: "general",
+		LogLevel:    LogInfo,
+
+		SendQueueSize:  256,
+		WriteTimeout:   10 * time.Second,
+		OverflowPolicy: OverflowDropOldest,
+
+		WebSocketAddr: ":8086",
+		AdminAddr:     "127.0.0.1:8087",
+
+		MessageRate:          2,
+		MessageBurst:         10,
+		CommandRate:          1,
+		CommandBurst:         5,
+		FloodMuteAfter:       5,
+		FloodMuteDuration:    30 * time.Second,
+		FloodDisconnectAfter: 50,
+		FloodStrikeReset:     time.Minute,
+		MaxConnsPerIP:        10,
+		MaxLineLength:        4096,
+		UserNames: NamePolicy{
+			MinLength:  2,
+			MaxLength:  24,
+			ExtraChars: "-_.",
+			Reserved:   []string{"server", "system", "admin", "root", "moderator", "everyone", "here"},
+		},
+		RoomNames:     NamePolicy{MinLength: 1, MaxLength: 32, ExtraChars: "-_."},
+		MaxPasteLines: 200,
+		MaxPasteSize:  16 * 1024,
+
+		LoginTimeout: time.Minute,
+		TCPKeepAlive: 15 * time.Second,
+		PingInterval: 30 * time.Second,
+		PongTimeout:  15 * time.Second,
+
+		AccountsFile:  "data/accounts.json",
+		AllowGuests:   true,
+		RoomsFile:     "data/rooms.json",
+		HistoryDir:    "data/history",
+		HistoryLimit:  1000,
+		HistoryReplay: 20,
+
+		MailboxFile:    "data/mailbox.json",
+		MailboxLimit:   100,
+		MailboxSeenFor: 7 * 24 * time.Hour,
+
+		MentionsFile: "data/mentions.json",
+		MentionLimit: 50,
+
+		TransferDir:      "data/transfers",
+		MaxFileSize:      10 << 20,
+		MaxTransferBytes: 200 << 20,
+		TransferExpiry:   time.Hour,
+
+		IdleAfter: 5 * time.Minute,
+
+		PluginTimeout: 500 * time.Millisecond,
+	}
+}
+
+// SetDataDir keeps accounts, rooms, history, mailboxes, mentions and file transfers under dir
+func (c *Config) SetDataDir(dir string) {
+	c.AccountsFile = filepath.Join(dir, "accounts.json")
+	c.RoomsFile = filepath.Join(dir, "rooms.json")
+	c.HistoryDir = filepath.Join(dir, "history")
+	c.MailboxFile = filepath.Join(dir, "mailbox.json")
+	c.MentionsFile = filepath.Join(dir, "mentions.json")
+	c.TransferDir = filepath.Join(dir, "transfers")
+}
+
+// Validate reports the first setting that the server cannot run with, such as a
+// negative limit or timeout. Zero keeps its documented meaning.
+func (c Config) Validate() error {
+	if c.SendQueueSize < 1 {
+		return fmt.Errorf("SendQueueSize must be at least 1")
+	}
+	if c.OverflowPolicy != OverflowDropOldest && c.OverflowPolicy != OverflowDisconnect {
+		return fmt.Errorf("OverflowPolicy must be '%s' or '%s'", OverflowDropOldest, OverflowDisconnect)
+	}
+	if c.MessageRate < 0 || c.CommandRate < 0 {
+		return fmt.Errorf("MessageRate and CommandRate must not be negative")
+	}
+
+	counts := []struct {
+		name  string
+		value int64
+	}{
+		{"MessageBurst", int64(c.MessageBurst)},
+		{"CommandBurst", int64(c.CommandBurst)},
+		{"FloodMuteAfter", int64(c.FloodMuteAfter)},
+		{"FloodDisconnectAfter", int64(c.FloodDisconnectAfter)},
+		{"MaxConnsPerIP", int64(c.MaxConnsPerIP)},
+		{"MaxLineLength", int64(c.MaxLineLength)},
+		{"MaxPasteLines", int64(c.MaxPasteLines)},
+		{"MaxPasteSize", int64(c.MaxPasteSize)},
+		{"HistoryLimit", int64(c.HistoryLimit)},
+		{"HistoryReplay", int64(c.HistoryReplay)},
+		{"MailboxLimit", int64(c.MailboxLimit)},
+		{"MentionLimit", int64(c.MentionLimit)},
+		{"MaxFileSize", c.MaxFileSize},
+		{"MaxTransferBytes", c.MaxTransferBytes},
+	}
+	for _, count := range counts {
+		if count.value < 0 {
+			return fmt.Errorf("%s must not be negative", count.name)
+		}
+	}
+
+	// TCPKeepAlive is left out: a negative one disables the probes
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"WriteTimeout", c.WriteTimeout},
+		{"FloodMuteDuration", c.FloodMuteDuration},
+		{"FloodStrikeReset", c.FloodStrikeReset},
+		{"LoginTimeout", c.LoginTimeout},
+		{"ReadTimeout", c.ReadTimeout},
+		{"PingInterval", c.PingInterval},
+		{"IdleKickAfter", c.IdleKickAfter},
+		{"MailboxSeenFor", c.MailboxSeenFor},
+		{"TransferExpiry", c.TransferExpiry},
+		{"IdleAfter", c.IdleAfter},
+		{"PluginTimeout", c.PluginTimeout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			return fmt.Errorf("%s must not be negative", d.name)
+		}
+	}
+	if c.PingInterval > 0 && c.PongTimeout <= 0 {
+		return fmt.Errorf("PongTimeout must be positive when PingInterval is set")
+	}
+
+	for _, policy := range []struct {
+		name   string
+		policy NamePolicy
+	}{{"UserNames", c.UserNames}, {"RoomNames", c.RoomNames}} {
+		switch p := policy.policy; {
+		case p.MinLength < 0 || p.MaxLength < 0:
+			return fmt.Errorf("%s lengths must not be negative", policy.name)
+		case p.MaxLength > 0 && p.MinLength > p.MaxLength:
+			return fmt.Errorf("%s MinLength %d is greater than MaxLength %d", policy.name, p.MinLength, p.MaxLength)
+		}
+	}
+	if err := c.RoomNames.check("room name", c.DefaultRoom); err != nil {
+		return fmt.Errorf("DefaultRoom: %v", err)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("TLSCertFile and TLSKeyFile must be set together")
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// dataDirKey sets every storage path at once, in config files and as CHAT_DATA_DIR
+const dataDirKey = "DataDir"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// LoadConfigFile reads a JSON config file over cfg. Keys are Config field names,
+// matched case-insensitively, plus "DataDir" for Config.SetDataDir; durations
+// are strings such as "30s". Settings missing from the file are left alone.
+func LoadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	// The data directory goes first so explicit paths in the file override it
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if strings.EqualFold(a, dataDirKey) != strings.EqualFold(b, dataDirKey) {
+			if strings.EqualFold(a, dataDirKey) {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+
+	for _, key := range keys {
+		raw := settings[key]
+		if strings.EqualFold(key, dataDirKey) {
+			var dir string
+			if err := json.Unmarshal(raw, &dir); err != nil {
+				return fmt.Errorf("%s: %s: %v", path, key, err)
+			}
+			cfg.SetDataDir(dir)
+			continue
+		}
+		field, ok := configField(cfg, func(name string) bool { return strings.EqualFold(name, key) })
+		if !ok {
+			return fmt.Errorf("%s: unknown setting '%s'", path, key)
+		}
+		if err := setFromJSON(field, raw); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, key, err)
+		}
+	}
+	return nil
+}
+
+// ApplyEnv overrides cfg with CHAT_* variables, one per Config field in upper
+// snake case, e.g. CHAT_LISTEN_ADDR or CHAT_IDLE_KICK_AFTER, plus CHAT_DATA_DIR.
+// Lists are comma-separated and name policies are JSON. lookup is usually
+// os.LookupEnv.
+func ApplyEnv(cfg *Config, lookup func(key string) (string, bool)) error {
+	if dir, ok := lookup("CHAT_" + envName(dataDirKey)); ok {
+		cfg.SetDataDir(dir)
+	}
+	t := reflect.TypeOf(*cfg)
+	for i := 0; i < t.NumField(); i++ {
+		key := "CHAT_" + envName(t.Field(i).Name)
+		text, ok := lookup(key)
+		if !ok {
+			continue
+		}
+		if err := setFromString(reflect.ValueOf(cfg).Elem().Field(i), text); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// SetConfigValue sets the Config field named key, matched case-insensitively
+// and including "DataDir", from text written as in a CHAT_* variable. It backs
+// the -set flag.
+func SetConfigValue(cfg *Config, key, text string) error {
+	if strings.EqualFold(key, dataDirKey) {
+		cfg.SetDataDir(text)
+		return nil
+	}
+	field, ok := configField(cfg, func(name string) bool { return strings.EqualFold(name, key) })
+	if !ok {
+		return fmt.Errorf("unknown setting '%s'", key)
+	}
+	return setFromString(field, text)
+}
+
+// configField finds the Config field whose name matches
+func configField(cfg *Config, match func(name string) bool) (reflect.Value, bool) {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if match(v.Type().Field(i).Name) {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// envName turns a field name such as TLSCertFile into TLS_CERT_FILE
+func envName(field string) string {
+	runes := []rune(field)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// setFromJSON sets a Config field from a config file value
+func setFromJSON(field reflect.Value, raw json.RawMessage) error {
+	if field.Type() == durationType {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return fmt.Errorf("durations are strings such as \"30s\"")
+		}
+		return setFromString(field, text)
+	}
+	return json.Unmarshal(raw, field.Addr().Interface())
+}
+
+// setFromString sets a Config field from an environment variable
+func setFromString(field reflect.Value, text string) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(text))
+	}
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(text, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	case reflect.Struct:
+		return json.Unmarshal([]byte(text), field.Addr().Interface())
+	default:
+		return fmt.Errorf("cannot set a %s from the environment", field.Type())
+	}
+	return nil
+}
+
+// Reload switches the running server to cfg, as on SIGHUP. A cfg that fails
+// Config.Validate is returned as an error and the old settings stay. Listen addresses,
+// TLS files, storage and cluster settings are fixed at start-up; changes to
+// them are logged and ignored, as is removing the AdminToken of an admin API
+// that is not loopback-only. Queue sizes and rate limits apply to clients
+// that connect afterwards; everything else applies right away.
+func (s *Server) Reload(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	old := s.config()
+	fixed := []struct {
+		name    string
+		changed bool
+	}{
+		{"ListenAddr", cfg.ListenAddr != old.ListenAddr},
+		{"WebSocketAddr", cfg.WebSocketAddr != old.WebSocketAddr},
+		{"AdminAddr", cfg.AdminAddr != old.AdminAddr},
+		{"TLSCertFile", cfg.TLSCertFile != old.TLSCertFile},
+		{"TLSKeyFile", cfg.TLSKeyFile != old.TLSKeyFile},
+		{"TLSClientCAFile", cfg.TLSClientCAFile != old.TLSClientCAFile},
+		{"TLSRequireClientCert", cfg.TLSRequireClientCert != old.TLSRequireClientCert},
+		{"AccountsFile", cfg.AccountsFile != old.AccountsFile},
+		{"RoomsFile", cfg.RoomsFile != old.RoomsFile},
+		{"HistoryDir", cfg.HistoryDir != old.HistoryDir},
+		{"HistoryLimit", cfg.HistoryLimit != old.HistoryLimit},
+		{"MailboxFile", cfg.MailboxFile != old.MailboxFile},
+		{"MailboxLimit", cfg.MailboxLimit != old.MailboxLimit},
+		{"MailboxSeenFor", cfg.MailboxSeenFor != old.MailboxSeenFor},
+		{"MentionsFile", cfg.MentionsFile != old.MentionsFile},
+		{"MentionLimit", cfg.MentionLimit != old.MentionLimit},
+		{"TransferDir", cfg.TransferDir != old.TransferDir},
+		{"NodeName", cfg.NodeName != old.NodeName},
+		{"ClusterAddr", cfg.ClusterAddr != old.ClusterAddr},
+		{"ClusterPeers", !slices.Equal(cfg.ClusterPeers, old.ClusterPeers)},
+		{"ClusterSecret", cfg.ClusterSecret != old.ClusterSecret},
+	}
+	for _, setting := range fixed {
+		if setting.changed {
+			logWarnf("Ignoring new %s; it only changes on restart", setting.name)
+		}
+	}
+	if cfg.AdminToken == "" && old.AdminToken != "" && old.AdminAddr != "" && !isLoopback(old.AdminAddr) {
+		logWarnf("Keeping the old AdminToken; the admin API on %s is not loopback-only and needs one", old.AdminAddr)
+		cfg.AdminToken = old.AdminToken
+	}
+	cfg.ListenAddr, cfg.WebSocketAddr, cfg.AdminAddr = old.ListenAddr, old.WebSocketAddr, old.AdminAddr
+	cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile = old.TLSCertFile, old.TLSKeyFile, old.TLSClientCAFile
+	cfg.TLSRequireClientCert = old.TLSRequireClientCert
+	cfg.AccountsFile, cfg.RoomsFile, cfg.HistoryDir, cfg.HistoryLimit = old.AccountsFile, old.RoomsFile, old.HistoryDir, old.HistoryLimit
+	cfg.MailboxFile, cfg.MailboxLimit, cfg.MailboxSeenFor = old.MailboxFile, old.MailboxLimit, old.MailboxSeenFor
+	cfg.MentionsFile, cfg.MentionLimit, cfg.TransferDir = old.MentionsFile, old.MentionLimit, old.TransferDir
+	cfg.NodeName, cfg.ClusterAddr, cfg.ClusterPeers, cfg.ClusterSecret = old.NodeName, old.ClusterAddr, old.ClusterPeers, old.ClusterSecret
+
+	s.cfg.Store(&cfg)
+	setLogLevel(cfg.LogLevel)
+	logInfof("Configuration reloaded")
+	return nil
+}
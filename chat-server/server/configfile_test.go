@@ -0,0 +1,202 @@
+package server
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		field, want string
+	}{
+		{"ListenAddr", "LISTEN_ADDR"},
+		{"MOTD", "MOTD"},
+		{"TLSCertFile", "TLS_CERT_FILE"},
+		{"TLSRequireClientCert", "TLS_REQUIRE_CLIENT_CERT"},
+		{"MaxConnsPerIP", "MAX_CONNS_PER_IP"},
+		{"IdleKickAfter", "IDLE_KICK_AFTER"},
+		{"DataDir", "DATA_DIR"},
+	}
+
+	for _, tt := range tests {
+		if got := envName(tt.field); got != tt.want {
+			t.Errorf("envName(%q) = %q; expected %q", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestSetConfigValue(t *testing.T) {
+	tests := []struct {
+		key, text string
+		check     func(cfg Config) bool
+		wantErr   string
+	}{
+		{"MaxConnsPerIP", "20", func(cfg Config) bool { return cfg.MaxConnsPerIP == 20 }, ""},
+		{"maxconnsperip", "3", func(cfg Config) bool { return cfg.MaxConnsPerIP == 3 }, ""},
+		{"MessageRate", "2.5", func(cfg Config) bool { return cfg.MessageRate == 2.5 }, ""},
+		{"AllowGuests", "false", func(cfg Config) bool { return !cfg.AllowGuests }, ""},
+		{"IdleKickAfter", "90s", func(cfg Config) bool { return cfg.IdleKickAfter == 90*time.Second }, ""},
+		{"LogLevel", "warn", func(cfg Config) bool { return cfg.LogLevel == LogWarn }, ""},
+		{"MOTD", "a=b", func(cfg Config) bool { return cfg.MOTD == "a=b" }, ""},
+		{"ClusterPeers", " a:1, ,b:2 ", func(cfg Config) bool { return slices.Equal(cfg.ClusterPeers, []string{"a:1", "b:2"}) }, ""},
+		{"UserNames", `{"MinLength":3}`, func(cfg Config) bool { return cfg.UserNames.MinLength == 3 }, ""},
+		{"DataDir", "/srv/chat", func(cfg Config) bool { return cfg.RoomsFile == filepath.Join("/srv/chat", "rooms.json") }, ""},
+		{"MaxConnsPerIP", "lots", nil, "invalid syntax"},
+		{"IdleKickAfter", "90", nil, "missing unit"},
+		{"NoSuchSetting", "1", nil, "unknown setting 'NoSuchSetting'"},
+	}
+
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		err := SetConfigValue(&cfg, tt.key, tt.text)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("SetConfigValue(%s, %q) returned %v; expected %q", tt.key, tt.text, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("SetConfigValue(%s, %q) returned error: %v", tt.key, tt.text, err)
+		case !tt.check(cfg):
+			t.Errorf("SetConfigValue(%s, %q) did not set the field", tt.key, tt.text)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"CHAT_DATA_DIR":         "/srv/chat",
+		"CHAT_ROOMS_FILE":       "/etc/chat/rooms.json",
+		"CHAT_MAX_CONNS_PER_IP": "4",
+		"CHAT_TLS_CERT_FILE":    "cert.pem",
+	}
+	cfg := DefaultConfig()
+	if err := ApplyEnv(&cfg, func(key string) (string, bool) { v, ok := env[key]; return v, ok }); err != nil {
+		t.Fatalf("ApplyEnv returned error: %v", err)
+	}
+	if cfg.MaxConnsPerIP != 4 || cfg.TLSCertFile != "cert.pem" {
+		t.Errorf("ApplyEnv set MaxConnsPerIP %d and TLSCertFile %q; expected 4 and \"cert.pem\"", cfg.MaxConnsPerIP, cfg.TLSCertFile)
+	}
+	if cfg.RoomsFile != "/etc/chat/rooms.json" || cfg.AccountsFile != filepath.Join("/srv/chat", "accounts.json") {
+		t.Errorf("ApplyEnv set RoomsFile %q and AccountsFile %q; expected the explicit file to override the data directory", cfg.RoomsFile, cfg.AccountsFile)
+	}
+
+	env = map[string]string{"CHAT_PING_INTERVAL": "soon"}
+	if err := ApplyEnv(&cfg, func(key string) (string, bool) { v, ok := env[key]; return v, ok }); err == nil || !strings.HasPrefix(err.Error(), "CHAT_PING_INTERVAL: ") {
+		t.Errorf("ApplyEnv with a bad duration returned %v; expected an error naming CHAT_PING_INTERVAL", err)
+	}
+}
+
+func TestReloadAdminToken(t *testing.T) {
+	tests := []struct {
+		name, addr, oldToken, newToken, want string
+	}{
+		{"new token", "0.0.0.0:8087", "old", "new", "new"},
+		{"token removed on loopback", "127.0.0.1:8087", "old", "", ""},
+		{"token removed beyond loopback", "0.0.0.0:8087", "old", "", "old"},
+		{"token removed with the API off", "", "old", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.AdminAddr, cfg.AdminToken = tt.addr, tt.oldToken
+			s := NewServerWithConfig(cfg)
+			cfg.AdminToken = tt.newToken
+			s.Reload(cfg)
+			if got := s.config().AdminToken; got != tt.want {
+				t.Errorf("AdminToken after reload is %q; expected %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadMaxConnsPerIP(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxConnsPerIP = 0
+	s := NewServerWithConfig(cfg)
+
+	// Connections opened without a limit still count once one is set
+	s.acquireIP("10.0.0.1:1000")
+	s.acquireIP("10.0.0.1:1001")
+	cfg.MaxConnsPerIP = 2
+	s.Reload(cfg)
+	if s.acquireIP("10.0.0.1:1002") {
+		t.Errorf("a third connection was allowed with MaxConnsPerIP 2")
+	}
+
+	// Lifting the limit again leaves the counts intact for the next one
+	cfg.MaxConnsPerIP = 0
+	s.Reload(cfg)
+	s.releaseIP("10.0.0.1:1000")
+	cfg.MaxConnsPerIP = 2
+	s.Reload(cfg)
+	if !s.acquireIP("10.0.0.1:1003") {
+		t.Errorf("a second connection was refused after the first one closed")
+	}
+	if s.acquireIP("10.0.0.1:1004") {
+		t.Errorf("a third connection was allowed with MaxConnsPerIP 2")
+	}
+	for _, addr := range []string{"10.0.0.1:1001", "10.0.0.1:1003"} {
+		s.releaseIP(addr)
+	}
+	if n := len(s.connsPerIP); n != 0 {
+		t.Errorf("%d addresses are still counted after every connection closed", n)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		want   string // Start of the error, or "" for none
+	}{
+		{"defaults", func(cfg *Config) {}, ""},
+		{"limits off", func(cfg *Config) { cfg.MessageRate, cfg.MaxConnsPerIP, cfg.PingInterval, cfg.PongTimeout = 0, 0, 0, 0 }, ""},
+		{"keepalive probes off", func(cfg *Config) { cfg.TCPKeepAlive = -1 }, ""},
+		{"no send queue", func(cfg *Config) { cfg.SendQueueSize = 0 }, "SendQueueSize must be at least 1"},
+		{"negative send queue", func(cfg *Config) { cfg.SendQueueSize = -1 }, "SendQueueSize must be at least 1"},
+		{"unknown overflow policy", func(cfg *Config) { cfg.OverflowPolicy = "block" }, "OverflowPolicy must be"},
+		{"negative rate", func(cfg *Config) { cfg.CommandRate = -1 }, "MessageRate and CommandRate must not be negative"},
+		{"negative burst", func(cfg *Config) { cfg.MessageBurst = -1 }, "MessageBurst must not be negative"},
+		{"negative file size", func(cfg *Config) { cfg.MaxFileSize = -1 }, "MaxFileSize must not be negative"},
+		{"negative timeout", func(cfg *Config) { cfg.LoginTimeout = -time.Second }, "LoginTimeout must not be negative"},
+		{"negative pong timeout", func(cfg *Config) { cfg.PongTimeout = -time.Second }, "PongTimeout must be positive"},
+		{"negative pong timeout without pings", func(cfg *Config) { cfg.PingInterval, cfg.PongTimeout = 0, -time.Second }, ""},
+		{"name lengths crossed", func(cfg *Config) { cfg.UserNames.MinLength = 30 }, "UserNames MinLength 30 is greater than MaxLength 24"},
+		{"no maximum name length", func(cfg *Config) { cfg.UserNames.MinLength, cfg.UserNames.MaxLength = 30, 0 }, ""},
+		{"negative room name length", func(cfg *Config) { cfg.RoomNames.MaxLength = -1 }, "RoomNames lengths must not be negative"},
+		{"invalid default room", func(cfg *Config) { cfg.DefaultRoom = "no spaces" }, "DefaultRoom: room name may only contain"},
+		{"certificate without key", func(cfg *Config) { cfg.TLSCertFile = "cert.pem" }, "TLSCertFile and TLSKeyFile must be set together"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.change(&cfg)
+			err := cfg.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("Validate returned %v; expected no error", err)
+			case tt.want != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.want)):
+				t.Errorf("Validate returned %v; expected an error starting %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	cfg := DefaultConfig()
+	s := NewServerWithConfig(cfg)
+
+	cfg.MOTD = "new"
+	cfg.SendQueueSize = -1
+	if err := s.Reload(cfg); err == nil {
+		t.Errorf("Reload with a negative SendQueueSize returned no error")
+	}
+	if got := s.config(); got.SendQueueSize != 256 || got.MOTD != "" {
+		t.Errorf("Reload kept SendQueueSize %d and MOTD %q; expected the old 256 and \"\"", got.SendQueueSize, got.MOTD)
+	}
+}
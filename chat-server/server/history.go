@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is a single message stored in a room log
+type HistoryEntry struct {
+	Seq  int64     `json:"seq"` // Position in the room log, starting at 1
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	Room string    `json:"room"`
+	From string    `json:"from"`
+	Text string    `json:"text"`
+
+	Action bool `json:"action,omitempty"` // Sent with /me
+	Paste  bool `json:"paste,omitempty"`  // Sent with /paste; Text has line breaks
+}
+
+// roomLog is the in-memory tail of one room's log file
+type roomLog struct {
+	entries []HistoryEntry
+	lines   int   // Number of lines currently in the file
+	lastSeq int64 // Sequence number of the newest entry
+}
+
+// historyStore keeps a bounded, append-only log per room on disk
+type historyStore struct {
+	dir   string
+	limit int
+	rooms map[string]*roomLog
+	mutex sync.Mutex
+}
+
+func newHistoryStore(dir string, limit int) *historyStore {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			logErrorf("Error creating history directory %s: %v", dir, err)
+			dir = ""
+		}
+	}
+	return &historyStore{
+		dir:   dir,
+		limit: limit,
+		rooms: make(map[string]*roomLog),
+	}
+}
+
+// path returns the log file for a room; room names are escaped so they cannot leave dir
+func (h *historyStore) path(room string) string {
+	return filepath.Join(h.dir, url.PathEscape(room)+".log")
+}
+
+// load returns the cached log for a room, reading it from disk on first use.
+// The caller must hold h.mutex.
+func (h *historyStore) load(room string) *roomLog {
+	if rl, ok := h.rooms[room]; ok {
+		return rl
+	}
+	rl := &roomLog{}
+	h.rooms[room] = rl
+	if h.dir == "" {
+		return rl
+	}
+
+	f, err := os.Open(h.path(room))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logErrorf("Error opening history for room %s: %v", room, err)
+		}
+		return rl
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		rl.lines++
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // Skip torn or corrupt lines
+		}
+		rl.entries = append(rl.entries, entry)
+		if len(rl.entries) > h.limit {
+			rl.entries = rl.entries[1:]
+		}
+		if entry.Seq > rl.lastSeq {
+			rl.lastSeq = entry.Seq
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logErrorf("Error reading history for room %s: %v", room, err)
+	}
+	return rl
+}
+
+// Append records a message in the room log and assigns its sequence number
+func (h *historyStore) Append(entry HistoryEntry) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	rl := h.load(entry.Room)
+	rl.lastSeq++
+	entry.Seq = rl.lastSeq
+	rl.entries = append(rl.entries, entry)
+	if len(rl.entries) > h.limit {
+		rl.entries = rl.entries[len(rl.entries)-h.limit:]
+	}
+	if h.dir == "" {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logErrorf("Error encoding history entry for room %s: %v", entry.Room, err)
+		return
+	}
+	f, err := os.OpenFile(h.path(entry.Room), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		logErrorf("Error opening history for room %s: %v", entry.Room, err)
+		return
+	}
+	_, err = f.Write(append(line, '\n'))
+	f.Close()
+	if err != nil {
+		logErrorf("Error writing history for room %s: %v", entry.Room, err)
+		return
+	}
+	rl.lines++
+
+	// Let the file grow to twice the limit before compacting it back down
+	if rl.lines > 2*h.limit {
+		h.compact(entry.Room, rl)
+	}
+}
+
+// compact rewrites a room log so it only holds the cached tail.
+// The caller must hold h.mutex.
+func (h *historyStore) compact(room string, rl *roomLog) {
+	tmp := h.path(room) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		logErrorf("Error compacting history for room %s: %v", room, err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, entry := range rl.entries {
+		if err := enc.Encode(entry); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			logErrorf("Error compacting history for room %s: %v", room, err)
+			return
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		logErrorf("Error compacting history for room %s: %v", room, err)
+		return
+	}
+	f.Close()
+	if err := os.Rename(tmp, h.path(room)); err != nil {
+		logErrorf("Error compacting history for room %s: %v", room, err)
+		return
+	}
+	rl.lines = len(rl.entries)
+}
+
+// Page returns up to n messages of a room older than sequence number before
+// (0 means the newest messages). Entries are returned oldest first.
+func (h *historyStore) Page(room string, before int64, n int) []HistoryEntry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	entries := h.load(room).entries
+	end := len(entries)
+	if before > 0 {
+		end = sort.Search(len(entries), func(i int) bool { return entries[i].Seq >= before })
+	}
+	if end <= 0 || n <= 0 {
+		return nil
+	}
+	start := end - n
+	if start < 0 {
+		start = 0
+	}
+	page := make([]HistoryEntry, end-start)
+	copy(page, entries[start:end])
+	return page
+}
+
+// Rooms lists the rooms that have a log on disk
+func (h *historyStore) Rooms() []string {
+	if h.dir == "" {
+		return nil
+	}
+	files, err := os.ReadDir(h.dir)
+	if err != nil {
+		logErrorf("Error listing history directory %s: %v", h.dir, err)
+		return nil
+	}
+	var rooms []string
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".log")
+		if !ok || file.IsDir() {
+			continue
+		}
+		if room, err := url.PathUnescape(name); err == nil {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
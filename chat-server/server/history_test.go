@@ -0,0 +1,95 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// appendTexts adds one message per text to a room
+func appendTexts(h *historyStore, room string, texts ...string) {
+	for _, text := range texts {
+		h.Append(HistoryEntry{Room: room, From: "alice", Text: text})
+	}
+}
+
+// pageTexts returns the texts of a page of history
+func pageTexts(entries []HistoryEntry) []string {
+	texts := make([]string, len(entries))
+	for i, entry := range entries {
+		texts[i] = entry.Text
+	}
+	return texts
+}
+
+func TestHistoryPage(t *testing.T) {
+	h := newHistoryStore(t.TempDir(), 5)
+	appendTexts(h, "general", "1", "2", "3", "4", "5", "6", "7")
+	appendTexts(h, "other", "x")
+
+	tests := []struct {
+		name   string
+		room   string
+		before int64
+		n      int
+		want   []string
+	}{
+		{"newest", "general", 0, 3, []string{"5", "6", "7"}},
+		{"more than the limit", "general", 0, 10, []string{"3", "4", "5", "6", "7"}},
+		{"older page", "general", 6, 2, []string{"4", "5"}},
+		{"older than the cached tail", "general", 3, 2, nil},
+		{"no entries asked for", "general", 0, 0, nil},
+		{"other room", "other", 0, 10, []string{"x"}},
+		{"empty room", "nobody", 0, 10, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pageTexts(h.Page(tt.room, tt.before, tt.n))
+			if len(got) != len(tt.want) {
+				t.Fatalf("Page(%q, %d, %d) = %q; expected %q", tt.room, tt.before, tt.n, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Page(%q, %d, %d) = %q; expected %q", tt.room, tt.before, tt.n, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHistoryReload(t *testing.T) {
+	dir := t.TempDir()
+	h := newHistoryStore(dir, 3)
+	appendTexts(h, "general", "1", "2", "3", "4", "5", "6", "7", "8")
+	appendTexts(h, "a/b", "slash")
+
+	// A torn line at the end of the file is skipped
+	f, err := os.OpenFile(h.path("general"), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("Error opening the room log: %v", err)
+	}
+	f.WriteString(`{"seq":9,"te` + "\n")
+	f.Close()
+
+	reloaded := newHistoryStore(dir, 3)
+	entries := reloaded.Page("general", 0, 10)
+	if got := pageTexts(entries); len(got) != 3 || got[0] != "6" || got[2] != "8" {
+		t.Errorf("reloaded history is %q; expected [6 7 8]", got)
+	}
+	if len(entries) > 0 && entries[len(entries)-1].Seq != 8 {
+		t.Errorf("newest reloaded entry has sequence number %d; expected 8", entries[len(entries)-1].Seq)
+	}
+
+	reloaded.Append(HistoryEntry{Room: "general", Text: "9"})
+	if entries := reloaded.Page("general", 0, 1); len(entries) != 1 || entries[0].Seq != 9 {
+		t.Errorf("entry appended after reloading got %+v; expected sequence number 9", entries)
+	}
+
+	if got := pageTexts(reloaded.Page("a/b", 0, 1)); len(got) != 1 || got[0] != "slash" {
+		t.Errorf("history of room 'a/b' is %q; expected [slash]", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a%2Fb.log")); err != nil {
+		t.Errorf("room 'a/b' was not logged to an escaped file name: %v", err)
+	}
+}
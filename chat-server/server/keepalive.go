@@ -0,0 +1,78 @@
+package server
+
+import (
+	"time"
+)
+
+// keepaliveSweep is how often logged-in clients are checked for pings, dead peers and idleness
+const keepaliveSweep = time.Second
+
+// sweepConnections pings JSON clients that have gone quiet, drops the ones that
+// stop answering and kicks users who have been idle for too long. It runs until
+// the server shuts down.
+func (s *Server) sweepConnections() {
+	ticker := time.NewTicker(keepaliveSweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			clients := make([]*Client, 0, len(s.clients))
+			for _, client := range s.clients {
+				clients = append(clients, client)
+			}
+			s.mutex.Unlock()
+			for _, client := range clients {
+				s.checkConnection(client, now)
+			}
+		}
+	}
+}
+
+// checkConnection applies the keepalive and idle policies to one client
+func (s *Server) checkConnection(client *Client, now time.Time) {
+	if client.kicked {
+		return // Already on its way out
+	}
+	cfg := s.config()
+	if kickAfter := cfg.IdleKickAfter; kickAfter > 0 && now.Sub(client.lastActiveAt()) >= kickAfter {
+		client.kicked = true
+		client.errorf("You were idle for more than %s. Disconnecting.", kickAfter)
+		logWarnf("Disconnecting %s: idle for more than %s", client.name(), kickAfter)
+		go client.close() // Flush the notice; the reader then unregisters the client
+		return
+	}
+
+	if client.protocol != ProtocolJSON || cfg.PingInterval <= 0 {
+		return // Text clients cannot answer pings; TCP keepalive finds their dead peers
+	}
+	lastRead := time.Unix(0, client.lastRead.Load())
+	if !client.pingedAt.IsZero() && lastRead.After(client.pingedAt) {
+		client.pingedAt = time.Time{} // Answered, or at least still talking
+	}
+	switch {
+	case client.pingedAt.IsZero() && now.Sub(lastRead) >= cfg.PingInterval:
+		ping := newEnvelope(FramePing)
+		if err := client.send(ping); err != nil {
+			logErrorf("Error sending ping to %s: %v", client.name(), err)
+		}
+		client.pingedAt = now
+	case !client.pingedAt.IsZero() && now.Sub(client.pingedAt) >= cfg.PongTimeout:
+		client.kicked = true
+		logWarnf("Disconnecting %s: no pong within %s", client.name(), cfg.PongTimeout)
+		client.conn.Close() // The peer is gone, so there is nothing to flush
+	}
+}
+
+// answerPing replies to a ping frame sent by a client
+func (c *Client) answerPing(ping Envelope) {
+	pong := newEnvelope(FramePong)
+	if ping.ID != "" {
+		pong.ID = ping.ID
+	}
+	if err := c.send(pong); err != nil {
+		logErrorf("Error sending pong to %s: %v", c.name(), err)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// waitClosed reads from c until the server closes the connection
+func waitClosed(t *testing.T, c *testConn) {
+	t.Helper()
+	for {
+		_, err := c.readLine()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("The server did not close the connection")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	t.Run("silent client is pinged and dropped", func(t *testing.T) {
+		t.Parallel()
+		s := startTestServer(t, func(cfg *Config) {
+			cfg.PingInterval = 100 * time.Millisecond
+			cfg.PongTimeout = 100 * time.Millisecond
+		})
+		c := loginJSON(t, s, "alice")
+		c.waitFrame(func(env Envelope) bool { return env.Type == FramePing })
+		waitClosed(t, c)
+	})
+
+	t.Run("client that answers stays", func(t *testing.T) {
+		t.Parallel()
+		s := startTestServer(t, func(cfg *Config) {
+			cfg.PingInterval = 100 * time.Millisecond
+			cfg.PongTimeout = 100 * time.Millisecond
+		})
+		c := loginJSON(t, s, "alice")
+		for i := 0; i < 3; i++ {
+			ping := c.waitFrame(func(env Envelope) bool { return env.Type == FramePing })
+			c.sendFrame(Envelope{Type: FramePong, ID: ping.ID})
+		}
+		s.mutex.Lock()
+		_, online := s.usernames["alice"]
+		s.mutex.Unlock()
+		if !online {
+			t.Errorf("a client answering every ping was dropped")
+		}
+	})
+
+	t.Run("idle user is kicked", func(t *testing.T) {
+		t.Parallel()
+		s := startTestServer(t, func(cfg *Config) {
+			cfg.IdleKickAfter = 100 * time.Millisecond
+			cfg.PingInterval = 0
+		})
+		c := loginJSON(t, s, "alice")
+		c.waitFor("You were idle for more than 100ms. Disconnecting.")
+		waitClosed(t, c)
+	})
+}
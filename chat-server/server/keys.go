@@ -0,0 +1,44 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// publicKeySize is the length of an X25519 public key
+const publicKeySize = 32
+
+// publishKey lists a client's public key in the key directory. The server only
+// passes keys on; the private keys never leave the clients.
+func (s *Server) publishKey(client *Client, key string) {
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != publicKeySize {
+		client.errorf("Invalid public key; expected %d bytes in base64.", publicKeySize)
+		return
+	}
+	s.mutex.Lock()
+	client.publicKey = key
+	s.mutex.Unlock()
+	s.peerBroadcast(peerFrame{Type: peerUserKey, User: client.name(), Key: key})
+}
+
+// lookupKey answers a key request with the public key of an online user. The
+// reply has no key if the user is offline or never published one.
+func (s *Server) lookupKey(client *Client, name string) {
+	reply := newEnvelope(FrameKey)
+	reply.From = name
+	s.mutex.Lock()
+	target, local := s.usernames[name]
+	if local {
+		reply.Key = target.publicKey
+	}
+	s.mutex.Unlock()
+	if !local {
+		reply.Key = s.remoteKey(name)
+	}
+	if reply.Key == "" {
+		reply.Text = fmt.Sprintf("User '%s' is offline or has no key for encrypted whispers.", name)
+	}
+	if err := client.send(reply); err != nil {
+		logErrorf("Error sending key of %s to %s: %v", name, client.name(), err)
+	}
+}
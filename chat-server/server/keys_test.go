@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestKeyDirectory(t *testing.T) {
+	s := startTestServer(t, func(cfg *Config) { cfg.CommandRate = 0 })
+	alice := loginJSON(t, s, "alice")
+	bob := loginJSON(t, s, "bob")
+	loginJSON(t, s, "carol") // Online without a key
+
+	key := base64.StdEncoding.EncodeToString(make([]byte, publicKeySize))
+	alice.sendFrame(Envelope{Type: FrameKey, Key: key})
+	waitUntil(t, "alice's key to be published", func() bool {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return s.usernames["alice"].publicKey == key
+	})
+
+	tests := []struct {
+		name     string
+		to       string
+		wantKey  string
+		wantText string
+	}{
+		{"published key", "alice", key, ""},
+		{"online without a key", "carol", "", "User 'carol' is offline or has no key for encrypted whispers."},
+		{"offline", "dave", "", "User 'dave' is offline or has no key for encrypted whispers."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bob.sendFrame(Envelope{Type: FrameKey, To: tt.to})
+			env := bob.waitFrame(func(env Envelope) bool { return env.Type == FrameKey })
+			if env.From != tt.to || env.Key != tt.wantKey || env.Text != tt.wantText {
+				t.Errorf("key reply is %+v; expected %q from %s with text %q", env, tt.wantKey, tt.to, tt.wantText)
+			}
+		})
+	}
+
+	t.Run("invalid key", func(t *testing.T) {
+		bob.sendFrame(Envelope{Type: FrameKey, Key: base64.StdEncoding.EncodeToString([]byte("short"))})
+		env := bob.waitFrame(func(env Envelope) bool { return env.Type == FrameError })
+		if !strings.HasPrefix(env.Text, "Invalid public key") {
+			t.Errorf("bob got %q; expected the key to be rejected", env.Text)
+		}
+	})
+}
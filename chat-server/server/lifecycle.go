@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+)
+
+// trackConn records an open connection so Shutdown can close it.
+// It returns false if the server is shutting down.
+func (s *Server) trackConn(client *Client) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.conns[client.conn] = client
+	s.connWG.Add(1)
+	return true
+}
+
+// untrackConn forgets a connection once its handler has finished
+func (s *Server) untrackConn(client *Client) {
+	s.mutex.Lock()
+	delete(s.conns, client.conn)
+	s.mutex.Unlock()
+	s.connWG.Done()
+}
+
+// Shutdown stops accepting connections, tells every room the server is going
+// down, closes all connections and waits for the server's goroutines to exit.
+// If ctx expires first, Shutdown returns the context's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.closing {
+		s.mutex.Unlock()
+		return errors.New("server is already shut down")
+	}
+	s.closing = true
+	listener := s.listener
+	wsServer := s.wsServer
+	adminServer := s.adminServer
+	s.mutex.Unlock()
+
+	if listener == nil {
+		return nil // Listen was never called, so nothing is running
+	}
+	logInfof("Shutting down chat server...")
+
+	// Stop accepting new clients
+	listener.Close()
+	if wsServer != nil {
+		if err := wsServer.Shutdown(ctx); err != nil {
+			logErrorf("Error shutting down WebSocket gateway: %v", err)
+		}
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			logErrorf("Error shutting down admin API: %v", err)
+		}
+	}
+
+	// Peers drop this node's users when its links close
+	s.stopCluster()
+
+	s.broadcastShutdownNotice()
+
+	// Let every writer flush what is queued, including the notice. Writes are
+	// bounded by the write timeout, and by ctx in case that is disabled.
+	s.mutex.Lock()
+	clients := make([]*Client, 0, len(s.conns))
+	for _, client := range s.conns {
+		clients = append(clients, client)
+	}
+	s.mutex.Unlock()
+	for _, client := range clients {
+		client.closeQueue()
+	}
+	for _, client := range clients {
+		select {
+		case <-client.out.done:
+		case <-ctx.Done():
+		}
+	}
+
+	// Closing the connections makes every handleConnection return, which
+	// unregisters its client through the still running message loop.
+	for _, client := range clients {
+		client.conn.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		s.cluster.wg.Wait()
+		close(s.quit)
+		<-s.loopDone
+		<-s.roomsDone
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logInfof("Chat server stopped.")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// broadcastShutdownNotice tells every room that the server is going down.
+// Clients in several rooms are told once.
+func (s *Server) broadcastShutdownNotice() {
+	s.mutex.Lock()
+	roomNames := make([]string, 0, len(s.rooms))
+	for roomName := range s.rooms {
+		roomNames = append(roomNames, roomName)
+	}
+	s.mutex.Unlock()
+
+	env := newEnvelope(FrameSystem)
+	env.Text = "Server is shutting down. Goodbye!"
+	s.deliverToRooms(roomNames, env) // Only this node is going down
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the least severe kind of message the server logs
+type LogLevel int32
+
+const (
+	LogDebug LogLevel = iota // Every client joining, leaving and moving between rooms
+	LogInfo                  // Server, cluster and plugin lifecycle
+	LogWarn                  // Clients disconnected for misbehaving, rejected peers and plugins that failed
+	LogError                 // Failed reads, writes and storage operations
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// ParseLogLevel parses "debug", "info", "warn" or "error"
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return LogLevel(i), nil
+		}
+	}
+	return LogInfo, fmt.Errorf("unknown log level '%s'; use debug, info, warn or error", name)
+}
+
+func (l LogLevel) String() string {
+	if l < LogDebug || l > LogError {
+		return fmt.Sprintf("LogLevel(%d)", int32(l))
+	}
+	return logLevelNames[l]
+}
+
+// MarshalText writes the level's name, for config files
+func (l LogLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText reads a level's name, for config files
+func (l *LogLevel) UnmarshalText(text []byte) error {
+	level, err := ParseLogLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// logLevel is shared by every server in the process, like the log package itself
+var logLevel atomic.Int32
+
+func setLogLevel(level LogLevel) {
+	logLevel.Store(int32(level))
+}
+
+// logf logs a message if level is at or above the configured level
+func logf(level LogLevel, format string, args ...interface{}) {
+	if int32(level) >= logLevel.Load() {
+		log.Printf(format, args...)
+	}
+}
+
+func logDebugf(format string, args ...interface{}) { logf(LogDebug, format, args...) }
+func logInfof(format string, args ...interface{})  { logf(LogInfo, format, args...) }
+func logWarnf(format string, args ...interface{})  { logf(LogWarn, format, args...) }
+func logErrorf(format string, args ...interface{}) { logf(LogError, format, args...) }
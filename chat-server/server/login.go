@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// maxLoginAttempts is how many failed logins a connection gets before it is dropped
+const maxLoginAttempts = 3
+
+// login runs the connect-time handshake and fills in the client's identity.
+// It returns false if the connection should be closed.
+//
+// Text clients answer "Enter your name: " with a name (then a password if the
+// name is registered), "/login <name> <password>" or "/register <name> <password>".
+// JSON clients answer with a hello or register frame instead.
+//
+// Clients that present a verified TLS client certificate are logged in under
+// the certificate's common name and only need to confirm the prompt.
+func (s *Server) login(client *Client, reader *bufio.Reader) bool {
+	certName, err := peerCertName(client.conn)
+	if err != nil {
+		logWarnf("TLS handshake with %s failed: %v", client.conn.RemoteAddr(), err)
+		return false
+	}
+	if certName != "" {
+		// A CA may issue any common name; it must still be a valid nick
+		if err := s.checkName(certName); err != nil {
+			logWarnf("Refusing client certificate of %s for %q: %v", client.conn.RemoteAddr(), certName, err)
+			client.errorf("The name %q in your client certificate cannot be used: %v. Disconnecting.", certName, err)
+			return false
+		}
+		return s.loginCert(client, reader, certName)
+	}
+
+	for attempt := 0; attempt < maxLoginAttempts; attempt++ {
+		client.write([]byte("Enter your name: "))
+		line, err := readLine(reader, s.config().MaxLineLength)
+		if err != nil {
+			logErrorf("Error reading name: %v", err)
+			return false
+		}
+		line = strings.TrimSpace(line) // Remove newline and any other whitespace
+
+		// A JSON frame instead of a name switches the connection to the JSON-lines protocol
+		if strings.HasPrefix(line, "{") {
+			return s.loginJSON(client, line, "")
+		}
+
+		var name string
+		var registered bool
+		switch {
+		case strings.HasPrefix(line, "/login "), strings.HasPrefix(line, "/register "):
+			parts := strings.Fields(line)
+			if len(parts) != 3 {
+				client.errorf("Usage: %s <name> <password>", parts[0])
+				continue
+			}
+			name = parts[1]
+			if parts[0] == "/register" {
+				if err := s.checkName(name); err != nil {
+					client.errorf("Invalid name: %v.", err)
+					continue
+				}
+				err = s.accounts.Register(name, parts[2])
+			} else {
+				name, err = s.accounts.Authenticate(name, parts[2])
+			}
+			if err != nil {
+				client.errorf("%s failed: %v.", strings.TrimPrefix(parts[0], "/"), err)
+				continue
+			}
+			registered = true
+
+		case s.accounts.Exists(line):
+			name = line
+			client.write([]byte("Password: "))
+			password, err := readLine(reader, s.config().MaxLineLength)
+			if err != nil {
+				logErrorf("Error reading password: %v", err)
+				return false
+			}
+			if name, err = s.accounts.Authenticate(name, strings.TrimSpace(password)); err != nil {
+				client.errorf("Wrong password for '%s'.", line)
+				continue
+			}
+			registered = true
+
+		default:
+			name = line
+			if name == "" {
+				client.errorf("Name cannot be empty.")
+				continue
+			}
+			if err := s.checkName(name); err != nil {
+				client.errorf("Invalid name: %v.", err)
+				continue
+			}
+			if !s.config().AllowGuests {
+				client.errorf("Guest access is disabled. Use /register <name> <password> or /login <name> <password>.")
+				continue
+			}
+		}
+
+		client.setName(name)
+		client.registered = registered
+		if s.claimName(client) {
+			return true
+		}
+	}
+
+	client.errorf("Too many failed attempts. Disconnecting.")
+	return false
+}
+
+// loginCert logs in a client authenticated by a TLS client certificate
+func (s *Server) loginCert(client *Client, reader *bufio.Reader, certName string) bool {
+	client.write([]byte(fmt.Sprintf("Authenticated as '%s' by client certificate. Press Enter to continue: ", certName)))
+	line, err := readLine(reader, s.config().MaxLineLength)
+	if err != nil {
+		logErrorf("Error reading from %s: %v", certName, err)
+		return false
+	}
+	if line = strings.TrimSpace(line); strings.HasPrefix(line, "{") {
+		return s.loginJSON(client, line, certName)
+	}
+
+	client.setName(certName)
+	client.registered = true
+	return s.claimName(client)
+}
+
+// loginJSON handles the first frame of a JSON-lines client. A non-empty
+// certName overrides the name in the frame and skips password checks.
+func (s *Server) loginJSON(client *Client, line, certName string) bool {
+	client.protocol = ProtocolJSON
+	client.write([]byte("\n")) // Terminate the text prompt so every following line is a frame
+
+	hello, err := decodeEnvelope(line)
+	if err != nil || (hello.Type != FrameHello && hello.Type != FrameRegister) {
+		client.errorf("Expected a hello or register frame. Disconnecting.")
+		return false
+	}
+	client.setName(strings.TrimSpace(hello.From))
+	if certName != "" {
+		client.setName(certName)
+	}
+	if client.name() == "" {
+		client.errorf("Name cannot be empty. Disconnecting.")
+		return false
+	}
+	if certName == "" && (hello.Type == FrameRegister || !s.accounts.Exists(client.name())) {
+		if err := s.checkName(client.name()); err != nil {
+			client.errorf("Invalid name: %v. Disconnecting.", err)
+			return false
+		}
+	}
+
+	switch {
+	case certName != "":
+		// Already authenticated by the TLS handshake
+	case hello.Type == FrameRegister:
+		err = s.accounts.Register(client.name(), hello.Password)
+	case hello.Password != "" || s.accounts.Exists(client.name()):
+		var name string
+		if name, err = s.accounts.Authenticate(client.name(), hello.Password); err == nil {
+			client.setName(name) // The account's own spelling
+		}
+	case !s.config().AllowGuests:
+		err = fmt.Errorf("guest access is disabled")
+	}
+	if err != nil {
+		client.errorf("Login failed: %v. Disconnecting.", err)
+		return false
+	}
+	client.registered = certName != "" || hello.Type == FrameRegister || hello.Password != ""
+	return s.claimName(client)
+}
+
+// claimName checks that nobody else is connected under the client's name,
+// on this node or any other node of the cluster
+func (s *Server) claimName(client *Client) bool {
+	if !s.reserveName(client.name()) {
+		client.errorf("Name '%s' is already taken. Please choose another.", client.name())
+		return false
+	}
+	return true
+}
+
+// registerAccount lets a guest reserve their current name with a password
+func (s *Server) registerAccount(client *Client, password string) {
+	if client.registered {
+		client.errorf("You are already logged in to a registered account.")
+		return
+	}
+	if err := s.accounts.Register(client.name(), password); err != nil {
+		client.errorf("Registration failed: %v.", err)
+		return
+	}
+	s.mutex.Lock() // The admin API reads it from its own goroutine
+	client.registered = true
+	s.mutex.Unlock()
+	client.systemf("Name '%s' is now registered to you.", client.name())
+	logInfof("Client %s registered an account.", client.name())
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errMailboxFull = errors.New("mailbox is full")
+
+// Mail is a whisper kept for a user who was offline when it was sent
+type Mail struct {
+	ID   string    `json:"id"`
+	From string    `json:"from"`
+	Text string    `json:"text"`
+	Time time.Time `json:"ts"`
+	Read bool      `json:"read,omitempty"`
+
+	Guest bool `json:"guest,omitempty"` // Sent to a guest name; only that guest coming back gets it
+}
+
+// mailFile is the on-disk format of the mailbox file
+type mailFile struct {
+	Boxes    map[string][]*Mail   `json:"boxes"`
+	Seen     map[string]time.Time `json:"seen"`                // When each guest last disconnected
+	SeenFrom map[string]string    `json:"seen_from,omitempty"` // The IP address each guest disconnected from
+}
+
+// mailStore keeps offline whispers and when each guest was last seen in a JSON file
+type mailStore struct {
+	path     string
+	limit    int           // Messages kept per mailbox
+	seenFor  time.Duration // How long after disconnecting a guest can still receive mail
+	boxes    map[string][]*Mail
+	seen     map[string]time.Time
+	seenFrom map[string]string
+	mutex    sync.Mutex
+}
+
+func newMailStore(path string, limit int, seenFor time.Duration) *mailStore {
+	store := &mailStore{
+		path:     path,
+		limit:    limit,
+		seenFor:  seenFor,
+		boxes:    make(map[string][]*Mail),
+		seen:     make(map[string]time.Time),
+		seenFrom: make(map[string]string),
+	}
+	if path == "" {
+		return store
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logErrorf("Error reading mailbox file %s: %v", path, err)
+		}
+		return store
+	}
+	var file mailFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		logErrorf("Error parsing mailbox file %s: %v", path, err)
+		return store
+	}
+	if file.Boxes != nil {
+		store.boxes = file.Boxes
+	}
+	if file.Seen != nil {
+		store.seen = file.Seen
+	}
+	if file.SeenFrom != nil {
+		store.seenFrom = file.SeenFrom
+	}
+	return store
+}
+
+// seenRecently returns the names that equal name, ignoring case, and
+// disconnected within the seen window
+func (m *mailStore) seenRecently(name string) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var names []string
+	for seenName, seen := range m.seen {
+		if strings.EqualFold(seenName, name) && time.Since(seen) < m.seenFor {
+			names = append(names, seenName)
+		}
+	}
+	return names
+}
+
+// MarkSeen records that the guest called name disconnected from ip just now
+func (m *mailStore) MarkSeen(name, ip string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.seen[name] = time.Now()
+	m.seenFrom[name] = ip
+	m.save()
+}
+
+// Resume hands name's mailbox to a user who just logged in under that name.
+// Mail left for a guest is only kept for that guest coming back: another guest
+// connecting from the address it left from, within the seen window. Anyone
+// else taking the name, including a new account, has that mail dropped.
+func (m *mailStore) Resume(name, ip string, guest bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	seen, wasSeen := m.seen[name]
+	returning := guest && wasSeen && time.Since(seen) < m.seenFor && m.seenFrom[name] == ip
+	delete(m.seen, name) // Online again; marked anew when they leave
+	delete(m.seenFrom, name)
+	if !returning {
+		kept := m.boxes[name][:0]
+		for _, mail := range m.boxes[name] {
+			if !mail.Guest {
+				kept = append(kept, mail)
+			}
+		}
+		if len(kept) == 0 {
+			delete(m.boxes, name)
+		} else {
+			m.boxes[name] = kept
+		}
+	}
+	if wasSeen || !returning {
+		m.save()
+	}
+}
+
+// Deliver puts a message into name's mailbox
+func (m *mailStore) Deliver(name string, mail *Mail) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.limit > 0 && len(m.boxes[name]) >= m.limit {
+		return errMailboxFull
+	}
+	m.boxes[name] = append(m.boxes[name], mail)
+	m.save()
+	return nil
+}
+
+// Unread returns how many messages in name's mailbox have not been read
+func (m *mailStore) Unread(name string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	unread := 0
+	for _, mail := range m.boxes[name] {
+		if !mail.Read {
+			unread++
+		}
+	}
+	return unread
+}
+
+// List returns a copy of name's mailbox, oldest first
+func (m *mailStore) List(name string) []Mail {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	box := make([]Mail, 0, len(m.boxes[name]))
+	for _, mail := range m.boxes[name] {
+		box = append(box, *mail)
+	}
+	return box
+}
+
+// MarkRead flags the given messages of name's mailbox as read
+func (m *mailStore) MarkRead(name string, ids []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	read := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		read[id] = true
+	}
+	for _, mail := range m.boxes[name] {
+		if read[mail.ID] {
+			mail.Read = true
+		}
+	}
+	m.save()
+}
+
+// Clear empties name's mailbox and returns how many messages were removed
+func (m *mailStore) Clear(name string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	removed := len(m.boxes[name])
+	delete(m.boxes, name)
+	m.save()
+	return removed
+}
+
+// save writes all mailboxes to disk, forgetting users not seen for too long.
+// The caller must hold m.mutex.
+func (m *mailStore) save() {
+	for name, seen := range m.seen {
+		if time.Since(seen) >= m.seenFor {
+			delete(m.seen, name)
+			delete(m.seenFrom, name)
+		}
+	}
+	if m.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(mailFile{Boxes: m.boxes, Seen: m.seen, SeenFrom: m.seenFrom}, "", "  ")
+	if err != nil {
+		logErrorf("Error encoding mailbox file: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		logErrorf("Error writing mailbox file %s: %v", m.path, err)
+		return
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		logErrorf("Error writing mailbox file %s: %v", m.path, err)
+		return
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		logErrorf("Error writing mailbox file %s: %v", m.path, err)
+	}
+}
+
+// mailWhisper keeps a whisper to an offline user in their mailbox. It returns
+// false if the target is neither registered nor a guest seen recently. A guest
+// name can be taken by anyone once its user is gone, so mail to a guest is
+// marked as such and only handed over by Resume to the same guest coming back.
+// The caller must not hold s.mutex, since Deliver writes the mailbox file.
+func (s *Server) mailWhisper(senderClient *Client, env Envelope) bool {
+	mail := &Mail{ID: env.ID, From: env.From, Text: env.Text, Time: env.Time}
+	target := env.To
+	if names := s.accounts.Matching(target); len(names) > 0 {
+		target = names[0]
+	} else if names := s.mailbox.seenRecently(target); len(names) > 0 {
+		target = names[0]
+		mail.Guest = true
+	} else {
+		return false
+	}
+	if err := s.mailbox.Deliver(target, mail); err != nil {
+		senderClient.errorf("Could not leave a message for %s: %v.", target, err)
+		return true
+	}
+	senderClient.systemf("%s is offline; your message was left in their mailbox.", target)
+	return true
+}
+
+// showUnread tells a client who just logged in about unread mail, after
+// dropping mail left for a guest who used to have the name
+func (s *Server) showUnread(client *Client) {
+	s.mailbox.Resume(client.name(), remoteIP(client.conn.RemoteAddr().String()), !client.registered)
+	if unread := s.mailbox.Unread(client.name()); unread > 0 {
+		client.systemf("You have %s. Use /inbox to list your mailbox and /read to read them.", pluralize(unread, "unread message"))
+	}
+}
+
+// showInbox handles /inbox
+func (s *Server) showInbox(client *Client) {
+	box := s.mailbox.List(client.name())
+	if len(box) == 0 {
+		client.systemf("Your mailbox is empty.")
+		return
+	}
+	client.systemf("--- Mailbox: %d messages, %d unread ---", len(box), s.mailbox.Unread(client.name()))
+	for i, mail := range box {
+		flag := " "
+		if !mail.Read {
+			flag = "*"
+		}
+		preview := mail.Text
+		if runes := []rune(preview); len(runes) > 40 {
+			preview = string(runes[:40]) + "..."
+		}
+		client.systemf("%s %d. [%s] %s: %s", flag, i+1, mail.Time.Format("2006-01-02 15:04"), mail.From, preview)
+	}
+	client.systemf("--- Use /read [n] to read unread messages or message n, /clear to empty the mailbox ---")
+}
+
+// readMail handles /read [n]; without an argument it shows every unread message
+func (s *Server) readMail(client *Client, args string) {
+	box := s.mailbox.List(client.name())
+	var selected []Mail
+	if args = strings.TrimSpace(args); args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 1 || n > len(box) {
+			client.errorf("Usage: /read [n], where n is a message number from /inbox")
+			return
+		}
+		selected = box[n-1 : n]
+	} else {
+		for _, mail := range box {
+			if !mail.Read {
+				selected = append(selected, mail)
+			}
+		}
+		if len(selected) == 0 {
+			client.systemf("No unread messages.")
+			return
+		}
+	}
+
+	ids := make([]string, 0, len(selected))
+	for _, mail := range selected {
+		env := Envelope{Type: FrameWhisper, ID: mail.ID, From: mail.From, To: client.name(), Text: mail.Text, Time: mail.Time, History: true}
+		if err := client.send(env); err != nil {
+			logErrorf("Error sending mail to %s: %v", client.name(), err)
+			return
+		}
+		ids = append(ids, mail.ID)
+	}
+	s.mailbox.MarkRead(client.name(), ids)
+}
+
+// clearMail handles /clear
+func (s *Server) clearMail(client *Client) {
+	removed := s.mailbox.Clear(client.name())
+	client.systemf("Removed %s from your mailbox.", pluralize(removed, "message"))
+}
+
+// pluralize formats a count with a singular or plural noun
+func pluralize(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailboxResume(t *testing.T) {
+	tests := []struct {
+		name     string
+		seenAgo  time.Duration // How long ago bob left from 10.0.0.1; 0 if never seen
+		ip       string
+		guest    bool
+		wantMail []string
+	}{
+		{"guest coming back", time.Hour, "10.0.0.1", true, []string{"to account", "to guest"}},
+		{"guest from another address", time.Hour, "10.0.0.2", true, []string{"to account"}},
+		{"guest after the seen window", 8 * 24 * time.Hour, "10.0.0.1", true, []string{"to account"}},
+		{"guest never seen", 0, "10.0.0.1", true, []string{"to account"}},
+		{"registered user", time.Hour, "10.0.0.1", false, []string{"to account"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mailbox.json")
+			m := newMailStore(path, 10, 7*24*time.Hour)
+			m.Deliver("bob", &Mail{ID: "1", Text: "to account"})
+			m.Deliver("bob", &Mail{ID: "2", Text: "to guest", Guest: true})
+			if tt.seenAgo > 0 {
+				m.MarkSeen("bob", "10.0.0.1")
+				m.seen["bob"] = time.Now().Add(-tt.seenAgo)
+			}
+
+			m.Resume("bob", tt.ip, tt.guest)
+			for _, store := range []*mailStore{m, newMailStore(path, 10, 7*24*time.Hour)} {
+				box := store.List("bob")
+				var texts []string
+				for _, mail := range box {
+					texts = append(texts, mail.Text)
+				}
+				if len(texts) != len(tt.wantMail) || (len(texts) > 0 && texts[len(texts)-1] != tt.wantMail[len(tt.wantMail)-1]) {
+					t.Errorf("mailbox holds %q; expected %q", texts, tt.wantMail)
+				}
+				if names := store.seenRecently("bob"); len(names) != 0 {
+					t.Errorf("bob is still seen as %q after logging in", names)
+				}
+			}
+		})
+	}
+}
+
+func TestMailWhisper(t *testing.T) {
+	s := startTestServer(t, nil)
+	alice := loginJSON(t, s, "alice")
+
+	// carol registers and leaves; dave is a guest who leaves
+	for _, frame := range []Envelope{
+		{Type: FrameRegister, From: "carol", Password: "secretpass1"},
+		{Type: FrameHello, From: "dave"},
+	} {
+		c := dial(t, s)
+		c.sendFrame(frame)
+		c.waitFrame(func(env Envelope) bool { return env.Type == FrameRoom })
+		c.conn.Close()
+		alice.waitFor(frame.From + " has left the chat.")
+	}
+
+	tests := []struct {
+		name, to, want string
+	}{
+		{"registered user", "carol", "carol is offline; your message was left in their mailbox."},
+		{"registered user in another case", "Carol", "carol is offline; your message was left in their mailbox."},
+		{"guest seen recently", "dave", "dave is offline; your message was left in their mailbox."},
+		{"unknown user", "erin", "User 'erin' not found."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice.sendFrame(Envelope{Type: FrameWhisper, To: tt.to, Text: "hi " + tt.to})
+			alice.waitFor(tt.want)
+		})
+	}
+
+	// The tests connect from one address, so dave coming back gets his mail
+	dave := dial(t, s)
+	dave.sendFrame(Envelope{Type: FrameHello, From: "dave"})
+	dave.waitFor("You have 1 unread message.")
+}
+
+func TestWhisperIgnoresCase(t *testing.T) {
+	s := startTestServer(t, nil)
+	alice := loginJSON(t, s, "alice")
+	bob := loginJSON(t, s, "bob")
+
+	alice.sendFrame(Envelope{Type: FrameWhisper, To: "BOB", Text: "hi bob"})
+	got := bob.waitFrame(func(env Envelope) bool { return env.Type == FrameWhisper })
+	if got.Text != "hi bob" || got.To != "bob" {
+		t.Errorf("bob got whisper %+v; expected \"hi bob\" to bob", got)
+	}
+	echo := alice.waitFrame(func(env Envelope) bool {
+		return env.Type == FrameWhisper || strings.Contains(env.Text, "offline")
+	})
+	if echo.Type != FrameWhisper || echo.To != "bob" {
+		t.Errorf("alice got %+v; expected the whisper to bob back", echo)
+	}
+	if box := s.mailbox.List("bob"); len(box) != 0 {
+		t.Errorf("bob's mailbox holds %d messages; expected none", len(box))
+	}
+
+	alice.sendFrame(Envelope{Type: FrameWhisper, To: "ALICE", Text: "me"})
+	alice.waitFor("You cannot whisper to yourself.")
+}
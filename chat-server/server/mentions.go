@@ -0,0 +1,334 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// mentionReplay is how many mentions /mentions lists by default
+const mentionReplay = 10
+
+// Mention is a room message that mentioned a user
+type Mention struct {
+	ID     string    `json:"id"`
+	Room   string    `json:"room"`
+	From   string    `json:"from"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"ts"`
+	Unread bool      `json:"unread,omitempty"` // Arrived while the user was offline
+}
+
+// mentionStore keeps the recent mentions of each user in a JSON file
+type mentionStore struct {
+	path  string
+	limit int // Mentions kept per user
+	users map[string][]*Mention
+	mutex sync.Mutex
+}
+
+func newMentionStore(path string, limit int) *mentionStore {
+	store := &mentionStore{path: path, limit: limit, users: make(map[string][]*Mention)}
+	if path == "" {
+		return store
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logErrorf("Error reading mentions file %s: %v", path, err)
+		}
+		return store
+	}
+	if err := json.Unmarshal(data, &store.users); err != nil {
+		logErrorf("Error parsing mentions file %s: %v", path, err)
+	}
+	if store.users == nil {
+		store.users = make(map[string][]*Mention)
+	}
+	return store
+}
+
+// Add records a mention for each of names, dropping their oldest mentions
+// beyond the limit
+func (m *mentionStore) Add(names []string, mention Mention) {
+	if len(names) == 0 {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, name := range names {
+		copied := mention
+		list := append(m.users[name], &copied)
+		if m.limit > 0 && len(list) > m.limit {
+			list = list[len(list)-m.limit:]
+		}
+		m.users[name] = list
+	}
+	m.save()
+}
+
+// Unread returns how many of name's mentions arrived while they were offline
+// and have not been listed yet
+func (m *mentionStore) Unread(name string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	unread := 0
+	for _, mention := range m.users[name] {
+		if mention.Unread {
+			unread++
+		}
+	}
+	return unread
+}
+
+// Recent returns copies of name's newest n mentions, oldest first, and marks
+// them all read
+func (m *mentionStore) Recent(name string, n int) []Mention {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	list := m.users[name]
+	recent := make([]Mention, 0, min(n, len(list)))
+	for _, mention := range list[max(len(list)-n, 0):] {
+		recent = append(recent, *mention)
+	}
+	changed := false
+	for _, mention := range list {
+		changed = changed || mention.Unread
+		mention.Unread = false
+	}
+	if changed {
+		m.save()
+	}
+	return recent
+}
+
+// save writes all mentions to disk. The caller must hold m.mutex.
+func (m *mentionStore) save() {
+	if m.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(m.users, "", "  ")
+	if err != nil {
+		logErrorf("Error encoding mentions file: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		logErrorf("Error writing mentions file %s: %v", m.path, err)
+		return
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		logErrorf("Error writing mentions file %s: %v", m.path, err)
+		return
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		logErrorf("Error writing mentions file %s: %v", m.path, err)
+	}
+}
+
+// mentionSet holds the names a message mentions with "@name", lower-cased,
+// mapped to the names as written. "@here" and "@everyone" mention everyone
+// in the room.
+type mentionSet map[string]string
+
+// parseMentions finds the "@name" mentions in text. An "@" only starts a
+// mention at the start of a word, so e-mail addresses are left alone. Names
+// may contain letters, digits and extra; a trailing dot is taken as either
+// part of the name or the end of the sentence.
+func parseMentions(text, extra string) mentionSet {
+	isNameRune := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(extra, r)
+	}
+	var mentioned mentionSet
+	for start := 0; ; {
+		i := strings.IndexByte(text[start:], '@')
+		if i < 0 {
+			break
+		}
+		at := start + i
+		start = at + 1
+		if before, _ := utf8.DecodeLastRuneInString(text[:at]); at > 0 && (isNameRune(before) || before == '@') {
+			continue
+		}
+		rest := text[start:]
+		end := strings.IndexFunc(rest, func(r rune) bool { return !isNameRune(r) })
+		if end < 0 {
+			end = len(rest)
+		}
+		for _, name := range []string{rest[:end], strings.TrimRight(rest[:end], ".")} {
+			if name != "" {
+				if mentioned == nil {
+					mentioned = make(mentionSet)
+				}
+				mentioned[strings.ToLower(name)] = name
+			}
+		}
+	}
+	return mentioned
+}
+
+// direct reports whether name itself is mentioned
+func (m mentionSet) direct(name string) bool {
+	_, ok := m[strings.ToLower(name)]
+	return ok
+}
+
+// everyone reports whether the whole room is mentioned with @here or @everyone
+func (m mentionSet) everyone() bool {
+	_, here := m["here"]
+	_, everyone := m["everyone"]
+	return here || everyone
+}
+
+// includes reports whether name is mentioned, directly or with @here or @everyone
+func (m mentionSet) includes(name string) bool {
+	return m.everyone() || m.direct(name)
+}
+
+// mentionPreview shortens a message for a notification line
+func mentionPreview(text string) string {
+	first, rest, multiline := strings.Cut(text, "\n")
+	if runes := []rune(first); len(runes) > 80 {
+		return string(runes[:80]) + "..."
+	}
+	if multiline && rest != "" {
+		return first + " ..."
+	}
+	return first
+}
+
+// mayMentionEveryoneLocked reports whether name may mention a whole room with
+// @here or @everyone, which only its moderators and owner can.
+// The caller must hold s.mutex.
+func (s *Server) mayMentionEveryoneLocked(name, roomName string) bool {
+	meta, ok := s.roomState.rooms[roomName]
+	return ok && meta.role(name) >= roleModerator
+}
+
+// notifyMentionsLocked tells the users on this node who were mentioned by name
+// in a message delivered to a room but are not in the room. It returns those
+// of them with an account along with the highlighted members with one; the
+// caller records their mentions once it has released s.mutex. Like offline
+// ones, mentions of guests are not kept. The caller must hold s.mutex.
+func (s *Server) notifyMentionsLocked(roomName string, env Envelope, mentioned mentionSet, highlighted []string) []string {
+	note := newEnvelope(FrameMention)
+	note.ID, note.From, note.Room = env.ID, env.From, roomName
+	note.Text = fmt.Sprintf("%s mentioned you in #%s: %s", env.From, roomName, mentionPreview(env.Text))
+
+	var notified []string
+	for _, name := range highlighted {
+		if client, ok := s.usernames[name]; ok && client.registered {
+			notified = append(notified, name)
+		}
+	}
+	for name, client := range s.usernames {
+		if client.rooms[roomName] || name == env.From || !mentioned.direct(name) {
+			continue
+		}
+		if err := client.send(note); err != nil {
+			logErrorf("Error sending mention notice to %s: %v", name, err)
+		}
+		if client.registered {
+			notified = append(notified, name)
+		}
+	}
+	return notified
+}
+
+// mentionOffline keeps the mentions in a room message for users who are not
+// connected to any node, if they have an account. A guest name can be taken
+// by anyone once its user is gone, so mentions of guests are not kept. Like live
+// mentions, names match ignoring case. The sender is told they will see it
+// later.
+func (s *Server) mentionOffline(env Envelope) {
+	if env.Type != FrameMessage {
+		return
+	}
+	mentioned := parseMentions(env.Text, s.config().UserNames.ExtraChars)
+	if len(mentioned) == 0 {
+		return
+	}
+
+	known := make(map[string]bool)
+	for lower := range mentioned {
+		for _, name := range s.accounts.Matching(lower) {
+			known[name] = true
+		}
+	}
+	if len(known) == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	var offline []string
+	for name := range known {
+		if _, local := s.usernames[name]; local || name == env.From {
+			continue
+		}
+		if _, remote := s.remoteRoute(name); remote {
+			continue
+		}
+		offline = append(offline, name)
+	}
+	sender, ok := s.usernames[env.From]
+	s.mutex.Unlock()
+	if len(offline) == 0 {
+		return
+	}
+	sort.Strings(offline)
+	s.mentions.Add(offline, Mention{ID: env.ID, Room: env.Room, From: env.From, Text: env.Text, Time: env.Time, Unread: true})
+	switch {
+	case !ok:
+	case len(offline) == 1:
+		sender.systemf("%s is offline and will see your mention when they return.", offline[0])
+	default:
+		sender.systemf("%s are offline and will see your mention when they return.", strings.Join(offline, ", "))
+	}
+}
+
+// showUnreadMentions tells a client who just logged in how often they were
+// mentioned while they were away
+func (s *Server) showUnreadMentions(client *Client) {
+	if unread := s.mentions.Unread(client.name()); unread > 0 {
+		client.systemf("You were mentioned %s while you were away. Use /mentions to see them.", pluralize(unread, "time"))
+	}
+}
+
+// showMentions handles /mentions [n]
+func (s *Server) showMentions(client *Client, args string) {
+	n := mentionReplay
+	if args = strings.TrimSpace(args); args != "" {
+		var err error
+		if n, err = strconv.Atoi(args); err != nil || n <= 0 {
+			client.errorf("Usage: /mentions [n]")
+			return
+		}
+	}
+	if !client.registered {
+		client.systemf("Mentions are only kept for users with an account; /register to keep yours.")
+		return
+	}
+	recent := s.mentions.Recent(client.name(), n)
+	if len(recent) == 0 {
+		client.systemf("Nobody has mentioned you yet.")
+		return
+	}
+	client.systemf("--- Your last %s ---", pluralize(len(recent), "mention"))
+	for _, m := range recent {
+		flag := " "
+		if m.Unread {
+			flag = "*"
+		}
+		client.systemf("%s [%s] #%s %s: %s", flag, m.Time.Format("2006-01-02 15:04"), m.Room, m.From, mentionPreview(m.Text))
+	}
+	client.systemf("--- End of mentions ---")
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		name, text   string
+		want         []string // Lower-cased names mentioned
+		wantEveryone bool
+	}{
+		{"plain", "@bob can you look?", []string{"bob"}, false},
+		{"case", "thanks @Bob!", []string{"bob"}, false},
+		{"several", "@alice, @bob and @alice", []string{"alice", "bob"}, false},
+		{"e-mail address", "mail alice@example.com", nil, false},
+		{"trailing dot", "ask @bob.", []string{"bob", "bob."}, false},
+		{"dots inside", "ask @j.r.bob...", []string{"j.r.bob", "j.r.bob..."}, false},
+		{"extra characters", "@the_bot-2 go", []string{"the_bot-2"}, false},
+		{"unicode", "@zoë hi", []string{"zoë"}, false},
+		{"after punctuation", "(@bob)", []string{"bob"}, false},
+		{"double at", "@@bob", nil, false},
+		{"double at after a word", "x@@bob", nil, false},
+		{"at alone", "look @ this", nil, false},
+		{"here", "@here standup", []string{"here"}, true},
+		{"everyone", "@Everyone: lunch", []string{"everyone"}, true},
+		{"here inside a word", "where@here", nil, false},
+	}
+
+	for _, tt := range tests {
+		mentioned := parseMentions(tt.text, "-_.")
+		var got []string
+		for lower := range mentioned {
+			got = append(got, lower)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: parseMentions(%q) found %q; expected %q", tt.name, tt.text, got, tt.want)
+		}
+		if mentioned.everyone() != tt.wantEveryone {
+			t.Errorf("%s: everyone() of %q = %t; expected %t", tt.name, tt.text, mentioned.everyone(), tt.wantEveryone)
+		}
+	}
+
+	if !parseMentions("hi @BOB.", "-_.").includes("bob") || parseMentions("hi @bobby", "-_.").includes("bob") {
+		t.Errorf("includes does not match whole names ignoring case")
+	}
+}
+
+func TestOfflineMentions(t *testing.T) {
+	s := startTestServer(t, nil)
+	alice := loginJSON(t, s, "alice")
+
+	// carol registers and leaves; dave is a guest who leaves
+	for _, frame := range []Envelope{
+		{Type: FrameRegister, From: "carol", Password: "secretpass1"},
+		{Type: FrameHello, From: "dave"},
+	} {
+		c := dial(t, s)
+		c.sendFrame(frame)
+		c.waitFrame(func(env Envelope) bool { return env.Type == FrameRoom })
+		c.conn.Close()
+		alice.waitFor(frame.From + " has left the chat.")
+	}
+
+	alice.sendFrame(Envelope{Type: FrameMessage, Text: "@dave @Carol see the notes"})
+	alice.waitFor("carol is offline and will see your mention when they return.")
+
+	dave := dial(t, s)
+	dave.sendFrame(Envelope{Type: FrameHello, From: "dave"})
+	dave.waitFrame(func(env Envelope) bool { return env.Type == FrameRoom })
+	if unread := s.mentions.Unread("dave"); unread != 0 {
+		t.Errorf("guest dave has %d unread mentions; expected none", unread)
+	}
+
+	carol := dial(t, s)
+	carol.sendFrame(Envelope{Type: FrameHello, From: "carol", Password: "secretpass1"})
+	carol.waitFor("You were mentioned 1 time while you were away. Use /mentions to see them.")
+}
+
+func TestGuestMentionsNotKept(t *testing.T) {
+	s := startTestServer(t, func(cfg *Config) { cfg.CommandRate = 0 })
+	alice := loginJSON(t, s, "alice")
+	carol := dial(t, s)
+	carol.sendFrame(Envelope{Type: FrameRegister, From: "carol", Password: "secretpass1"})
+	carol.waitFrame(func(env Envelope) bool { return env.Type == FrameRoom })
+	dave := loginJSON(t, s, "dave")
+	erin := loginJSON(t, s, "erin")
+	erin.sendFrame(Envelope{Type: FrameCommand, Text: "/join dev"})
+	erin.waitFor("You are now the owner of room 'dev'.")
+	erin.sendFrame(Envelope{Type: FrameCommand, Text: "/leave general"})
+	erin.waitFor("left room 'general'")
+
+	alice.sendFrame(Envelope{Type: FrameMessage, Text: "@carol @dave @erin see the notes"})
+	erin.waitFrame(func(env Envelope) bool { return env.Type == FrameMention })
+	waitUntil(t, "carol's mention to be kept", func() bool { return len(s.mentions.Recent("carol", 10)) == 1 })
+
+	tests := []struct {
+		name string
+		want int
+	}{
+		{"carol", 1}, // Registered
+		{"dave", 0},  // Guest in the room
+		{"erin", 0},  // Guest notified from another room
+	}
+	for _, tt := range tests {
+		if got := len(s.mentions.Recent(tt.name, 10)); got != tt.want {
+			t.Errorf("%s has %d mentions; expected %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Whoever takes dave's name next finds none of their mentions
+	dave.conn.Close()
+	alice.waitFor("dave has left the chat.")
+	next := loginJSON(t, s, "dave")
+	next.sendFrame(Envelope{Type: FrameCommand, Text: "/mentions"})
+	next.waitFor("Mentions are only kept for users with an account")
+}
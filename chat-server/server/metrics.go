@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxRoomMetrics is how many rooms get their own chat_room_messages_total
+// series; messages to rooms beyond that, and to a room called "other", are
+// counted under room="other", so clients creating rooms cannot grow the
+// metrics without bound.
+const maxRoomMetrics = 100
+
+// broadcastBuckets are the upper bounds, in seconds, of the broadcast latency histogram
+var broadcastBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// histogram is a Prometheus-style histogram with fixed buckets
+type histogram struct {
+	bounds []float64
+	counts []uint64 // counts[i] observations <= bounds[i]; the last slot is +Inf
+	sum    float64
+	count  uint64
+	mutex  sync.Mutex
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// observe records one value
+func (h *histogram) observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// metrics holds the counters exported on /metrics
+type metrics struct {
+	whispers      atomic.Uint64
+	joins         atomic.Uint64
+	leaves        atomic.Uint64
+	connections   atomic.Uint64
+	droppedWrites atomic.Uint64
+	floodDropped  atomic.Uint64
+
+	roomMessages map[string]uint64 // At most maxRoomMetrics rooms, plus "other"
+	otherRooms   uint64            // Messages to rooms without their own series
+	mutex        sync.Mutex        // Guards roomMessages and otherRooms
+
+	broadcastLatency *histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		roomMessages:     make(map[string]uint64),
+		broadcastLatency: newHistogram(broadcastBuckets),
+	}
+}
+
+// roomMessage counts a chat message sent to a room
+func (m *metrics) roomMessage(roomName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.roomMessages[roomName]; roomName == "other" || (!ok && len(m.roomMessages) >= maxRoomMetrics) {
+		m.otherRooms++
+		return
+	}
+	m.roomMessages[roomName]++
+}
+
+// observeBroadcast records how long a broadcast took
+func (m *metrics) observeBroadcast(start time.Time) {
+	m.broadcastLatency.observe(time.Since(start).Seconds())
+}
+
+// handleMetrics serves GET /metrics in the Prometheus text exposition format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.writeMetrics(w)
+}
+
+// writeMetrics writes all metrics in the Prometheus text exposition format
+func (s *Server) writeMetrics(w io.Writer) {
+	s.mutex.Lock()
+	clients := len(s.clients)
+	rooms := len(s.rooms)
+	s.mutex.Unlock()
+	s.cluster.mutex.Lock()
+	peers := len(s.cluster.links)
+	s.cluster.mutex.Unlock()
+
+	m := s.metrics
+	writeMetric(w, "chat_connected_clients", "gauge", "Clients currently logged in.", float64(clients))
+	writeMetric(w, "chat_rooms", "gauge", "Rooms that currently have members.", float64(rooms))
+	writeMetric(w, "chat_cluster_peers", "gauge", "Cluster nodes this node is linked to.", float64(peers))
+	writeMetric(w, "chat_connections_total", "counter", "Clients that logged in since start.", float64(m.connections.Load()))
+	writeMetric(w, "chat_whispers_total", "counter", "Whispers delivered.", float64(m.whispers.Load()))
+	writeMetric(w, "chat_joins_total", "counter", "Times a client entered a room, including on connect.", float64(m.joins.Load()))
+	writeMetric(w, "chat_leaves_total", "counter", "Times a client left a room, including on disconnect.", float64(m.leaves.Load()))
+	writeMetric(w, "chat_dropped_writes_total", "counter", "Outbound lines dropped because a client's queue was full.", float64(m.droppedWrites.Load()))
+	writeMetric(w, "chat_flood_dropped_total", "counter", "Inbound lines dropped by rate limiting.", float64(m.floodDropped.Load()))
+
+	m.mutex.Lock()
+	roomNames := make([]string, 0, len(m.roomMessages))
+	for roomName := range m.roomMessages {
+		roomNames = append(roomNames, roomName)
+	}
+	sort.Strings(roomNames)
+	fmt.Fprintln(w, "# HELP chat_room_messages_total Chat messages sent per room.")
+	fmt.Fprintln(w, "# TYPE chat_room_messages_total counter")
+	for _, roomName := range roomNames {
+		fmt.Fprintf(w, "chat_room_messages_total{room=\"%s\"} %d\n", escapeLabel(roomName), m.roomMessages[roomName])
+	}
+	if m.otherRooms > 0 {
+		fmt.Fprintf(w, "chat_room_messages_total{room=\"other\"} %d\n", m.otherRooms)
+	}
+	m.mutex.Unlock()
+
+	h := m.broadcastLatency
+	h.mutex.Lock()
+	fmt.Fprintln(w, "# HELP chat_broadcast_duration_seconds Time taken to queue a frame for every member of a room.")
+	fmt.Fprintln(w, "# TYPE chat_broadcast_duration_seconds histogram")
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "chat_broadcast_duration_seconds_bucket{le=\"%s\"} %d\n", formatFloat(bound), cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)]
+	fmt.Fprintf(w, "chat_broadcast_duration_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(w, "chat_broadcast_duration_seconds_sum %s\n", formatFloat(h.sum))
+	fmt.Fprintf(w, "chat_broadcast_duration_seconds_count %d\n", h.count)
+	h.mutex.Unlock()
+}
+
+// writeMetric writes a single unlabeled metric with its HELP and TYPE lines
+func writeMetric(w io.Writer, name, metricType, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+// formatFloat formats a sample value the way Prometheus expects
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escapeLabel escapes a label value for the text exposition format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,500 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// addToRoom puts client in a room's member list, creating the room if needed.
+// The first member of a room without an owner, on any node, becomes its owner.
+// It returns true if the client became the owner. The caller must hold s.mutex.
+func (s *Server) addToRoom(client *Client, roomName string) bool {
+	if _, ok := s.rooms[roomName]; !ok {
+		s.rooms[roomName] = make(map[string]*Client)
+	}
+	s.rooms[roomName][client.name()] = client
+	client.rooms[roomName] = true
+
+	meta := s.roomState.get(roomName)
+	deleteName(meta.Invited, client.name()) // An invitation is used up by joining
+	if meta.Owner != "" || s.cluster.roomInUse(roomName) {
+		return false
+	}
+	meta.Owner = client.name()
+	s.roomChanged(meta)
+	return true
+}
+
+// roomChanged saves the state of a room after a change and sends it to the
+// other nodes. The caller must hold s.mutex.
+func (s *Server) roomChanged(meta *roomMeta) {
+	meta.Updated = time.Now()
+	s.roomState.save()
+	s.peerBroadcast(peerFrame{Type: peerRoomState, Meta: meta})
+}
+
+// removeFromRoom takes client out of a room's member list and deletes the list
+// once it is empty. The caller must hold s.mutex.
+func (s *Server) removeFromRoom(client *Client, roomName string) {
+	delete(client.rooms, roomName)
+	roomClients, ok := s.rooms[roomName]
+	if !ok {
+		return
+	}
+	delete(roomClients, client.name())
+	if len(roomClients) > 0 {
+		return
+	}
+	delete(s.rooms, roomName) // Delete room if empty
+
+	// Bans, mutes and the topic are kept. Guest names are not reserved, so
+	// guests lose their owner and moderator rights once the room is empty on
+	// every node, as well as when they disconnect (see dropGuestRoles).
+	meta, ok := s.roomState.rooms[roomName]
+	if !ok || s.cluster.roomInUse(roomName) {
+		return
+	}
+	changed := false
+	if meta.Owner != "" && !s.accounts.Exists(meta.Owner) {
+		meta.Owner = ""
+		changed = true
+	}
+	for name := range meta.Moderators {
+		if !s.accounts.Exists(name) {
+			delete(meta.Moderators, name)
+			changed = true
+		}
+	}
+	if meta.Owner == "" && len(meta.Moderators) == 0 && meta.InviteOnly {
+		meta.InviteOnly = false // Nobody would be left to invite anyone in
+		changed = true
+	}
+	if meta.isEmpty() {
+		delete(s.roomState.rooms, roomName)
+	}
+	if changed {
+		s.roomChanged(meta)
+	}
+}
+
+// joinDenied returns why name may not enter a room, or "" if it may.
+// The caller must hold s.mutex.
+func (s *Server) joinDenied(name, roomName string) string {
+	meta, ok := s.roomState.rooms[roomName]
+	if !ok {
+		return ""
+	}
+	if key, banned := nameKey(meta.Banned, name); banned {
+		if reason := meta.Banned[key]; reason != "" {
+			return fmt.Sprintf("You are banned from room '%s': %s", roomName, reason)
+		}
+		return fmt.Sprintf("You are banned from room '%s'.", roomName)
+	}
+	if _, invited := nameKey(meta.Invited, name); meta.InviteOnly && meta.role(name) == roleMember && !invited {
+		return fmt.Sprintf("Room '%s' is invite-only.", roomName)
+	}
+	return ""
+}
+
+// dropGuestRoles takes the owner and moderator rights and the invitations of a
+// guest who disconnected, since anyone may log in under the name next. Invite-only
+// rooms left without an owner or moderator are opened. The caller must hold s.mutex.
+func (s *Server) dropGuestRoles(name string) {
+	for roomName, meta := range s.roomState.rooms {
+		changed := deleteName(meta.Moderators, name)
+		changed = deleteName(meta.Invited, name) || changed
+		if meta.Owner != "" && strings.EqualFold(meta.Owner, name) {
+			meta.Owner = ""
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		if meta.Owner == "" && len(meta.Moderators) == 0 {
+			meta.InviteOnly = false
+		}
+		if meta.isEmpty() {
+			delete(s.roomState.rooms, roomName)
+		}
+		s.roomChanged(meta)
+	}
+}
+
+// canonicalName returns the name a user given in any case goes by: that of
+// the online user or account matching it ignoring case, or the name as given.
+// The caller must hold s.mutex.
+func (s *Server) canonicalName(name string) string {
+	if client, ok := lookupName(s.usernames, name); ok {
+		return client.name()
+	}
+	s.cluster.mutex.Lock()
+	key, remote := nameKey(s.cluster.users, name)
+	s.cluster.mutex.Unlock()
+	if remote {
+		return key
+	}
+	if names := s.accounts.Matching(name); len(names) > 0 {
+		return names[0]
+	}
+	return name
+}
+
+// mutedFor returns how much longer client is muted in a room, or 0
+func (s *Server) mutedFor(client *Client, roomName string) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	meta, ok := s.roomState.rooms[roomName]
+	if !ok {
+		return 0
+	}
+	return meta.mutedFor(client.name())
+}
+
+// moderatedRoom returns the state of the client's room if the client holds at
+// least the given role there, and tells the client otherwise. The caller must hold s.mutex.
+func (s *Server) moderatedRoom(client *Client, minRole int) *roomMeta {
+	meta := s.roomState.find(client.room)
+	if meta == nil || meta.role(client.name()) < minRole {
+		if minRole == roleOwner {
+			client.errorf("Only the owner of room '%s' can do that.", client.room)
+		} else {
+			client.errorf("Only moderators of room '%s' can do that.", client.room)
+		}
+		return nil
+	}
+	return meta
+}
+
+// announce sends a system notice to everyone in a room
+func (s *Server) announce(roomName, format string, args ...interface{}) {
+	env := newEnvelope(FrameSystem)
+	env.Room = roomName
+	env.Text = fmt.Sprintf(format, args...)
+	s.broadcastMessageToRoom(roomName, env)
+}
+
+// splitTarget splits "<user> [rest]" command arguments
+func splitTarget(args string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], strings.TrimSpace(parts[1])
+}
+
+// setModerator handles /op and /deop
+func (s *Server) setModerator(client *Client, args string, grant bool) {
+	target, _ := splitTarget(args)
+	if target == "" {
+		if grant {
+			client.errorf("Usage: /op <username>")
+		} else {
+			client.errorf("Usage: /deop <username>")
+		}
+		return
+	}
+
+	s.mutex.Lock()
+	meta := s.moderatedRoom(client, roleOwner)
+	if meta == nil {
+		s.mutex.Unlock()
+		return
+	}
+	target = s.canonicalName(target)
+	if meta.role(target) == roleOwner {
+		s.mutex.Unlock()
+		client.errorf("The owner already has every right in the room.")
+		return
+	}
+	deleteName(meta.Moderators, target)
+	if grant {
+		meta.Moderators[target] = true
+	}
+	s.roomChanged(meta)
+	roomName := client.room
+	s.mutex.Unlock()
+
+	if grant {
+		s.announce(roomName, "%s made %s a moderator of room '%s'.", client.name(), target, roomName)
+	} else {
+		s.announce(roomName, "%s removed %s as a moderator of room '%s'.", client.name(), target, roomName)
+	}
+}
+
+// checkTarget verifies that client outranks target in the room.
+// The caller must hold s.mutex.
+func checkTarget(client *Client, meta *roomMeta, target string) bool {
+	if strings.EqualFold(target, client.name()) {
+		client.errorf("You cannot do that to yourself.")
+		return false
+	}
+	if meta.role(target) >= meta.role(client.name()) {
+		client.errorf("You cannot do that to %s.", target)
+		return false
+	}
+	return true
+}
+
+// kickUser handles /kick
+func (s *Server) kickUser(client *Client, args string) {
+	target, reason := splitTarget(args)
+	if target == "" {
+		client.errorf("Usage: /kick <username> [reason]")
+		return
+	}
+
+	s.mutex.Lock()
+	meta := s.moderatedRoom(client, roleModerator)
+	if meta != nil {
+		target = s.canonicalName(target)
+	}
+	if meta == nil || !checkTarget(client, meta, target) {
+		s.mutex.Unlock()
+		return
+	}
+	roomName := client.room
+	targetClient, inRoom := s.rooms[roomName][target]
+	s.mutex.Unlock()
+	if !inRoom {
+		if !s.removeRemoteUser(target, roomName, "kicked", client.name(), reason) {
+			client.errorf("User '%s' is not in room '%s'.", target, roomName)
+		}
+		return
+	}
+
+	s.removeUser(targetClient, roomName, "kicked", client.name(), reason)
+}
+
+// removeUser takes a kicked or banned user out of a room. Users who have no
+// other room to go to are disconnected.
+func (s *Server) removeUser(target *Client, roomName, action, by, reason string) {
+	suffix := "."
+	if reason != "" {
+		suffix = ": " + reason
+	}
+	s.announce(roomName, "%s was %s by %s%s", target.name(), action, by, suffix)
+	logInfof("Client %s was %s from room %s by %s.", target.name(), action, roomName, by)
+
+	target.errorf("You were %s from room '%s' by %s%s", action, roomName, by, suffix)
+	if !s.partRoom(target, roomName) {
+		target.errorf("You have no other room to go to. Disconnecting.")
+		go target.close() // Flush the notice; the reader then unregisters the client
+	}
+}
+
+// banUser handles /ban
+func (s *Server) banUser(client *Client, args string) {
+	target, reason := splitTarget(args)
+	if target == "" {
+		client.errorf("Usage: /ban <username> [reason]")
+		return
+	}
+
+	s.mutex.Lock()
+	meta := s.moderatedRoom(client, roleModerator)
+	if meta != nil {
+		target = s.canonicalName(target)
+	}
+	if meta == nil || !checkTarget(client, meta, target) {
+		s.mutex.Unlock()
+		return
+	}
+	deleteName(meta.Banned, target)
+	meta.Banned[target] = reason
+	deleteName(meta.Moderators, target)
+	deleteName(meta.Invited, target)
+	s.roomChanged(meta)
+	roomName := client.room
+	targetClient, inRoom := s.rooms[roomName][target]
+	s.mutex.Unlock()
+
+	if inRoom {
+		s.removeUser(targetClient, roomName, "banned", client.name(), reason)
+		return
+	}
+	if s.removeRemoteUser(target, roomName, "banned", client.name(), reason) {
+		return // The user's node announces it
+	}
+	s.announce(roomName, "%s was banned by %s.", target, client.name())
+}
+
+// unbanUser handles /unban
+func (s *Server) unbanUser(client *Client, args string) {
+	target, _ := splitTarget(args)
+	if target == "" {
+		client.errorf("Usage: /unban <username>")
+		return
+	}
+
+	s.mutex.Lock()
+	meta := s.moderatedRoom(client, roleModerator)
+	if meta == nil {
+		s.mutex.Unlock()
+		return
+	}
+	key, banned := nameKey(meta.Banned, target)
+	if !banned {
+		s.mutex.Unlock()
+		client.errorf("User '%s' is not banned from room '%s'.", target, client.room)
+		return
+	}
+	target = key
+	deleteName(meta.Banned, target)
+	s.roomChanged(meta)
+	roomName := client.room
+	s.mutex.Unlock()
+
+	s.announce(roomName, "%s was unbanned by %s.", target, client.name())
+}
+
+// muteUser handles /mute and /unmute; a zero duration unmutes
+func (s *Server) muteUser(client *Client, args string, unmute bool) {
+	target, rest := splitTarget(args)
+	var duration time.Duration
+	if !unmute {
+		var err error
+		duration, err = time.ParseDuration(rest)
+		if target == "" || err != nil || duration <= 0 {
+			client.errorf("Usage: /mute <username> <duration>, e.g. /mute bob 10m")
+			return
+		}
+	} else if target == "" {
+		client.errorf("Usage: /unmute <username>")
+		return
+	}
+
+	s.mutex.Lock()
+	meta := s.moderatedRoom(client, roleModerator)
+	if meta != nil {
+		target = s.canonicalName(target)
+	}
+	if meta == nil || !checkTarget(client, meta, target) {
+		s.mutex.Unlock()
+		return
+	}
+	deleteName(meta.Muted, target)
+	if !unmute {
+		meta.Muted[target] = time.Now().Add(duration)
+	}
+	s.roomChanged(meta)
+	roomName := client.room
+	s.mutex.Unlock()
+
+	if unmute {
+		s.announce(roomName, "%s was unmuted by %s.", target, client.name())
+	} else {
+		s.announce(roomName, "%s was muted for %s by %s.", target, duration, client.name())
+	}
+}
+
+// setTopic handles /topic; without arguments it shows the topic, "-" clears it
+func (s *Server) setTopic(client *Client, args string) {
+	topic := strings.TrimSpace(args)
+
+	s.mutex.Lock()
+	if topic == "" {
+		current := ""
+		if meta, ok := s.roomState.rooms[client.room]; ok {
+			current = meta.Topic
+		}
+		s.mutex.Unlock()
+		if current == "" {
+			client.systemf("Room '%s' has no topic.", client.room)
+		} else {
+			client.systemf("Topic of room '%s': %s", client.room, current)
+		}
+		return
+	}
+
+	meta := s.moderatedRoom(client, roleModerator)
+	if meta == nil {
+		s.mutex.Unlock()
+		return
+	}
+	if topic == "-" {
+		topic = ""
+	}
+	meta.Topic = topic
+	s.roomChanged(meta)
+	roomName := client.room
+	s.mutex.Unlock()
+
+	if topic == "" {
+		s.announce(roomName, "%s cleared the topic.", client.name())
+	} else {
+		s.announce(roomName, "%s set the topic: %s", client.name(), topic)
+	}
+}
+
+// setInviteOnly handles /invite-only [on|off]; without an argument it toggles
+func (s *Server) setInviteOnly(client *Client, args string) {
+	if client.room == s.config().DefaultRoom {
+		client.errorf("The default room cannot be made invite-only.")
+		return
+	}
+
+	s.mutex.Lock()
+	meta := s.moderatedRoom(client, roleModerator)
+	if meta == nil {
+		s.mutex.Unlock()
+		return
+	}
+	switch strings.TrimSpace(args) {
+	case "":
+		meta.InviteOnly = !meta.InviteOnly
+	case "on":
+		meta.InviteOnly = true
+	case "off":
+		meta.InviteOnly = false
+	default:
+		s.mutex.Unlock()
+		client.errorf("Usage: /invite-only [on|off]")
+		return
+	}
+	inviteOnly := meta.InviteOnly
+	s.roomChanged(meta)
+	roomName := client.room
+	s.mutex.Unlock()
+
+	if inviteOnly {
+		s.announce(roomName, "%s made room '%s' invite-only.", client.name(), roomName)
+	} else {
+		s.announce(roomName, "%s opened room '%s' to everyone.", client.name(), roomName)
+	}
+}
+
+// inviteUser handles /invite
+func (s *Server) inviteUser(client *Client, args string) {
+	target, _ := splitTarget(args)
+	if target == "" {
+		client.errorf("Usage: /invite <username>")
+		return
+	}
+
+	s.mutex.Lock()
+	meta := s.moderatedRoom(client, roleModerator)
+	if meta == nil {
+		s.mutex.Unlock()
+		return
+	}
+	target = s.canonicalName(target)
+	deleteName(meta.Invited, target)
+	meta.Invited[target] = true
+	s.roomChanged(meta)
+	roomName := client.room
+	targetClient, online := s.usernames[target]
+	s.mutex.Unlock()
+
+	client.systemf("Invited %s to room '%s'.", target, roomName)
+	notice := newEnvelope(FrameSystem)
+	notice.Text = fmt.Sprintf("%s invited you to room '%s'. Use /join %s to enter.", client.name(), roomName, roomName)
+	if online {
+		if err := targetClient.send(notice); err != nil {
+			logErrorf("Error sending invitation to %s: %v", target, err)
+		}
+	} else if link, remote := s.remoteRoute(target); remote {
+		link.send(peerFrame{Type: peerDeliver, User: target, Frame: &notice})
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestModeration(t *testing.T) {
+	s := startTestServer(t, func(cfg *Config) { cfg.CommandRate = 0 }) // alice sends more commands than the burst allows
+	alice := loginJSON(t, s, "alice")
+	bob := loginJSON(t, s, "bob")
+
+	alice.sendFrame(Envelope{Type: FrameCommand, Text: "/join lobby"})
+	alice.waitFor("You are now the owner of room 'lobby'.")
+	bob.sendFrame(Envelope{Type: FrameCommand, Text: "/join lobby"})
+	bob.waitFor("You have joined room 'lobby'.")
+
+	tests := []struct {
+		name string
+		from *testConn
+		line string
+		to   *testConn
+		want string
+	}{
+		{"member kicks", bob, "/kick alice", bob, "Only moderators of room 'lobby' can do that."},
+		{"member sets the topic", bob, "/topic mine", bob, "Only moderators of room 'lobby' can do that."},
+		{"owner sets the topic", alice, "/topic plans", bob, "alice set the topic: plans"},
+		{"owner mutes in another case", alice, "/mute BOB 1h", bob, "bob was muted for 1h0m0s by alice."},
+		{"muted member talks", bob, "hello", bob, "You are muted in room 'lobby'"},
+		{"owner bans", alice, "/ban bob spam", bob, "You were banned from room 'lobby' by alice: spam"},
+		{"banned member joins", bob, "/join lobby", bob, "You are banned from room 'lobby': spam"},
+		{"owner unbans in another case", alice, "/unban BOB", alice, "bob was unbanned by alice."},
+		{"unbanned member joins", bob, "/join lobby", bob, "You have joined room 'lobby'."},
+		{"owner bans in another case", alice, "/ban Bob spam", bob, "You were banned from room 'lobby' by alice: spam"},
+		{"member banned in another case joins", bob, "/join lobby", bob, "You are banned from room 'lobby': spam"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frameType := FrameCommand
+			if !strings.HasPrefix(tt.line, "/") {
+				frameType = FrameMessage
+			}
+			tt.from.sendFrame(Envelope{Type: frameType, Text: tt.line})
+			tt.to.waitFor(tt.want)
+		})
+	}
+
+	// Bans and the topic outlive the server; guests lose ownership once the room empties
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	meta := newRoomStore(s.config().RoomsFile).find("lobby")
+	if meta == nil || meta.Owner != "" || meta.Topic != "plans" || meta.Banned["bob"] != "spam" {
+		t.Errorf("rooms file holds %+v for room 'lobby'; expected no owner, topic plans and bob banned", meta)
+	}
+}
+
+func TestGuestRolesDropped(t *testing.T) {
+	s := startTestServer(t, nil)
+	alice := loginJSON(t, s, "alice")
+	bob := loginJSON(t, s, "bob")
+	carol := loginJSON(t, s, "carol")
+
+	alice.sendFrame(Envelope{Type: FrameCommand, Text: "/join lobby"})
+	alice.waitFor("You are now the owner of room 'lobby'.")
+	for _, c := range []*testConn{bob, carol} {
+		c.sendFrame(Envelope{Type: FrameCommand, Text: "/join lobby"})
+		c.waitFor("You have joined room 'lobby'.")
+	}
+	alice.sendFrame(Envelope{Type: FrameCommand, Text: "/op bob"})
+	carol.waitFor("alice made bob a moderator of room 'lobby'.")
+
+	// Guests who leave while others keep the room open lose their rights, so
+	// whoever takes their name next does not get them
+	tests := []struct {
+		leaving   *testConn
+		name      string
+		wantOwner string
+		wantMods  int
+	}{
+		{bob, "bob", "alice", 0},
+		{alice, "alice", "", 0},
+	}
+	for _, tt := range tests {
+		tt.leaving.conn.Close()
+		carol.waitFor(tt.name + " has left the chat.")
+		s.mutex.Lock()
+		meta := s.roomState.find("lobby")
+		if meta == nil {
+			meta = &roomMeta{} // Nothing left to keep
+		}
+		if meta.Owner != tt.wantOwner || len(meta.Moderators) != tt.wantMods {
+			t.Errorf("after %s left, room 'lobby' has owner %q and moderators %v; expected owner %q and %d moderators", tt.name, meta.Owner, meta.Moderators, tt.wantOwner, tt.wantMods)
+		}
+		s.mutex.Unlock()
+	}
+}
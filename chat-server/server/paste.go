@@ -0,0 +1,84 @@
+package server
+
+import (
+	"strings"
+)
+
+// pasteBuffer collects the lines of a /paste block typed by a text client
+type pasteBuffer struct {
+	lines    []string
+	size     int
+	overflow bool // The block grew past the limits and will be dropped
+}
+
+// collectPaste handles a line from a text client in paste mode, which a line
+// with just "/paste" starts and a line with just "." ends. Lines keep their
+// indentation. Once the block is complete it is returned as a message.
+func (s *Server) collectPaste(client *Client, line string) (ClientMessage, bool) {
+	cfg := s.config()
+	line = strings.TrimRight(line, "\r\n")
+	if client.paste == nil {
+		client.paste = &pasteBuffer{}
+		client.systemf("Paste mode: send your lines, then a line with just '.' to post them as one message.")
+		return ClientMessage{}, false
+	}
+
+	paste := client.paste
+	if strings.TrimSpace(line) != "." {
+		paste.size += len(line) + 1
+		if len(paste.lines) >= cfg.MaxPasteLines || paste.size > cfg.MaxPasteSize {
+			paste.overflow, paste.lines = true, nil
+		}
+		if !paste.overflow {
+			paste.lines = append(paste.lines, line)
+		}
+		return ClientMessage{}, false
+	}
+
+	client.paste = nil
+	if paste.overflow {
+		client.errorf("Your paste was longer than %s or %d bytes and was dropped.", pluralize(cfg.MaxPasteLines, "line"), cfg.MaxPasteSize)
+		return ClientMessage{}, false
+	}
+	env := Envelope{Type: FrameMessage, Paste: true, Text: cleanBlock(strings.Join(paste.lines, "\n"))}
+	return ClientMessage{Client: client, Frame: &env}, true
+}
+
+// sendPaste posts a multi-line block as a single message to one of the
+// client's rooms, by default its active room.
+func (s *Server) sendPaste(client *Client, roomName, text string) {
+	cfg := s.config()
+	roomName = strings.TrimPrefix(roomName, "#")
+	if roomName == "" {
+		roomName = client.room
+	}
+	s.mutex.Lock()
+	member := client.rooms[roomName]
+	s.mutex.Unlock()
+
+	switch {
+	case !member:
+		client.errorf("You are not in room '%s'.", roomName)
+	case text == "":
+		client.errorf("Your paste is empty; nothing was sent.")
+	case len(text) > cfg.MaxPasteSize || strings.Count(text, "\n") >= cfg.MaxPasteLines:
+		client.errorf("Your paste is too long; the limit is %s or %d bytes.", pluralize(cfg.MaxPasteLines, "line"), cfg.MaxPasteSize)
+	default:
+		env := newEnvelope(FrameMessage)
+		env.Room = roomName
+		env.Text = text
+		env.Paste = true
+		s.postMessage(client, env)
+	}
+}
+
+// lineLimit is the longest line read from client. JSON clients may send longer
+// frames for pastes and file chunks; other frames are held to MaxLineLength
+// once decoded.
+func (s *Server) lineLimit(client *Client) int {
+	cfg := s.config()
+	if client.protocol == ProtocolText || cfg.MaxLineLength <= 0 {
+		return cfg.MaxLineLength
+	}
+	return max(cfg.MaxLineLength, 2*cfg.MaxPasteSize+1024, 2*FileChunkSize)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// peerNonceSize is the length of the random nonce each node sends in the
+// clear hello of a link
+const peerNonceSize = 32
+
+// linkCipher seals the frames of a peer link in one direction with AES-GCM.
+// Each frame uses the next nonce in sequence, so frames that are replayed,
+// dropped or reordered on the way fail to open.
+type linkCipher struct {
+	aead cipher.AEAD
+	seq  uint64
+}
+
+func newLinkCipher(key []byte) (*linkCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &linkCipher{aead: aead}, nil
+}
+
+// nextNonce returns the nonce for the next frame
+func (lc *linkCipher) nextNonce() []byte {
+	nonce := make([]byte, lc.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], lc.seq)
+	lc.seq++
+	return nonce
+}
+
+// seal encrypts a frame into a base64 line
+func (lc *linkCipher) seal(data []byte) []byte {
+	sealed := lc.aead.Seal(nil, lc.nextNonce(), data, nil)
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(sealed))+1)
+	base64.StdEncoding.Encode(line, sealed)
+	line[len(line)-1] = '\n'
+	return line
+}
+
+// open decrypts a line sealed by the other end
+func (lc *linkCipher) open(line []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(line)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid sealed peer frame: %v", err)
+	}
+	data, err := lc.aead.Open(nil, lc.nextNonce(), sealed, nil)
+	if err != nil {
+		return nil, errors.New("peer frame does not open with the cluster secret")
+	}
+	return data, nil
+}
+
+// linkKeys derives the keys for the frames sent by the dialer and by the
+// acceptor of a link from the cluster secret and the nonces both ends sent.
+// The nonces are fresh for every link, so frames from one link are useless on
+// any other.
+func linkKeys(secret string, dialerNonce, acceptorNonce []byte) (dialerKey, acceptorKey []byte) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("chat-server peer link"))
+	mac.Write(dialerNonce)
+	mac.Write(acceptorNonce)
+	linkKey := mac.Sum(nil)
+
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, linkKey)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	return derive("dialer"), derive("acceptor")
+}
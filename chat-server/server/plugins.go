@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Plugin is a set of hooks that automate the server. Every hook is optional.
+// Hooks run on the server's message loop, one at a time, and are abandoned if
+// they take longer than Config.PluginTimeout; they should return when ctx is done.
+type Plugin struct {
+	Name string // Sender of the plugin's messages and whispers
+
+	OnMessage       func(ctx context.Context, ev *Event) // A chat message is about to be posted; may rewrite or block it
+	OnJoin          func(ctx context.Context, ev *Event) // A user entered a room, including on connect
+	OnLeave         func(ctx context.Context, ev *Event) // A user left a room, including on disconnect
+	OnRoomCreated   func(ctx context.Context, ev *Event) // The first user on this node entered a room
+	OnRoomDestroyed func(ctx context.Context, ev *Event) // The last user on this node left a room
+
+	Commands []Command // Slash commands added along with the plugin
+}
+
+// Event is what a hook is called with. Hooks respond through its methods;
+// the responses are carried out once the hook has returned in time.
+type Event struct {
+	User string // Who sent the message, joined or left; empty for room events
+	Room string
+	Text string // The chat message; OnMessage hooks may change it
+
+	blocked bool
+	reason  string
+	actions []hookAction
+}
+
+// hookAction is a message a hook wants sent
+type hookAction struct {
+	from    string
+	to      string // Whisper recipient, or "" to post to the room
+	text    string
+	private bool
+}
+
+// Block stops the message from being posted. A non-empty reason is shown to the sender.
+func (ev *Event) Block(reason string) {
+	ev.blocked = true
+	ev.reason = reason
+}
+
+// Say posts a message to the event's room. Messages from plugins do not trigger hooks.
+func (ev *Event) Say(format string, args ...interface{}) {
+	ev.actions = append(ev.actions, hookAction{text: fmt.Sprintf(format, args...)})
+}
+
+// Whisper sends a private message to a user
+func (ev *Event) Whisper(user, format string, args ...interface{}) {
+	ev.actions = append(ev.actions, hookAction{to: user, text: fmt.Sprintf(format, args...), private: true})
+}
+
+// pluginSet holds the registered plugins
+type pluginSet struct {
+	list  []*Plugin
+	mutex sync.RWMutex
+}
+
+// RegisterPlugin adds a plugin and its commands. Register plugins before Listen.
+func (s *Server) RegisterPlugin(p Plugin) error {
+	if p.Name == "" {
+		return errors.New("plugin needs a name")
+	}
+	for _, cmd := range p.Commands {
+		if err := s.commands.add(pluginCommand{Command: cmd, plugin: &p, server: s}); err != nil {
+			return fmt.Errorf("plugin %s: %v", p.Name, err)
+		}
+	}
+
+	s.plugins.mutex.Lock()
+	s.plugins.list = append(s.plugins.list, &p)
+	s.plugins.mutex.Unlock()
+	logInfof("Registered plugin %s", p.Name)
+	return nil
+}
+
+// pluginCommand runs a plugin's command with the plugin timeout
+type pluginCommand struct {
+	Command
+	plugin *Plugin
+	server *Server
+}
+
+// Run runs the command with the plugin timeout. Unlike a hook, a command acts
+// on the server directly, so once it times out it is told to stop through
+// ctx.Done and given as long again to return. If it still has not, it is
+// abandoned and cannot act on the server any more.
+func (c pluginCommand) Run(ctx *CommandContext) {
+	ctx.plugin = &pluginRun{}
+	c.server.callPlugin(c.plugin.Name, "/"+c.Spec().Name, ctx.plugin, func(hookCtx context.Context) {
+		ctx.done = hookCtx.Done()
+		c.Command.Run(ctx)
+	})
+}
+
+// pluginRun is a plugin command running in its own goroutine while the message
+// loop waits for it. Its actions stand in for the loop until it is abandoned.
+type pluginRun struct {
+	mutex     sync.Mutex
+	abandoned bool
+}
+
+// act runs fn unless the command has been abandoned. A nil run is a built-in
+// command, which runs on the message loop itself.
+func (r *pluginRun) act(fn func()) {
+	if r == nil {
+		fn()
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.abandoned {
+		fn()
+	}
+}
+
+// abandon stops the command from acting, once any action in progress is done
+func (r *pluginRun) abandon() {
+	r.mutex.Lock()
+	r.abandoned = true
+	r.mutex.Unlock()
+}
+
+// callHook runs fn with the plugin timeout and recovers from panics.
+// It returns false if fn panicked or did not return in time.
+func (s *Server) callHook(plugin, hook string, fn func(ctx context.Context)) bool {
+	return s.callPlugin(plugin, hook, nil, fn)
+}
+
+// callPlugin runs fn like callHook. With a run, a call that times out is
+// cancelled and waited for up to the timeout again before it is abandoned.
+func (s *Server) callPlugin(plugin, hook string, run *pluginRun, fn func(ctx context.Context)) bool {
+	cfg := s.config()
+	ctx, cancel := context.WithCancel(context.Background())
+	if cfg.PluginTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.PluginTimeout)
+	}
+	defer cancel()
+
+	done := make(chan bool, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logWarnf("Plugin %s panicked in %s: %v", plugin, hook, r)
+				done <- false
+			}
+		}()
+		fn(ctx)
+		done <- true
+	}()
+
+	select {
+	case ok := <-done:
+		return ok
+	case <-ctx.Done():
+		logWarnf("Plugin %s timed out in %s after %s", plugin, hook, cfg.PluginTimeout)
+		if run == nil {
+			return false
+		}
+		grace := time.NewTimer(cfg.PluginTimeout)
+		defer grace.Stop()
+		select {
+		case <-done:
+		case <-grace.C:
+			logWarnf("Plugin %s did not stop in %s; abandoning it", plugin, hook)
+			run.abandon()
+		}
+		return false
+	}
+}
+
+// Selectors for runHooks
+var (
+	onMessage       = func(p *Plugin) func(context.Context, *Event) { return p.OnMessage }
+	onJoin          = func(p *Plugin) func(context.Context, *Event) { return p.OnJoin }
+	onLeave         = func(p *Plugin) func(context.Context, *Event) { return p.OnLeave }
+	onRoomCreated   = func(p *Plugin) func(context.Context, *Event) { return p.OnRoomCreated }
+	onRoomDestroyed = func(p *Plugin) func(context.Context, *Event) { return p.OnRoomDestroyed }
+)
+
+// runHooks calls one hook of every plugin in registration order and collects
+// what they asked for. Message hooks stop at the first one that blocks.
+// It returns the event as changed by the hooks.
+func (s *Server) runHooks(hook string, pick func(p *Plugin) func(context.Context, *Event), ev Event) Event {
+	s.plugins.mutex.RLock()
+	plugins := append([]*Plugin(nil), s.plugins.list...)
+	s.plugins.mutex.RUnlock()
+
+	for _, p := range plugins {
+		fn := pick(p)
+		if fn == nil {
+			continue
+		}
+
+		// The hook gets its own copy, so a hook that times out changes nothing
+		attempt := ev
+		attempt.actions = nil
+		if !s.callHook(p.Name, hook, func(ctx context.Context) { fn(ctx, &attempt) }) {
+			continue
+		}
+		for i := range attempt.actions {
+			attempt.actions[i].from = p.Name
+		}
+		ev.Text = attempt.Text
+		ev.blocked, ev.reason = attempt.blocked, attempt.reason
+		ev.actions = append(ev.actions, attempt.actions...)
+		if ev.blocked {
+			break
+		}
+	}
+	return ev
+}
+
+// hookActions sends the messages hooks asked for, after the event itself
+func (s *Server) hookActions(ev Event) {
+	for _, action := range ev.actions {
+		env := newEnvelope(FrameMessage)
+		env.From = action.from
+		env.Text = action.text
+		env.Bot = true
+		if action.private {
+			env.Type = FrameWhisper
+			env.To = action.to
+			s.deliverWhisper(env)
+			continue
+		}
+		if ev.Room == "" {
+			continue
+		}
+		env.Room = ev.Room
+		s.history.Append(historyEntry(env))
+		s.broadcastMessageToRoom(env.Room, env)
+	}
+}
+
+// deliverWhisper sends a whisper that has no sending client to its target,
+// on this node or another one
+func (s *Server) deliverWhisper(env Envelope) {
+	s.mutex.Lock()
+	target, ok := s.usernames[env.To]
+	s.mutex.Unlock()
+	if ok {
+		if err := target.send(env); err != nil {
+			logErrorf("Error sending whisper from %s to %s: %v", env.From, env.To, err)
+		}
+		return
+	}
+	if link, remote := s.remoteRoute(env.To); remote {
+		link.send(peerFrame{Type: peerDeliver, User: env.To, Frame: &env})
+	}
+}
+
+// joinEvents runs the hooks for a user entering a room on this node
+func (s *Server) joinEvents(user, roomName string, created bool) {
+	if created {
+		s.hookActions(s.runHooks("OnRoomCreated", onRoomCreated, Event{Room: roomName}))
+	}
+	s.hookActions(s.runHooks("OnJoin", onJoin, Event{User: user, Room: roomName}))
+}
+
+// leaveEvents runs the hooks for a user leaving a room on this node
+func (s *Server) leaveEvents(user, roomName string, destroyed bool) {
+	s.hookActions(s.runHooks("OnLeave", onLeave, Event{User: user, Room: roomName}))
+	if destroyed {
+		s.hookActions(s.runHooks("OnRoomDestroyed", onRoomDestroyed, Event{Room: roomName}))
+	}
+}
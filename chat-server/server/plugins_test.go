@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPluginTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+
+	s := startTestServer(t, func(cfg *Config) { cfg.PluginTimeout = 50 * time.Millisecond })
+	err := s.RegisterPlugin(Plugin{
+		Name: "slowbot",
+		OnMessage: func(ctx context.Context, ev *Event) {
+			if strings.Contains(ev.Text, "slow") {
+				<-release // Ignores ctx
+			}
+			ev.Text = strings.ToUpper(ev.Text)
+		},
+		Commands: []Command{
+			NewCommand(CommandSpec{Name: "polite", Help: "Stops when told"}, func(ctx *CommandContext) {
+				<-ctx.Done()
+				ctx.Reply("Stopped.")
+			}),
+			NewCommand(CommandSpec{Name: "stuck", Help: "Never stops in time"}, func(ctx *CommandContext) {
+				<-release
+				ctx.Say("too late")
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatalf("RegisterPlugin returned error: %v", err)
+	}
+	alice := loginJSON(t, s, "alice")
+
+	tests := []struct {
+		name string
+		env  Envelope
+		want string // The next message alice gets
+	}{
+		{"hook in time", Envelope{Type: FrameMessage, Text: "hello"}, "HELLO"},
+		{"hook abandoned", Envelope{Type: FrameMessage, Text: "slow one"}, "slow one"},
+		{"command that stops", Envelope{Type: FrameCommand, Text: "/polite"}, "Stopped."},
+		{"command abandoned", Envelope{Type: FrameCommand, Text: "/stuck"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice.sendFrame(tt.env)
+			if tt.want != "" {
+				alice.waitFor(tt.want)
+			}
+		})
+	}
+
+	// The message loop carries on
+	alice.sendFrame(Envelope{Type: FrameMessage, Text: "still here"})
+	alice.waitFor("STILL HERE")
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultAwayMessage is used by /away without a message
+const defaultAwayMessage = "Away"
+
+// member is a user in a room as listed by /who
+type member struct {
+	name string
+	away string
+	idle time.Duration // Zero for users of other nodes, whose activity is not shared
+}
+
+// touch records that the client just sent something
+func (c *Client) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// lastActiveAt returns when the client last sent something
+func (c *Client) lastActiveAt() time.Time {
+	return time.Unix(0, c.lastActive.Load())
+}
+
+// idleFor returns how long the client has been idle, or 0 if it is not idle yet
+func (s *Server) idleFor(client *Client, now time.Time) time.Duration {
+	idle := now.Sub(client.lastActiveAt())
+	if s.config().IdleAfter <= 0 || idle < s.config().IdleAfter {
+		return 0
+	}
+	return idle
+}
+
+// status describes whether a member is away or idle, or returns ""
+func (m member) status() string {
+	switch {
+	case m.away != "":
+		return fmt.Sprintf("away: %s", m.away)
+	case m.idle > 0:
+		return fmt.Sprintf("idle %s", formatIdle(m.idle))
+	default:
+		return ""
+	}
+}
+
+// formatIdle rounds an idle time for display, e.g. "7m" or "2h15m"
+func formatIdle(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d < time.Hour {
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// roomMembers lists the users in a room on this node and on linked nodes
+func (s *Server) roomMembers(roomName string) []member {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cluster.mutex.Lock()
+	defer s.cluster.mutex.Unlock()
+
+	now := time.Now()
+	var members []member
+	for name, client := range s.rooms[roomName] {
+		members = append(members, member{name: name, away: client.away, idle: s.idleFor(client, now)})
+	}
+	for name, user := range s.cluster.users {
+		if user.inRoom(roomName) {
+			members = append(members, member{name: name, away: user.away})
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].name < members[j].name })
+	return members
+}
+
+// roomSizes counts the users in every room on this node and on linked nodes
+func (s *Server) roomSizes() map[string]int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cluster.mutex.Lock()
+	defer s.cluster.mutex.Unlock()
+
+	sizes := make(map[string]int)
+	for roomName, roomClients := range s.rooms {
+		sizes[roomName] += len(roomClients)
+	}
+	for _, user := range s.cluster.users {
+		for _, roomName := range user.rooms {
+			sizes[roomName]++
+		}
+	}
+	return sizes
+}
+
+// showWho handles /who [room]
+func (s *Server) showWho(ctx *CommandContext) {
+	roomName := ctx.Room()
+	if len(ctx.Args) == 1 {
+		roomName = strings.TrimPrefix(ctx.Args[0], "#")
+	}
+	members := s.roomMembers(roomName)
+	if len(members) == 0 {
+		ctx.Reply("Nobody is in room '%s'.", roomName)
+		return
+	}
+
+	names := make([]string, len(members))
+	for i, m := range members {
+		names[i] = m.name
+		if status := m.status(); status != "" {
+			names[i] += " (" + status + ")"
+		}
+	}
+	ctx.Reply("%s in room '%s': %s", pluralize(len(members), "user"), roomName, strings.Join(names, ", "))
+}
+
+// showRooms handles /rooms
+func (s *Server) showRooms(ctx *CommandContext) {
+	sizes := s.roomSizes()
+	roomNames := make([]string, 0, len(sizes))
+	for roomName := range sizes {
+		roomNames = append(roomNames, roomName)
+	}
+	sort.Strings(roomNames)
+
+	topics := make(map[string]string, len(roomNames))
+	s.mutex.Lock()
+	for _, roomName := range roomNames {
+		if meta, ok := s.roomState.rooms[roomName]; ok {
+			topics[roomName] = meta.Topic
+		}
+	}
+	s.mutex.Unlock()
+
+	ctx.Reply("--- %s ---", pluralize(len(roomNames), "room"))
+	for _, roomName := range roomNames {
+		if topic := topics[roomName]; topic != "" {
+			ctx.Reply("%s (%s): %s", roomName, pluralize(sizes[roomName], "user"), topic)
+		} else {
+			ctx.Reply("%s (%s)", roomName, pluralize(sizes[roomName], "user"))
+		}
+	}
+}
+
+// showWhois handles /whois <user>
+func (s *Server) showWhois(ctx *CommandContext) {
+	now := time.Now()
+
+	s.mutex.Lock()
+	name := s.canonicalName(ctx.Args[0])
+	client, local := s.usernames[name]
+	var lines []string
+	if local {
+		kind := "guest"
+		if client.registered {
+			kind = "registered user"
+		}
+		lines = append(lines,
+			fmt.Sprintf("%s is a %s, talking in room '%s'", name, kind, client.room),
+			fmt.Sprintf("Rooms: %s", strings.Join(client.roomNames(), ", ")),
+			fmt.Sprintf("Connected since %s (%s)", client.connectedAt.Format("2006-01-02 15:04"), now.Sub(client.connectedAt).Round(time.Second)),
+			fmt.Sprintf("Last active %s ago", now.Sub(client.lastActiveAt()).Round(time.Second)))
+		if client.away != "" {
+			lines = append(lines, fmt.Sprintf("Away: %s", client.away))
+		}
+	}
+	s.mutex.Unlock()
+
+	if !local {
+		s.cluster.mutex.Lock()
+		user, remote := lookupName(s.cluster.users, name)
+		s.cluster.mutex.Unlock()
+		if !remote || user.room == "" {
+			ctx.Error("User '%s' not found.", name)
+			return
+		}
+		lines = append(lines,
+			fmt.Sprintf("%s is talking in room '%s' on node %s", name, user.room, user.node),
+			fmt.Sprintf("Rooms: %s", strings.Join(user.rooms, ", ")))
+		if user.away != "" {
+			lines = append(lines, fmt.Sprintf("Away: %s", user.away))
+		}
+	}
+	for _, line := range lines {
+		ctx.Reply("%s", line)
+	}
+}
+
+// setAway handles /away [message]. Without a message it marks the user back
+// if they were away, and away with a default message otherwise.
+func (s *Server) setAway(ctx *CommandContext) {
+	client := ctx.Client
+	s.mutex.Lock()
+	away := defaultAwayMessage
+	if len(ctx.Args) == 1 {
+		away = ctx.Args[0]
+	} else if client.away != "" {
+		away = ""
+	}
+	client.away = away
+	s.mutex.Unlock()
+	s.peerBroadcast(peerFrame{Type: peerUserAway, User: client.name(), Away: away})
+
+	if away == "" {
+		ctx.Reply("You are no longer away.")
+		return
+	}
+	ctx.Reply("You are now away: %s", away)
+}
+
+// awayReply answers a whisper to a user who is away with their away message
+func (s *Server) awayReply(senderClient *Client, target, away string) {
+	if away == "" {
+		return
+	}
+	env := newEnvelope(FrameWhisper)
+	env.From = target
+	env.To = senderClient.name()
+	env.Text = fmt.Sprintf("[auto-reply] I am away: %s", away)
+	if err := senderClient.send(env); err != nil {
+		logErrorf("Error sending away reply to %s: %v", senderClient.name(), err)
+	}
+}
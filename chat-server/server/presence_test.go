@@ -0,0 +1,32 @@
+package server
+
+import "testing"
+
+func TestWhoAndWhois(t *testing.T) {
+	s := startTestServer(t, func(cfg *Config) { cfg.CommandRate = 0 })
+	alice := loginJSON(t, s, "alice")
+	bob := loginJSON(t, s, "bob")
+	bob.sendFrame(Envelope{Type: FrameCommand, Text: "/join dev"})
+	bob.waitFor("You are now the owner of room 'dev'.")
+	bob.sendFrame(Envelope{Type: FrameCommand, Text: "/away lunch"})
+	bob.waitFor("lunch")
+
+	tests := []struct {
+		name, line, want string
+	}{
+		{"active room", "/who", "2 users in room 'general'"},
+		{"room by name", "/who dev", "1 user in room 'dev': bob"},
+		{"room with #", "/who #dev", "1 user in room 'dev': bob"},
+		{"empty room", "/who #nowhere", "Nobody is in room 'nowhere'."},
+		{"user", "/whois bob", "bob is a guest, talking in room 'dev'"},
+		{"user in another case", "/whois BOB", "bob is a guest, talking in room 'dev'"},
+		{"away user", "/whois Bob", "Away: lunch"},
+		{"unknown user", "/whois nobody", "User 'nobody' not found."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice.sendFrame(Envelope{Type: FrameCommand, Text: tt.line})
+			alice.waitFor(tt.want)
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Frame types used in the JSON-lines protocol
+const (
+	FrameHello    = "hello"    // Client -> server: switch to JSON mode and log in
+	FrameRegister = "register" // Client -> server: switch to JSON mode and create an account
+	FrameMessage  = "message"  // Chat line in a room
+	FrameWhisper  = "whisper"  // Private message between two users
+	FrameJoin     = "join"     // Someone joined a room (client -> server: join a room)
+	FrameLeave    = "leave"    // Someone left a room (client -> server: leave the room)
+	FramePresence = "presence" // Someone connected to or disconnected from the server
+	FrameSystem   = "system"   // Informational notice from the server
+	FrameRoom     = "room"     // Server -> client: the client's active room is now Room
+	FrameError    = "error"    // A request failed
+	FrameCommand  = "command"  // Client -> server: run a slash command given in Text
+	FrameKey      = "key"      // Client -> server: publish Key, or look up the key of To; server -> client: the Key of From
+	FrameFile     = "file"     // Client -> server: offer File of Size bytes to To or Room; server -> client: an offer, or the go-ahead to upload
+	FrameChunk    = "chunk"    // A piece of a file being uploaded or downloaded, base64 in Data
+	FrameResult   = "result"   // Server -> client: a room message found by /search
+	FrameMention  = "mention"  // Server -> client: From mentioned you in Room, which you are not in
+	FramePing     = "ping"     // Either side: are you still there? Answer with a pong carrying the same ID
+	FramePong     = "pong"     // Answer to a ping
+)
+
+// Protocol is the wire format spoken on a connection
+type Protocol int
+
+const (
+	ProtocolText Protocol = iota // Free-form newline-terminated text, for telnet users
+	ProtocolJSON                 // One JSON Envelope per line
+)
+
+// Envelope is a typed frame of the JSON-lines protocol.
+// Text-protocol clients receive the same frames rendered as plain lines.
+type Envelope struct {
+	Type    string    `json:"type"`
+	ID      string    `json:"id,omitempty"`
+	Room    string    `json:"room,omitempty"`
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Text    string    `json:"text,omitempty"`
+	Time    time.Time `json:"ts"`
+	History bool      `json:"history,omitempty"` // Replayed from the room log
+	Action  bool      `json:"action,omitempty"`  // A /me message: From is doing Text
+	Bot     bool      `json:"bot,omitempty"`     // Sent by a server plugin rather than a user
+
+	Key       string `json:"key,omitempty"`       // Base64 X25519 public key, in key frames
+	Encrypted bool   `json:"encrypted,omitempty"` // A whisper whose Text only the recipient can decrypt
+	Paste     bool   `json:"paste,omitempty"`     // A multi-line block sent with /paste; Text keeps its line breaks
+	Mention   bool   `json:"mention,omitempty"`   // The message mentions the recipient, by name or with @here or @everyone
+
+	File string `json:"file,omitempty"` // File name, in file frames and the first chunk of a download
+	Size int64  `json:"size,omitempty"` // File size in bytes, likewise
+	Data string `json:"data,omitempty"` // Base64 file content, in chunk frames
+
+	Password string `json:"password,omitempty"` // Only sent by clients in hello and register frames
+}
+
+// FileChunkSize is the most file content a chunk frame may carry, before base64
+const FileChunkSize = 16 * 1024
+
+var (
+	idPrefix  = strconv.FormatInt(time.Now().UnixNano(), 36)
+	idCounter atomic.Uint64
+)
+
+// nextID returns an identifier that is unique for the lifetime of the process
+// and very unlikely to repeat across restarts.
+func nextID() string {
+	return idPrefix + "-" + strconv.FormatUint(idCounter.Add(1), 36)
+}
+
+// newEnvelope creates a frame of the given type stamped with an ID and the current time
+func newEnvelope(frameType string) Envelope {
+	return Envelope{Type: frameType, ID: nextID(), Time: time.Now()}
+}
+
+// historyEntry turns a room message into an entry for the room log
+func historyEntry(env Envelope) HistoryEntry {
+	return HistoryEntry{ID: env.ID, Time: env.Time, Room: env.Room, From: env.From, Text: env.Text, Action: env.Action, Paste: env.Paste}
+}
+
+// historyEnvelope turns a stored room message back into a frame
+func historyEnvelope(entry HistoryEntry) Envelope {
+	return Envelope{
+		Type:    FrameMessage,
+		ID:      entry.ID,
+		Room:    entry.Room,
+		From:    entry.From,
+		Text:    entry.Text,
+		Time:    entry.Time,
+		History: true,
+		Action:  entry.Action,
+		Paste:   entry.Paste,
+	}
+}
+
+// render formats a frame as a line for a text-protocol client named viewer,
+// whose active room is active. Lines from other rooms are marked with the room.
+func (e Envelope) render(viewer, active string) string {
+	if e.Room != "" && e.Room != active && !e.History {
+		switch e.Type {
+		case FrameMessage, FrameJoin, FrameLeave, FrameSystem:
+			room := e.Room
+			e.Room = "" // Render the frame as usual, then mark it
+			return fmt.Sprintf("[#%s] %s", room, e.render(viewer, active))
+		}
+	}
+
+	switch e.Type {
+	case FrameMessage, FrameResult:
+		line := fmt.Sprintf("%s: %s", e.From, e.Text)
+		switch {
+		case e.Action:
+			line = fmt.Sprintf("* %s %s", e.From, e.Text)
+		case e.Paste:
+			lines := strings.Split(e.Text, "\n")
+			line = fmt.Sprintf("%s pasted %s:\n| %s", e.From, pluralize(len(lines), "line"), strings.Join(lines, "\n| "))
+		}
+		if e.Mention {
+			line = "[Mention] " + line
+		}
+		switch {
+		case e.Type == FrameResult:
+			return fmt.Sprintf("[%s] #%s %s", e.Time.Format("2006-01-02 15:04"), e.Room, line)
+		case e.History:
+			return fmt.Sprintf("[%s] %s", e.Time.Format("2006-01-02 15:04"), line)
+		}
+		return line
+	case FrameWhisper:
+		if e.Encrypted {
+			e.Text = "(encrypted; use a client with end-to-end encryption to read it)"
+		}
+		if e.History {
+			return fmt.Sprintf("[%s] [Whisper from %s]: %s", e.Time.Format("2006-01-02 15:04"), e.From, e.Text)
+		}
+		if e.From == viewer {
+			return fmt.Sprintf("[Whisper to %s]: %s", e.To, e.Text)
+		}
+		return fmt.Sprintf("[Whisper from %s]: %s", e.From, e.Text)
+	default:
+		return e.Text
+	}
+}
+
+// encode formats a frame for the given protocol, without the trailing newline
+func (e Envelope) encode(p Protocol, viewer, active string) ([]byte, error) {
+	if p == ProtocolJSON {
+		return json.Marshal(e)
+	}
+	return []byte(e.render(viewer, active)), nil
+}
+
+// decodeEnvelope parses an inbound JSON frame
+func decodeEnvelope(line string) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal([]byte(line), &env); err != nil {
+		return env, fmt.Errorf("invalid frame: %v", err)
+	}
+	if env.Type == "" {
+		return env, fmt.Errorf("invalid frame: missing type")
+	}
+	return env, nil
+}
+
+// toClientMessage converts an inbound frame into the message handled by the server loop
+func (e Envelope) toClientMessage(client *Client) (ClientMessage, error) {
+	switch e.Type {
+	case FrameMessage:
+		if e.Paste {
+			return ClientMessage{Client: client, Frame: &e}, nil
+		}
+		if e.Room != "" {
+			return ClientMessage{Client: client, Message: "/msg #" + e.Room + " " + e.Text}, nil
+		}
+		return ClientMessage{Client: client, Message: e.Text, Literal: true}, nil
+	case FrameWhisper:
+		if e.Encrypted {
+			return ClientMessage{Client: client, Frame: &e}, nil
+		}
+		return ClientMessage{Client: client, Message: "/whisper " + e.To + " " + e.Text}, nil
+	case FrameJoin:
+		return ClientMessage{Client: client, Message: "/join " + e.Room}, nil
+	case FrameLeave:
+		return ClientMessage{Client: client, Message: strings.TrimSpace("/leave " + e.Room)}, nil
+	case FrameCommand:
+		return ClientMessage{Client: client, Message: e.Text}, nil
+	case FrameKey:
+		return ClientMessage{Client: client, Frame: &e}, nil
+	default:
+		return ClientMessage{}, fmt.Errorf("unsupported frame type '%s'", e.Type)
+	}
+}
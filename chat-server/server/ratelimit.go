@@ -0,0 +1,165 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// tokenBucket allows bursts of up to burst events, refilled at rate per second
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, or nil if rate is 0 (unlimited)
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// floodGuard tracks the rate limits of one client. It is only used by the
+// client's reader goroutine, so it needs no locking.
+type floodGuard struct {
+	messages   *tokenBucket
+	commands   *tokenBucket
+	strikes    int       // Lines rejected since the last reset
+	lastStrike time.Time // When the most recent line was rejected
+	mutedUntil time.Time // Lines are dropped until then
+}
+
+func (s *Server) newFloodGuard() *floodGuard {
+	cfg := s.config()
+	return &floodGuard{
+		messages: newTokenBucket(cfg.MessageRate, cfg.MessageBurst),
+		commands: newTokenBucket(cfg.CommandRate, cfg.CommandBurst),
+	}
+}
+
+// chatCommands are commands that count against the message limit rather than the command limit
+var chatCommands = []string{"/whisper ", "/w ", "/tell ", "/msg ", "/me ", "//"}
+
+// isCommand reports whether a client message counts against the command limit.
+// Whispers, pastes, /msg and /me are chat, so they share the message limit.
+func (m ClientMessage) isCommand() bool {
+	if m.Frame != nil {
+		return m.Frame.Type != FrameWhisper && m.Frame.Type != FrameMessage
+	}
+	if m.Literal || !strings.HasPrefix(m.Message, "/") {
+		return false
+	}
+	for _, prefix := range chatCommands {
+		if strings.HasPrefix(m.Message, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowMessage applies the client's rate limits to an inbound line. A client
+// going over a limit is first warned, then muted for a while and finally
+// disconnected. It returns false if the line must be dropped.
+func (s *Server) allowMessage(client *Client, msg ClientMessage) bool {
+	guard := client.flood
+	now := time.Now()
+
+	if guard.strikes > 0 && now.Sub(guard.lastStrike) > s.config().FloodStrikeReset {
+		guard.strikes = 0 // Forgive clients that behaved for a while
+	}
+
+	bucket := guard.messages
+	if msg.isCommand() {
+		bucket = guard.commands
+	}
+	if now.Before(guard.mutedUntil) {
+		s.floodStrike(client, now) // Keep flooding while muted and you are gone
+		return false
+	}
+	if bucket.allow(now) {
+		return true
+	}
+
+	s.floodStrike(client, now)
+	return false
+}
+
+// floodStrike records a rejected line and escalates
+func (s *Server) floodStrike(client *Client, now time.Time) {
+	s.metrics.floodDropped.Add(1)
+	guard := client.flood
+	guard.strikes++
+	guard.lastStrike = now
+
+	switch {
+	case s.config().FloodDisconnectAfter > 0 && guard.strikes == s.config().FloodDisconnectAfter:
+		client.errorf("Disconnected for flooding.")
+		logWarnf("Disconnecting %s (%s) for flooding.", client.name(), client.conn.RemoteAddr())
+		go client.close() // Flush the notice; the reader then ends
+	case s.config().FloodMuteAfter > 0 && guard.strikes == s.config().FloodMuteAfter:
+		guard.mutedUntil = now.Add(s.config().FloodMuteDuration)
+		client.errorf("You are flooding and have been muted for %s.", s.config().FloodMuteDuration)
+		logWarnf("Muted %s for flooding.", client.name())
+	case guard.strikes == 1:
+		client.errorf("You are sending messages too fast. Slow down or you will be muted.")
+	}
+}
+
+// remoteIP returns the IP address part of a "host:port" remote address
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// acquireIP counts a new connection from addr against the per-IP limit.
+// It returns false if the limit is reached. Connections are counted even
+// without a limit, so that a reload setting MaxConnsPerIP sees the ones
+// already open and releaseIP always undoes exactly what acquireIP did.
+func (s *Server) acquireIP(addr string) bool {
+	ip := remoteIP(addr)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if limit := s.config().MaxConnsPerIP; limit > 0 && s.connsPerIP[ip] >= limit {
+		return false
+	}
+	s.connsPerIP[ip]++
+	return true
+}
+
+// releaseIP undoes acquireIP once a connection has closed
+func (s *Server) releaseIP(addr string) {
+	ip := remoteIP(addr)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.connsPerIP[ip]--; s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	steps := []struct {
+		after time.Duration // Since start
+		want  bool
+	}{
+		{0, true},
+		{0, true},
+		{0, true},
+		{0, false}, // Burst of 3 used up
+		{100 * time.Millisecond, false},
+		{500 * time.Millisecond, true}, // One token back at 2 per second
+		{500 * time.Millisecond, false},
+		{time.Hour, true}, // Refilled, but only up to the burst
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, false},
+	}
+
+	bucket := newTokenBucket(2, 3)
+	bucket.last = start
+	for i, step := range steps {
+		if got := bucket.allow(start.Add(step.after)); got != step.want {
+			t.Errorf("step %d: allow after %s = %t; expected %t", i, step.after, got, step.want)
+		}
+	}
+
+	unlimited := newTokenBucket(0, 3)
+	for i := 0; i < 100; i++ {
+		if !unlimited.allow(start) {
+			t.Fatalf("a bucket with no rate refused event %d", i)
+		}
+	}
+}
+
+func TestIsCommand(t *testing.T) {
+	tests := []struct {
+		msg  ClientMessage
+		want bool
+	}{
+		{ClientMessage{Message: "hello"}, false},
+		{ClientMessage{Message: "/join lobby"}, true},
+		{ClientMessage{Message: "/me waves"}, false},
+		{ClientMessage{Message: "/w bob hi"}, false},
+		{ClientMessage{Message: "/msg #lobby hi"}, false},
+		{ClientMessage{Message: "//not a command"}, false},
+		{ClientMessage{Message: "/who", Literal: true}, false},
+		{ClientMessage{Frame: &Envelope{Type: FrameWhisper}}, false},
+		{ClientMessage{Frame: &Envelope{Type: FrameMessage, Paste: true}}, false},
+		{ClientMessage{Frame: &Envelope{Type: FrameKey}}, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.msg.isCommand(); got != tt.want {
+			t.Errorf("isCommand of %+v = %t; expected %t", tt.msg, got, tt.want)
+		}
+	}
+}
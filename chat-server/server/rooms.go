@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Room roles, from least to most privileged
+const (
+	roleMember = iota
+	roleModerator
+	roleOwner
+)
+
+// roomMeta is the moderation state of a room. Unlike the member list in
+// Server.rooms it survives the room emptying out, and it is shared with the
+// other nodes of a cluster.
+type roomMeta struct {
+	Name       string               `json:"name"`
+	Owner      string               `json:"owner,omitempty"`
+	Moderators map[string]bool      `json:"moderators,omitempty"`
+	Banned     map[string]string    `json:"banned,omitempty"` // name -> reason
+	Muted      map[string]time.Time `json:"muted,omitempty"`  // name -> muted until
+	Topic      string               `json:"topic,omitempty"`
+	InviteOnly bool                 `json:"invite_only,omitempty"`
+	Invited    map[string]bool      `json:"invited,omitempty"`
+	Updated    time.Time            `json:"updated"` // Last change; the newest state wins between nodes
+}
+
+// role returns the role name has in the room. Like logins, names in the room
+// state match ignoring case.
+func (m *roomMeta) role(name string) int {
+	_, moderator := nameKey(m.Moderators, name)
+	switch {
+	case m.Owner != "" && strings.EqualFold(m.Owner, name):
+		return roleOwner
+	case moderator:
+		return roleModerator
+	default:
+		return roleMember
+	}
+}
+
+// mutedFor returns how much longer name is muted, or 0
+func (m *roomMeta) mutedFor(name string) time.Duration {
+	key, ok := nameKey(m.Muted, name)
+	if !ok {
+		return 0
+	}
+	left := time.Until(m.Muted[key])
+	if left <= 0 {
+		delete(m.Muted, key)
+		return 0
+	}
+	return left
+}
+
+// isEmpty reports whether the room has no state worth keeping
+func (m *roomMeta) isEmpty() bool {
+	return m.Owner == "" && len(m.Moderators) == 0 && len(m.Banned) == 0 &&
+		len(m.Muted) == 0 && m.Topic == "" && !m.InviteOnly && len(m.Invited) == 0
+}
+
+// roomStore keeps room moderation state in a JSON file.
+// It is guarded by Server.mutex.
+type roomStore struct {
+	path  string
+	rooms map[string]*roomMeta
+	dirty chan struct{} // Signalled by save; Server.writeRooms writes the file
+}
+
+func newRoomStore(path string) *roomStore {
+	store := &roomStore{
+		path:  path,
+		rooms: make(map[string]*roomMeta),
+		dirty: make(chan struct{}, 1),
+	}
+	if path == "" {
+		return store
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logErrorf("Error reading rooms file %s: %v", path, err)
+		}
+		return store
+	}
+	var rooms []*roomMeta
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		logErrorf("Error parsing rooms file %s: %v", path, err)
+		return store
+	}
+	for _, meta := range rooms {
+		store.rooms[meta.Name] = meta
+	}
+	return store
+}
+
+// find returns the state of a room, or nil if it has none. Unlike get it
+// never creates one.
+func (r *roomStore) find(name string) *roomMeta {
+	if _, ok := r.rooms[name]; !ok {
+		return nil
+	}
+	return r.get(name)
+}
+
+// get returns the state of a room, creating it if needed
+func (r *roomStore) get(name string) *roomMeta {
+	meta, ok := r.rooms[name]
+	if !ok {
+		meta = &roomMeta{
+			Name:       name,
+			Moderators: make(map[string]bool),
+			Banned:     make(map[string]string),
+			Muted:      make(map[string]time.Time),
+			Invited:    make(map[string]bool),
+		}
+		r.rooms[name] = meta
+	}
+	// Maps left out of the file by omitempty come back nil
+	if meta.Moderators == nil {
+		meta.Moderators = make(map[string]bool)
+	}
+	if meta.Banned == nil {
+		meta.Banned = make(map[string]string)
+	}
+	if meta.Muted == nil {
+		meta.Muted = make(map[string]time.Time)
+	}
+	if meta.Invited == nil {
+		meta.Invited = make(map[string]bool)
+	}
+	return meta
+}
+
+// save schedules the state of all rooms to be written to disk. The file is
+// written by Server.writeRooms, so the caller holding Server.mutex does not
+// hold up everyone else while it is.
+func (r *roomStore) save() {
+	if r.path == "" {
+		return
+	}
+	select {
+	case r.dirty <- struct{}{}:
+	default: // A write is already pending and will include this change
+	}
+}
+
+// encode returns the contents of the rooms file. The caller must hold Server.mutex.
+func (r *roomStore) encode() ([]byte, error) {
+	rooms := make([]*roomMeta, 0, len(r.rooms))
+	for _, meta := range r.rooms {
+		if !meta.isEmpty() {
+			rooms = append(rooms, meta)
+		}
+	}
+	return json.MarshalIndent(rooms, "", "  ")
+}
+
+// write replaces the rooms file with data
+func (r *roomStore) write(data []byte) {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		logErrorf("Error writing rooms file %s: %v", r.path, err)
+		return
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		logErrorf("Error writing rooms file %s: %v", r.path, err)
+		return
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		logErrorf("Error writing rooms file %s: %v", r.path, err)
+	}
+}
+
+// writeRooms writes the rooms file whenever it has been saved, until the
+// server shuts down. Changes still pending then are written before it returns.
+func (s *Server) writeRooms() {
+	defer close(s.roomsDone)
+	for {
+		select {
+		case <-s.roomState.dirty:
+			s.flushRooms()
+		case <-s.quit:
+			select {
+			case <-s.roomState.dirty:
+				s.flushRooms()
+			default:
+			}
+			return
+		}
+	}
+}
+
+// flushRooms encodes the room state under s.mutex and writes it after letting go
+func (s *Server) flushRooms() {
+	s.mutex.Lock()
+	data, err := s.roomState.encode()
+	s.mutex.Unlock()
+	if err != nil {
+		logErrorf("Error encoding rooms file: %v", err)
+		return
+	}
+	s.roomState.write(data)
+}
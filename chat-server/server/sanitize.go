@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// NamePolicy restricts the names of users or rooms
+type NamePolicy struct {
+	MinLength  int      // Shortest name, in characters
+	MaxLength  int      // Longest name, in characters
+	ExtraChars string   // Characters allowed besides letters and digits
+	Reserved   []string // Names nobody may take, compared case-insensitively
+}
+
+// check returns why name breaks the policy, or nil. kind is "name" or "room name".
+func (p NamePolicy) check(kind, name string) error {
+	length := utf8.RuneCountInString(name)
+	switch {
+	case length < p.MinLength:
+		return fmt.Errorf("%s must be at least %d characters", kind, p.MinLength)
+	case p.MaxLength > 0 && length > p.MaxLength:
+		return fmt.Errorf("%s must be at most %d characters", kind, p.MaxLength)
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(p.ExtraChars, r) {
+			if p.ExtraChars == "" {
+				return fmt.Errorf("%s may only contain letters and digits", kind)
+			}
+			return fmt.Errorf("%s may only contain letters, digits and the characters '%s'", kind, p.ExtraChars)
+		}
+	}
+	for _, reserved := range p.Reserved {
+		if strings.EqualFold(name, reserved) {
+			return fmt.Errorf("%s '%s' is reserved", kind, name)
+		}
+	}
+	return nil
+}
+
+// checkName returns why a user may not take name, or nil. Plugin names are
+// reserved as well, so nobody can pose as a bot.
+func (s *Server) checkName(name string) error {
+	if err := s.config().UserNames.check("name", name); err != nil {
+		return err
+	}
+	s.plugins.mutex.RLock()
+	defer s.plugins.mutex.RUnlock()
+	for _, p := range s.plugins.list {
+		if strings.EqualFold(name, p.Name) {
+			return fmt.Errorf("name '%s' is reserved", name)
+		}
+	}
+	return nil
+}
+
+// checkRoomName returns why a room may not be called name, or nil
+func (s *Server) checkRoomName(name string) error {
+	return s.config().RoomNames.check("room name", name)
+}
+
+// readLine reads a line of at most max bytes, newline included (0 means no
+// limit). A longer line is read up to its newline and dropped with
+// errLineTooLong, so the connection stays usable.
+func readLine(reader *bufio.Reader, max int) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong && max > 0 && len(line)+len(chunk) > max {
+			tooLong, line = true, nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err != nil && tooLong:
+			return "", err
+		case err != nil:
+			return string(line), err
+		case tooLong:
+			return "", errLineTooLong
+		default:
+			return string(line), nil
+		}
+	}
+}
+
+// cleanText drops control characters, which could move the cursor, recolor or
+// clear other users' terminals, along with whole ANSI escape sequences and the
+// invisible marks that reverse text direction. Tabs and line breaks become
+// spaces. text must be valid UTF-8; handleConnection drops lines that are not.
+func cleanText(text string) string {
+	var b strings.Builder
+	b.Grow(len(text))
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+		switch {
+		case r == '\x1b' && i < len(text) && text[i] == '[':
+			// Skip a CSI sequence: parameters up to a final byte in @ to ~
+			for i++; i < len(text) && (text[i] < 0x40 || text[i] > 0x7e); i++ {
+			}
+			i++
+		case r == '\t', r == '\n', r == '\r':
+			b.WriteByte(' ')
+		case unicode.IsControl(r), unicode.Is(unicode.Bidi_Control, r):
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// cleanBlock cleans a multi-line block line by line like cleanText, keeping
+// the line breaks. Tabs become four spaces so code keeps its indentation;
+// trailing spaces and blank lines at either end are dropped.
+func cleanBlock(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(cleanText(strings.ReplaceAll(line, "\t", "    ")), " ")
+	}
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
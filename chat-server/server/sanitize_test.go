@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 100)
+
+	tests := []struct {
+		name  string
+		input string
+		max   int
+		want  []string // Lines read, or the error's text after "!"
+	}{
+		{"lines", "one\ntwo\n", 10, []string{"one\n", "two\n", "!EOF"}},
+		{"exactly the limit", "123456789\n", 10, []string{"123456789\n", "!EOF"}},
+		{"too long", "1234567890\nnext\n", 10, []string{"!line too long", "next\n"}},
+		{"too long across buffer refills", long + "\nnext\n", 20, []string{"!line too long", "next\n"}},
+		{"no limit", long + "\n", 0, []string{long + "\n"}},
+		{"no line break at the end", "last", 10, []string{"!EOF"}},
+		{"too long without a line break", long, 10, []string{"!EOF"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReaderSize(strings.NewReader(tt.input), 16)
+			for i, want := range tt.want {
+				line, err := readLine(reader, tt.max)
+				got := line
+				if err != nil {
+					got = "!" + err.Error()
+				}
+				if got != want {
+					t.Fatalf("read %d returned %q; expected %q", i+1, got, want)
+				}
+			}
+		})
+	}
+
+	// A partial last line is returned with the error
+	line, err := readLine(bufio.NewReader(strings.NewReader("last")), 10)
+	if line != "last" || !errors.Is(err, io.EOF) {
+		t.Errorf("readLine of a partial line returned %q, %v; expected \"last\", EOF", line, err)
+	}
+}
+
+func TestCleanText(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"plain", "hello, wörld!", "hello, wörld!"},
+		{"whitespace", "a\tb\r\nc", "a b  c"},
+		{"control characters", "bell\a back\b null\x00 del\x7f", "bell back null del"},
+		{"color", "\x1b[31mred\x1b[0m", "red"},
+		{"cursor movement", "\x1b[2J\x1b[1;1Hclear", "clear"},
+		{"unterminated escape", "tail\x1b[12", "tail"},
+		{"lone escape", "a\x1bb", "ab"},
+		{"C1 control", "a\u009bb", "ab"},
+		{"direction override", "abc‮def⁦", "abcdef"},
+	}
+
+	for _, tt := range tests {
+		if got := cleanText(tt.text); got != tt.want {
+			t.Errorf("%s: cleanText(%q) = %q; expected %q", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestCleanBlock(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"indentation", "if x {\n\treturn\n}", "if x {\n    return\n}"},
+		{"windows line breaks", "a\r\nb", "a\nb"},
+		{"blank lines at the ends", "\n\n  \nbody\n\n", "body"},
+		{"blank lines inside", "a\n\nb", "a\n\nb"},
+		{"trailing spaces", "a   \nb", "a\nb"},
+		{"escapes", "\x1b[1mbold\x1b[0m\n\x07", "bold"},
+	}
+
+	for _, tt := range tests {
+		if got := cleanBlock(tt.text); got != tt.want {
+			t.Errorf("%s: cleanBlock(%q) = %q; expected %q", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestNamePolicy(t *testing.T) {
+	policy := NamePolicy{MinLength: 2, MaxLength: 8, ExtraChars: "_-", Reserved: []string{"admin"}}
+
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{"alice", ""},
+		{"Zoë_2", ""},
+		{"a", "name must be at least 2 characters"},
+		{"abcdefghi", "name must be at most 8 characters"},
+		{"bad name", "name may only contain letters, digits and the characters '_-'"},
+		{"tab\tx", "name may only contain"},
+		{"ADMIN", "name 'ADMIN' is reserved"},
+	}
+
+	for _, tt := range tests {
+		err := policy.check("name", tt.name)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("check(%q) returned %v; expected no error", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)):
+			t.Errorf("check(%q) returned %v; expected %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// searchResultLimit is how many results /search shows
+const searchResultLimit = 20
+
+var (
+	errNothingToSearch = errors.New("nothing to search for")
+	errBadSince        = errors.New("invalid since date")
+)
+
+// SearchResult is a room message found by /search or the admin export
+type SearchResult struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Room   string    `json:"room"`
+	From   string    `json:"from"`
+	Text   string    `json:"text"`
+	Action bool      `json:"action,omitempty"`
+	Paste  bool      `json:"paste,omitempty"`
+}
+
+// indexedMessage is a message in the search index with the terms it contains
+type indexedMessage struct {
+	result SearchResult
+	terms  []string
+}
+
+// searchIndex is an inverted index over the room messages. Like the room logs
+// it keeps the newest limit messages of each room, and it is kept up to date
+// as messages are broadcast.
+type searchIndex struct {
+	limit    int
+	docs     map[int]*indexedMessage
+	lastDoc  int
+	postings map[string][]int // Term -> messages containing it, oldest first
+	rooms    map[string][]int // Room -> its messages, oldest first
+	mutex    sync.RWMutex
+}
+
+func newSearchIndex(limit int) *searchIndex {
+	return &searchIndex{
+		limit:    limit,
+		docs:     make(map[int]*indexedMessage),
+		postings: make(map[string][]int),
+		rooms:    make(map[string][]int),
+	}
+}
+
+// buildSearchIndex indexes the messages in every room log of h
+func buildSearchIndex(h *historyStore) *searchIndex {
+	idx := newSearchIndex(h.limit)
+	started := time.Now()
+	for _, room := range h.Rooms() {
+		for _, entry := range h.Page(room, 0, h.limit) {
+			idx.add(entry)
+		}
+	}
+	if len(idx.docs) > 0 {
+		logInfof("Indexed %s in %d rooms for search in %s", pluralize(len(idx.docs), "message"), len(idx.rooms), time.Since(started).Round(time.Millisecond))
+	}
+	return idx
+}
+
+// searchTerms splits text into lower-case words for the index
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// add indexes a room message, dropping the oldest message of its room once
+// the room holds more than the limit
+func (idx *searchIndex) add(entry HistoryEntry) {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, term := range searchTerms(entry.From + " " + entry.Text) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.lastDoc++
+	doc := idx.lastDoc
+	idx.docs[doc] = &indexedMessage{
+		result: SearchResult{ID: entry.ID, Time: entry.Time, Room: entry.Room, From: entry.From, Text: entry.Text, Action: entry.Action, Paste: entry.Paste},
+		terms:  terms,
+	}
+	for _, term := range terms {
+		idx.postings[term] = append(idx.postings[term], doc)
+	}
+	idx.rooms[entry.Room] = append(idx.rooms[entry.Room], doc)
+	if docs := idx.rooms[entry.Room]; len(docs) > idx.limit {
+		idx.rooms[entry.Room] = docs[1:]
+		idx.removeLocked(docs[0])
+	}
+}
+
+// removeLocked drops a message from the postings of its terms.
+// The caller must hold idx.mutex.
+func (idx *searchIndex) removeLocked(doc int) {
+	msg, ok := idx.docs[doc]
+	if !ok {
+		return
+	}
+	delete(idx.docs, doc)
+	for _, term := range msg.terms {
+		docs := idx.postings[term]
+		i := sort.SearchInts(docs, doc)
+		if i < len(docs) && docs[i] == doc {
+			docs = append(docs[:i], docs[i+1:]...)
+		}
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+		} else {
+			idx.postings[term] = docs
+		}
+	}
+}
+
+// searchQuery is a parsed search: every term must match, a term ending in
+// "*" matches any word it starts, and the filters narrow the results down
+type searchQuery struct {
+	terms []string
+	room  string
+	from  string
+	since time.Time
+}
+
+// newSearchQuery parses the parts of a search. since may be a date such as
+// "2024-05-01" or "2024-05-01T14:00", "today", "yesterday" or an age such as
+// "90m", "12h", "3d" or "2w".
+func newSearchQuery(text, room, from, since string, now time.Time) (searchQuery, error) {
+	q := searchQuery{room: strings.TrimPrefix(room, "#"), from: strings.TrimPrefix(from, "@")}
+	for _, word := range strings.Fields(text) {
+		terms := searchTerms(word)
+		if len(terms) == 0 {
+			continue
+		}
+		if strings.HasSuffix(word, "*") {
+			terms[len(terms)-1] += "*"
+		}
+		q.terms = append(q.terms, terms...)
+	}
+	if since != "" {
+		t, err := parseSince(since, now)
+		if err != nil {
+			return q, err
+		}
+		q.since = t
+	}
+	return q, nil
+}
+
+// parseSearch parses the arguments of /search: words to look for, mixed
+// with "#room" (or "in:room"), "from:user" and "since:date"
+func parseSearch(args []string, now time.Time) (searchQuery, error) {
+	var words []string
+	var room, from, since string
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "#") && len(arg) > 1:
+			room = arg[1:]
+		case strings.HasPrefix(arg, "in:"):
+			room = strings.TrimPrefix(arg, "in:")
+		case strings.HasPrefix(arg, "from:"):
+			from = strings.TrimPrefix(arg, "from:")
+		case strings.HasPrefix(arg, "since:"):
+			since = strings.TrimPrefix(arg, "since:")
+		default:
+			words = append(words, arg)
+		}
+	}
+	q, err := newSearchQuery(strings.Join(words, " "), room, from, since, now)
+	if err == nil && len(q.terms) == 0 && q.room == "" && q.from == "" {
+		err = errNothingToSearch
+	}
+	return q, err
+}
+
+// parseSince turns the value of since: into a point in time
+func parseSince(value string, now time.Time) (time.Time, error) {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch value {
+	case "today":
+		return midnight, nil
+	case "yesterday":
+		return midnight.AddDate(0, 0, -1), nil
+	}
+	if n, err := strconv.Atoi(value[:len(value)-1]); err == nil && n >= 0 {
+		switch value[len(value)-1] {
+		case 'd':
+			return now.AddDate(0, 0, -n), nil
+		case 'w':
+			return now.AddDate(0, 0, -7*n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w %q", errBadSince, value)
+}
+
+// lookupLocked returns the messages containing term, oldest first.
+// The caller must hold idx.mutex.
+func (idx *searchIndex) lookupLocked(term string) []int {
+	prefix, ok := strings.CutSuffix(term, "*")
+	if !ok {
+		return idx.postings[term]
+	}
+	var docs []int
+	for candidate, list := range idx.postings {
+		if strings.HasPrefix(candidate, prefix) {
+			docs = append(docs, list...)
+		}
+	}
+	sort.Ints(docs)
+	unique := docs[:0]
+	for _, doc := range docs {
+		if len(unique) == 0 || doc != unique[len(unique)-1] {
+			unique = append(unique, doc)
+		}
+	}
+	return unique
+}
+
+// intersect returns the documents in both sorted lists
+func intersect(a, b []int) []int {
+	var both []int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			both = append(both, a[i])
+			i++
+			j++
+		}
+	}
+	return both
+}
+
+// search returns the messages matching q, newest first, leaving out rooms
+// for which hidden returns true. With limit > 0 at most limit messages are
+// returned; total counts all of them.
+func (idx *searchIndex) search(q searchQuery, hidden func(room string) bool, limit int) (results []SearchResult, total int) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	var docs []int
+	switch {
+	case len(q.terms) > 0:
+		lists := make([][]int, len(q.terms))
+		for i, term := range q.terms {
+			lists[i] = idx.lookupLocked(term)
+		}
+		sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+		docs = lists[0]
+		for _, list := range lists[1:] {
+			docs = intersect(docs, list)
+		}
+	case q.room != "":
+		docs = idx.rooms[q.room]
+	default:
+		for doc := range idx.docs {
+			docs = append(docs, doc)
+		}
+	}
+
+	for _, doc := range docs {
+		r := idx.docs[doc].result
+		if (q.room != "" && r.Room != q.room) || (q.from != "" && !strings.EqualFold(r.From, q.from)) ||
+			r.Time.Before(q.since) || (hidden != nil && hidden(r.Room)) {
+			continue
+		}
+		results = append(results, r)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Time.After(results[j].Time) })
+	total = len(results)
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, total
+}
+
+// indexMessage adds a room message that is being broadcast to the search index
+func (s *Server) indexMessage(env Envelope) {
+	if env.Type == FrameMessage && !env.History {
+		s.search.add(historyEntry(env))
+	}
+}
+
+// searchMessages handles /search for a client. Rooms the client is not in
+// and could not join are left out.
+func (s *Server) searchMessages(client *Client, args []string) {
+	q, err := parseSearch(args, time.Now())
+	if err != nil {
+		const usage = "Usage: /search <words> [#room] [from:user] [since:date]"
+		switch {
+		case errors.Is(err, errNothingToSearch):
+			client.errorf("Nothing to search for. %s", usage)
+		case errors.Is(err, errBadSince):
+			client.errorf("Cannot read the date after since:; use e.g. 2024-05-01, 2024-05-01T14:00, today, 12h or 3d. %s", usage)
+		default:
+			client.errorf("%s", usage)
+		}
+		return
+	}
+
+	s.mutex.Lock()
+	hiddenRooms := make(map[string]bool)
+	for roomName := range s.roomState.rooms {
+		if !client.rooms[roomName] && s.joinDenied(client.name(), roomName) != "" {
+			hiddenRooms[roomName] = true
+		}
+	}
+	s.mutex.Unlock()
+
+	results, total := s.search.search(q, func(room string) bool { return hiddenRooms[room] }, searchResultLimit)
+	if total == 0 {
+		client.systemf("No messages found.")
+		return
+	}
+	if total > len(results) {
+		client.systemf("--- Newest %d of %s ---", len(results), pluralize(total, "result"))
+	} else {
+		client.systemf("--- %s ---", pluralize(total, "result"))
+	}
+	for _, r := range results {
+		env := newEnvelope(FrameResult)
+		env.ID, env.Time, env.Room, env.From = r.ID, r.Time, r.Room, r.From
+		env.Text, env.Action, env.Paste = r.Text, r.Action, r.Paste
+		if err := client.send(env); err != nil {
+			logErrorf("Error sending search results to %s: %v", client.name(), err)
+			return
+		}
+	}
+	client.systemf("--- End of results ---")
+}
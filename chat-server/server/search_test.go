@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 10, 15, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"today", time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC)},
+		{"yesterday", time.Date(2024, 5, 9, 0, 0, 0, 0, time.UTC)},
+		{"3d", time.Date(2024, 5, 7, 15, 30, 0, 0, time.UTC)},
+		{"2w", time.Date(2024, 4, 26, 15, 30, 0, 0, time.UTC)},
+		{"0d", now},
+		{"12h", time.Date(2024, 5, 10, 3, 30, 0, 0, time.UTC)},
+		{"90m", time.Date(2024, 5, 10, 14, 0, 0, 0, time.UTC)},
+		{"2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-05-01T14:00", time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)},
+		{"2024-05-01T14:00:30", time.Date(2024, 5, 1, 14, 0, 30, 0, time.UTC)},
+		{"2024-05-01T14:00:00+02:00", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.value, now)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseSince(%q) = %v, %v; expected %v", tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{"d", "-3d", "-1h", "3x", "2024-13-01", "last week"} {
+		if _, err := parseSince(value, now); !errors.Is(err, errBadSince) {
+			t.Errorf("parseSince(%q) returned %v; expected %v", value, err, errBadSince)
+		}
+	}
+}
+
+func TestParseSearch(t *testing.T) {
+	now := time.Date(2024, 5, 10, 15, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		args    []string
+		want    searchQuery
+		wantErr error
+	}{
+		{[]string{"Deploy", "failed!"}, searchQuery{terms: []string{"deploy", "failed"}}, nil},
+		{[]string{"deplo*"}, searchQuery{terms: []string{"deplo*"}}, nil},
+		{[]string{"foo-bar*"}, searchQuery{terms: []string{"foo", "bar*"}}, nil},
+		{[]string{"#ops", "from:@alice"}, searchQuery{room: "ops", from: "alice"}, nil},
+		{[]string{"x", "in:ops", "since:today"}, searchQuery{terms: []string{"x"}, room: "ops", since: time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC)}, nil},
+		{[]string{"#"}, searchQuery{}, errNothingToSearch},
+		{[]string{"since:today"}, searchQuery{}, errNothingToSearch},
+		{[]string{"x", "since:soon"}, searchQuery{}, errBadSince},
+	}
+	for _, tt := range tests {
+		got, err := parseSearch(tt.args, now)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("parseSearch(%q) returned error %v; expected %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (!slices.Equal(got.terms, tt.want.terms) || got.room != tt.want.room || got.from != tt.want.from || !got.since.Equal(tt.want.since)) {
+			t.Errorf("parseSearch(%q) = %+v; expected %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	start := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	idx := newSearchIndex(3)
+	messages := []HistoryEntry{
+		{ID: "1", Room: "lobby", From: "alice", Text: "the deploy failed"},
+		{ID: "2", Room: "lobby", From: "bob", Text: "deployment fixed"},
+		{ID: "3", Room: "ops", From: "Alice", Text: "Deploy done, deploy again?"},
+		{ID: "4", Room: "lobby", From: "carol", Text: "lunch"},
+		{ID: "5", Room: "lobby", From: "dave", Text: "more lunch"}, // Pushes message 1 out of the lobby
+		{ID: "6", Room: "secret", From: "erin", Text: "deploy keys"},
+	}
+	for i, entry := range messages {
+		entry.Time = start.Add(time.Duration(i) * time.Minute)
+		idx.add(entry)
+	}
+
+	tests := []struct {
+		name  string
+		query searchQuery
+		want  []string // Result IDs, newest first
+	}{
+		{"term", searchQuery{terms: []string{"deploy"}}, []string{"6", "3"}},
+		{"prefix", searchQuery{terms: []string{"deploy*"}}, []string{"6", "3", "2"}},
+		{"every term", searchQuery{terms: []string{"deploy", "done"}}, []string{"3"}},
+		{"sender is a term", searchQuery{terms: []string{"carol"}}, []string{"4"}},
+		{"dropped message", searchQuery{terms: []string{"failed"}}, nil},
+		{"room only", searchQuery{room: "lobby"}, []string{"5", "4", "2"}},
+		{"from ignores case", searchQuery{from: "alice"}, []string{"3"}},
+		{"since", searchQuery{terms: []string{"lunch"}, since: start.Add(4 * time.Minute)}, []string{"5"}},
+		{"no match", searchQuery{terms: []string{"deploy", "lunch"}}, nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		results, total := idx.search(tt.query, nil, 0)
+		for _, r := range results {
+			got = append(got, r.ID)
+		}
+		if !slices.Equal(got, tt.want) || total != len(tt.want) {
+			t.Errorf("%s: search returned %q (%d in total); expected %q", tt.name, got, total, tt.want)
+		}
+	}
+
+	// Message 6 is in a hidden room
+	hidden := func(room string) bool { return room == "secret" }
+	results, total := idx.search(searchQuery{terms: []string{"deploy*"}}, hidden, 1)
+	if len(results) != 1 || results[0].ID != "3" || total != 2 {
+		t.Errorf("search with a limit of 1 returned %+v and %d in total; expected message 3 and 2", results, total)
+	}
+	if _, ok := idx.postings["failed"]; ok {
+		t.Errorf("terms of a dropped message are still indexed")
+	}
+}
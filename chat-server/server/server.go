@@ -2,24 +2,121 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
 	"net"
+	"net/http"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 // Client represents a connected client
 type Client struct {
-	conn net.Conn
-	name string
-	room string // New field: current room name
+	conn     net.Conn
+	username atomic.Value    // Name as a string; use name and setName, which are safe from any goroutine
+	room     string          // Active room, where plain messages go
+	rooms    map[string]bool // Every room the client is in; guarded by Server.mutex
+	shown    atomic.Value    // Copy of room for rendering frames without Server.mutex
+	protocol Protocol        // Wire format negotiated at connect time
+	out      *outbound
+
+	registered bool // Logged in to a registered account rather than as a guest; changed under Server.mutex once online
+	flood      *floodGuard
+
+	connectedAt time.Time
+	lastActive  atomic.Int64         // Unix nanoseconds of the last line the client sent
+	lastRead    atomic.Int64         // Like lastActive, but counting pongs too
+	pingedAt    time.Time            // When an unanswered ping was sent; only used by sweepConnections
+	kicked      bool                 // Set by sweepConnections once it has dropped the client
+	away        string               // Away message, or "" when present; guarded by Server.mutex
+	publicKey   string               // Published key for encrypted whispers; guarded by Server.mutex
+	paste       *pasteBuffer         // A /paste block being typed by a text client; only used by its reader
+	uploads     map[string]*transfer // Files being uploaded, by the ID the client chose; only used by its reader
+
+	historyCursor int64 // Oldest history entry of the current room shown to this client
+}
+
+// name returns the client's name
+func (c *Client) name() string {
+	name, _ := c.username.Load().(string)
+	return name
+}
+
+// setName changes the client's name. Once the client is registered, the
+// caller must also hold s.mutex to keep it in step with Server.usernames.
+func (c *Client) setName(name string) {
+	c.username.Store(name)
+}
+
+// setRoom makes one of the client's rooms its active room. The caller must hold s.mutex.
+func (c *Client) setRoom(roomName string) {
+	c.room = roomName
+	c.shown.Store(roomName)
+	c.historyCursor = 0
+}
+
+// roomNames lists the client's rooms in order. The caller must hold s.mutex.
+func (c *Client) roomNames() []string {
+	roomNames := make([]string, 0, len(c.rooms))
+	for roomName := range c.rooms {
+		roomNames = append(roomNames, roomName)
+	}
+	sort.Strings(roomNames)
+	return roomNames
+}
+
+// send queues a frame for the client in its negotiated protocol
+func (c *Client) send(env Envelope) error {
+	active, _ := c.shown.Load().(string)
+	line, err := env.encode(c.protocol, c.name(), active)
+	if err != nil {
+		return err
+	}
+	return c.write(append(line, '\n'))
+}
+
+// notify sends a frame of the given type carrying only a text notice
+func (c *Client) notify(frameType, format string, args ...interface{}) {
+	env := newEnvelope(frameType)
+	env.Text = fmt.Sprintf(format, args...)
+	if err := c.send(env); err != nil {
+		logErrorf("Error sending notice to %s: %v", c.name(), err)
+	}
+}
+
+// systemf sends an informational notice to the client
+func (c *Client) systemf(format string, args ...interface{}) {
+	c.notify(FrameSystem, format, args...)
+}
+
+// roomf tells the client that its active room is now room. JSON clients get a
+// room frame, so they can follow which room they are talking in.
+func (c *Client) roomf(room, format string, args ...interface{}) {
+	env := newEnvelope(FrameRoom)
+	env.Room = room
+	env.Text = fmt.Sprintf(format, args...)
+	if err := c.send(env); err != nil {
+		logErrorf("Error sending notice to %s: %v", c.name(), err)
+	}
+}
+
+// errorf tells the client a request failed
+func (c *Client) errorf(format string, args ...interface{}) {
+	c.notify(FrameError, format, args...)
 }
 
 // ClientMessage represents a message from a client
 type ClientMessage struct {
 	Client  *Client
 	Message string
+	Literal bool      // Deliver Message as chat text even if it starts with '/'
+	Frame   *Envelope // A JSON frame with no text equivalent, handled by handleFrame instead of Message
 }
 
 // Server represents the chat server
@@ -30,231 +127,818 @@ type Server struct {
 	messages   chan ClientMessage
 	register   chan *Client
 	unregister chan *Client
+	tasks      chan func() // Work finished on the loop after waiting elsewhere, such as a /nick confirmed by peers
 	mutex      sync.Mutex
+
+	cfg       atomic.Pointer[Config] // Replaced as a whole by Reload
+	history   *historyStore
+	search    *searchIndex // Inverted index over the room logs, for /search
+	accounts  *accountStore
+	roomState *roomStore     // Owners, moderators, bans, mutes and topics; guarded by mutex
+	mailbox   *mailStore     // Whispers waiting for offline users
+	mentions  *mentionStore  // Recent @mentions of each user, for /mentions
+	transfers *transferStore // Files sent with /send, waiting for their recipients
+	metrics   *metrics
+	commands  *commandRegistry
+	plugins   pluginSet
+	cluster   *cluster // Links to the other nodes of a cluster
+
+	listener    net.Listener
+	wsServer    *http.Server
+	wsAddr      net.Addr
+	adminServer *http.Server
+	adminAddr   net.Addr
+	conns       map[net.Conn]*Client // Every open connection, including ones still logging in
+	connWG      sync.WaitGroup       // Running handleConnection goroutines
+	closing     bool                 // Set once Shutdown has been called
+
+	connsPerIP map[string]int // Open connections per remote IP, for Config.MaxConnsPerIP
+	quit       chan struct{}  // Closed to stop handleMessages
+	loopDone   chan struct{}  // Closed when handleMessages has returned
+	roomsDone  chan struct{}  // Closed when writeRooms has written the last changes
 }
 
-// NewServer creates a new chat server
+// NewServer creates a new chat server with the default configuration
 func NewServer() *Server {
-	return &Server{
+	return NewServerWithConfig(DefaultConfig())
+}
+
+// NewServerWithConfig creates a new chat server using cfg
+func NewServerWithConfig(cfg Config) *Server {
+	s := &Server{
+		history:    newHistoryStore(cfg.HistoryDir, cfg.HistoryLimit),
+		accounts:   newAccountStore(cfg.AccountsFile),
+		roomState:  newRoomStore(cfg.RoomsFile),
+		mailbox:    newMailStore(cfg.MailboxFile, cfg.MailboxLimit, cfg.MailboxSeenFor),
+		mentions:   newMentionStore(cfg.MentionsFile, cfg.MentionLimit),
+		transfers:  newTransferStore(cfg.TransferDir),
+		metrics:    newMetrics(),
+		cluster:    newCluster(),
 		clients:    make(map[net.Conn]*Client),
 		usernames:  make(map[string]*Client),
 		rooms:      make(map[string]map[string]*Client), // Initialize rooms map
 		messages:   make(chan ClientMessage),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		tasks:      make(chan func()),
+		conns:      make(map[net.Conn]*Client),
+		connsPerIP: make(map[string]int),
+		quit:       make(chan struct{}),
+		loopDone:   make(chan struct{}),
+		roomsDone:  make(chan struct{}),
+		commands:   newCommandRegistry(),
 	}
+	s.cfg.Store(&cfg)
+	setLogLevel(cfg.LogLevel)
+	s.search = buildSearchIndex(s.history)
+	s.registerBuiltinCommands()
+	return s
+}
+
+// config returns the current configuration. Callers must not modify it.
+func (s *Server) config() *Config {
+	return s.cfg.Load()
 }
 
-// Start starts the chat server
-func (s *Server) Start(port string) {
-	listener, err := net.Listen("tcp", ":"+port)
+// Start listens on addr and serves clients until Shutdown is called.
+// It returns nil after a graceful shutdown.
+func (s *Server) Start(addr string) error {
+	if err := s.Listen(addr); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen opens the chat listener and the WebSocket gateway, if configured, and
+// starts the message loop. Connections are accepted once Serve is called.
+// addr is a host:port or a bare port; "" means Config.ListenAddr. Listening on
+// port "0" picks a free port; use Addr to find out which.
+func (s *Server) Listen(addr string) error {
+	cfg := s.config()
+	switch {
+	case addr == "":
+		addr = cfg.ListenAddr
+	case !strings.Contains(addr, ":"):
+		addr = ":" + addr
+	}
+	tlsConfig, err := s.tlsConfig()
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		return fmt.Errorf("configuring TLS: %v", err)
+	}
+	listenConfig := net.ListenConfig{KeepAlive: cfg.TCPKeepAlive}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("starting server: %v", err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	if cfg.WebSocketAddr != "" {
+		if err := s.startWebSocket(cfg.WebSocketAddr, tlsConfig); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	if cfg.AdminAddr != "" {
+		if err := s.startAdmin(cfg.AdminAddr); err != nil {
+			listener.Close()
+			if s.wsServer != nil {
+				s.wsServer.Close()
+			}
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	s.listener = listener
+	s.mutex.Unlock()
+	logInfof("Chat server started on %s (TLS: %t)", listener.Addr(), tlsConfig != nil)
+
+	if cfg.ClusterAddr != "" || len(cfg.ClusterPeers) > 0 {
+		if err := s.startCluster(); err != nil {
+			listener.Close()
+			if s.wsServer != nil {
+				s.wsServer.Close()
+			}
+			if s.adminServer != nil {
+				s.adminServer.Close()
+			}
+			return err
+		}
 	}
-	defer listener.Close()
-	log.Printf("Chat server started on port %s", port)
 
 	go s.handleMessages()
+	go s.writeRooms()
+	go s.sweepConnections()
+	go s.sweepTransfers()
+	return nil
+}
+
+// Serve accepts connections on the listener opened by Listen until Shutdown is called.
+func (s *Server) Serve() error {
+	s.mutex.Lock()
+	listener := s.listener
+	s.mutex.Unlock()
+	if listener == nil {
+		return errors.New("server is not listening")
+	}
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return nil // Shutdown closed the listener
+			}
+			logErrorf("Error accepting connection: %v", err)
+			continue
+		}
+		if !s.acquireIP(conn.RemoteAddr().String()) {
+			logWarnf("Rejecting %s: too many connections from this address", conn.RemoteAddr())
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			fmt.Fprintln(conn, "Too many connections from your address. Disconnecting.")
+			conn.Close()
 			continue
 		}
 		go s.handleConnection(conn)
 	}
 }
 
+// Addr returns the address of the chat listener, or nil before Listen
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// WebSocketAddr returns the address of the WebSocket gateway, or nil if it is not running
+func (s *Server) WebSocketAddr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.wsAddr
+}
+
 func (s *Server) handleMessages() {
+	defer close(s.loopDone)
 	for {
 		select {
+		case <-s.quit:
+			return
+
 		case client := <-s.register:
 			s.mutex.Lock()
+			if reason := s.joinDenied(client.name(), client.room); reason != "" {
+				s.mutex.Unlock()
+				s.releaseName(client.name())
+				client.errorf("%s Disconnecting.", reason)
+				go client.close() // The reader then unregisters the client, which is a no-op
+				continue
+			}
 			s.clients[client.conn] = client
-			s.usernames[client.name] = client
+			s.usernames[client.name()] = client
+			s.cluster.mutex.Lock()
+			delete(s.cluster.claims, client.name()) // The name is now held by usernames
+			s.cluster.mutex.Unlock()
 			// Add client to their initial room
-			if _, ok := s.rooms[client.room]; !ok {
-				s.rooms[client.room] = make(map[string]*Client)
-			}
-			s.rooms[client.room][client.name] = client
+			_, roomExists := s.rooms[client.room]
+			becameOwner := s.addToRoom(client, client.room)
+			member := peerUserOf(client)
 			s.mutex.Unlock()
-			s.broadcastMessageToRoom(client.room, fmt.Sprintf("%s has joined the chat.", client.name))
-			log.Printf("Client %s connected to room %s. Total clients: %d", client.name, client.room, len(s.clients))
+			s.peerBroadcast(member.frame(peerUserJoin))
+			s.metrics.connections.Add(1)
+			s.metrics.joins.Add(1)
+			s.broadcastPresence(client.name(), member.Rooms, fmt.Sprintf("%s has joined the chat.", client.name()))
+			s.showMOTD(client)
+			client.roomf(client.room, "You are in room '%s'.", client.room)
+			s.welcomeToRoom(client, becameOwner)
+			s.showUnread(client)
+			s.showUnreadMentions(client)
+			s.joinEvents(client.name(), client.room, !roomExists)
+			logInfof("Client %s connected to room %s. Total clients: %d", client.name(), client.room, len(s.clients))
 
 		case client := <-s.unregister:
 			s.mutex.Lock()
 			if _, ok := s.clients[client.conn]; ok {
 				delete(s.clients, client.conn)
-				delete(s.usernames, client.name)
-				// Remove client from their room
-				if roomClients, ok := s.rooms[client.room]; ok {
-					delete(roomClients, client.name)
-					if len(roomClients) == 0 { // If room is empty, delete it
-						delete(s.rooms, client.room)
-					}
+				delete(s.usernames, client.name())
+				// Remove client from all of their rooms
+				roomNames := client.roomNames()
+				destroyed := make(map[string]bool, len(roomNames))
+				for _, roomName := range roomNames {
+					s.removeFromRoom(client, roomName)
+					_, roomExists := s.rooms[roomName]
+					destroyed[roomName] = !roomExists
 				}
-				client.conn.Close()
+				if !client.registered {
+					s.dropGuestRoles(client.name())
+				}
+				s.transfers.withdraw(client.name())
+				closing := s.closing
 				s.mutex.Unlock()
-				s.broadcastMessageToRoom(client.room, fmt.Sprintf("%s has left the chat.", client.name))
-				log.Printf("Client %s disconnected from room %s. Total clients: %d", client.name, client.room, len(s.clients))
+				s.peerBroadcast(peerFrame{Type: peerUserLeave, User: client.name()})
+				if !client.registered {
+					s.mailbox.MarkSeen(client.name(), remoteIP(client.conn.RemoteAddr().String()))
+				}
+				s.metrics.leaves.Add(uint64(len(roomNames)))
+				if !closing { // Everyone is being disconnected and already got the shutdown notice
+					s.broadcastPresence(client.name(), roomNames, fmt.Sprintf("%s has left the chat.", client.name()))
+				}
+				for _, roomName := range roomNames {
+					s.leaveEvents(client.name(), roomName, destroyed[roomName])
+				}
+				logInfof("Client %s disconnected from %s. Total clients: %d", client.name(), pluralize(len(roomNames), "room"), len(s.clients))
 			} else {
 				s.mutex.Unlock()
 			}
 
 		case clientMsg := <-s.messages:
-			senderClient := clientMsg.Client
-			actualMessage := clientMsg.Message
-
-			if strings.HasPrefix(actualMessage, "/whisper ") {
-				whisperParts := strings.SplitN(actualMessage, " ", 3)
-				if len(whisperParts) < 3 {
-					fmt.Fprintln(senderClient.conn, "Usage: /whisper <username> <message>")
-					continue
-				}
-				targetUsername := whisperParts[1]
-				privateMessage := whisperParts[2]
-
-				s.sendWhisper(senderClient, targetUsername, privateMessage)
-			} else if strings.HasPrefix(actualMessage, "/join ") {
-				newRoomName := strings.TrimSpace(strings.TrimPrefix(actualMessage, "/join "))
-				s.joinRoom(senderClient, newRoomName)
-			} else if actualMessage == "/leave" {
-				s.leaveRoom(senderClient)
-			} else {
-				// Broadcast to current room
-				s.broadcastMessageToRoom(senderClient.room, fmt.Sprintf("%s: %s", senderClient.name, actualMessage))
+			message := clientMsg.Message
+			switch {
+			case clientMsg.Frame != nil:
+				s.handleFrame(clientMsg.Client, *clientMsg.Frame)
+			case clientMsg.Literal || !strings.HasPrefix(message, "/"):
+				s.sendChatMessage(clientMsg.Client, clientMsg.Client.room, message, false)
+			case strings.HasPrefix(message, "//"): // Escaped slash
+				s.sendChatMessage(clientMsg.Client, clientMsg.Client.room, message[1:], false)
+			default:
+				s.runCommand(clientMsg.Client, message)
 			}
+
+		case task := <-s.tasks:
+			task()
 		}
 	}
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
-	reader := bufio.NewReader(conn)
-	fmt.Fprint(conn, "Enter your name: ")
-	name, err := reader.ReadString('\n')
-	if err != nil {
-		log.Printf("Error reading name: %v", err)
-		conn.Close()
-		return
+// runOnLoop has the message loop run fn. It is dropped if the server shuts
+// down first.
+func (s *Server) runOnLoop(fn func()) {
+	select {
+	case s.tasks <- fn:
+	case <-s.quit:
 	}
-	name = strings.TrimSpace(name) // Remove newline and any other whitespace
+}
 
-	if name == "" {
-		fmt.Fprintln(conn, "Name cannot be empty. Disconnecting.")
-		conn.Close()
-		return
+// handleFrame handles JSON frames that have no text command equivalent: key
+// frames, encrypted whispers and pastes
+func (s *Server) handleFrame(client *Client, env Envelope) {
+	switch {
+	case env.Type == FrameKey && env.To != "":
+		s.lookupKey(client, env.To)
+	case env.Type == FrameKey:
+		s.publishKey(client, env.Key)
+	case env.Type == FrameWhisper && env.Encrypted:
+		whisper := newEnvelope(FrameWhisper)
+		whisper.From = client.name()
+		whisper.To = env.To
+		whisper.Text = env.Text
+		whisper.Encrypted = true
+		s.relayWhisper(client, whisper)
+	case env.Type == FrameMessage && env.Paste:
+		s.sendPaste(client, env.Room, env.Text)
 	}
+}
 
-	// Check if name is already taken
-	s.mutex.Lock()
-	if _, exists := s.usernames[name]; exists {
-		s.mutex.Unlock()
-		fmt.Fprintln(conn, fmt.Sprintf("Name '%s' is already taken. Please choose another. Disconnecting.", name))
-		conn.Close()
+// handleConnection serves one client. The caller must have counted the
+// connection with acquireIP.
+func (s *Server) handleConnection(conn net.Conn) {
+	defer s.releaseIP(conn.RemoteAddr().String())
+
+	client := s.newClient(conn)
+	if !s.trackConn(client) {
+		client.close() // Shutting down
 		return
 	}
-	s.mutex.Unlock()
+	defer s.untrackConn(client)
 
-	client := &Client{conn: conn, name: name, room: "general"} // Assign default room
+	reader := bufio.NewReader(conn)
+	if s.config().LoginTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.config().LoginTimeout))
+	}
+	if !s.login(client, reader) {
+		client.close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
 	s.register <- client
 
 	defer func() {
+		s.abandonUploads(client)
 		s.unregister <- client
+		client.close()
 	}()
 
 	for {
-		message, err := reader.ReadString('\n')
+		if s.config().ReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.config().ReadTimeout))
+		}
+		message, err := readLine(reader, s.lineLimit(client))
+		if errors.Is(err, errLineTooLong) {
+			client.errorf("Line too long; the limit is %d bytes. It was dropped.", s.config().MaxLineLength)
+			continue
+		}
 		if err != nil {
-			log.Printf("Error reading from %s: %v", client.name, err)
+			logErrorf("Error reading from %s: %v", client.name(), err)
 			break
 		}
-		s.messages <- ClientMessage{Client: client, Message: strings.TrimSpace(message)}
+		client.lastRead.Store(time.Now().UnixNano())
+		if !utf8.ValidString(message) {
+			client.errorf("Line is not valid UTF-8. It was dropped.")
+			continue
+		}
+		if client.protocol == ProtocolText && (client.paste != nil || strings.TrimSpace(message) == "/paste") {
+			client.touch()
+			if clientMsg, done := s.collectPaste(client, message); done && s.allowMessage(client, clientMsg) {
+				s.messages <- clientMsg
+			}
+			continue
+		}
+		oversized := len(message) > s.config().MaxLineLength && s.config().MaxLineLength > 0 // Only pastes and chunks may be
+		message = strings.TrimSpace(message)
+
+		if client.protocol == ProtocolText {
+			message = cleanText(message)
+			if message != "" {
+				client.touch()
+			}
+			clientMsg := ClientMessage{Client: client, Message: message}
+			if s.allowMessage(client, clientMsg) {
+				s.messages <- clientMsg
+			}
+			continue
+		}
+		if message == "" {
+			continue
+		}
+		env, err := decodeEnvelope(message)
+		if err != nil {
+			client.errorf("%v", err)
+			continue
+		}
+		switch {
+		case env.Type == FramePong:
+			continue // Proves the connection is alive, but not that the user is active
+		case env.Type == FramePing:
+			client.answerPing(env)
+			continue
+		case env.Type == FrameChunk:
+			s.receiveChunk(client, env)
+			continue
+		case oversized && !env.Paste:
+			client.errorf("Line too long; the limit is %d bytes. It was dropped.", s.config().MaxLineLength)
+			continue
+		}
+		client.touch()
+		if env.Paste {
+			env.Text = cleanBlock(env.Text)
+		} else {
+			env.Text = cleanText(env.Text)
+		}
+		env.Room, env.To, env.File = cleanText(env.Room), cleanText(env.To), cleanText(env.File)
+		if env.Type == FrameFile {
+			// Handled here rather than by the message loop, so the upload
+			// exists before the chunks that follow it are read
+			if s.allowMessage(client, ClientMessage{Client: client, Frame: &env}) {
+				s.offerFile(client, env)
+			}
+			continue
+		}
+		clientMsg, err := env.toClientMessage(client)
+		if err != nil {
+			client.errorf("%v", err)
+			continue
+		}
+		if s.allowMessage(client, clientMsg) {
+			s.messages <- clientMsg
+		}
+	}
+}
+
+// sendChatMessage stores a chat line in the room log and broadcasts it to one
+// of the sender's rooms. An action is a /me line.
+func (s *Server) sendChatMessage(senderClient *Client, roomName, text string, action bool) {
+	env := newEnvelope(FrameMessage)
+	env.Room = roomName
+	env.Text = text
+	env.Action = action
+	s.postMessage(senderClient, env)
+}
+
+// postMessage runs the OnMessage hooks on a chat message from senderClient,
+// then stores it in the room log and broadcasts it.
+func (s *Server) postMessage(senderClient *Client, env Envelope) {
+	if left := s.mutedFor(senderClient, env.Room); left > 0 {
+		senderClient.errorf("You are muted in room '%s' for another %s.", env.Room, left.Round(time.Second))
+		return
+	}
+
+	ev := s.runHooks("OnMessage", onMessage, Event{User: senderClient.name(), Room: env.Room, Text: env.Text})
+	if ev.blocked {
+		if ev.reason != "" {
+			senderClient.errorf("Your message was not sent: %s", ev.reason)
+		}
+		s.hookActions(ev)
+		return
 	}
+
+	env.From = senderClient.name()
+	env.Text = ev.Text
+	s.history.Append(historyEntry(env))
+	s.broadcastMessageToRoom(env.Room, env)
+	s.hookActions(ev)
+}
+
+// broadcastPresence announces a user connecting, disconnecting or changing
+// their name to everyone in their rooms, on this node and every linked node.
+// Users who share several rooms with them are told once.
+func (s *Server) broadcastPresence(name string, roomNames []string, text string) {
+	env := newEnvelope(FramePresence)
+	env.From = name
+	env.Text = text
+	s.broadcastToRooms(roomNames, env)
 }
 
-// broadcastMessageToRoom sends a message to all clients in a specific room.
-func (s *Server) broadcastMessageToRoom(roomName string, message string) {
+// broadcastToRooms sends a frame once to every client in any of the rooms,
+// on this node and every linked node.
+func (s *Server) broadcastToRooms(roomNames []string, env Envelope) {
+	s.deliverToRooms(roomNames, env)
+	s.peerBroadcast(peerFrame{Type: peerRoom, Rooms: roomNames, Frame: &env})
+}
+
+// deliverToRooms sends a frame once to every client on this node that is in
+// any of the rooms.
+func (s *Server) deliverToRooms(roomNames []string, env Envelope) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	sent := make(map[*Client]bool)
+	for _, roomName := range roomNames {
+		for _, client := range s.rooms[roomName] {
+			if sent[client] {
+				continue
+			}
+			sent[client] = true
+			if err := client.send(env); err != nil {
+				logErrorf("Error sending message to %s: %v", client.name(), err)
+			}
+		}
+	}
+}
+
+// broadcastMessageToRoom sends a frame to all clients in a specific room,
+// on this node and every linked node. Chat messages are added to the search
+// index, and mentions of users who are offline are kept for them.
+func (s *Server) broadcastMessageToRoom(roomName string, env Envelope) {
+	s.indexMessage(env)
+	s.deliverToRoom(roomName, env)
+	s.peerBroadcast(peerFrame{Type: peerRoom, Frame: &env})
+	s.mentionOffline(env)
+}
+
+// deliverToRoom sends a frame to the clients in a room that are connected to this node.
+// Members a chat message mentions get it highlighted; users on this node who
+// are mentioned but not in the room get a notice. @here and @everyone only
+// count when a moderator of the room writes them.
+func (s *Server) deliverToRoom(roomName string, env Envelope) {
+	defer s.metrics.observeBroadcast(time.Now())
+	var mentioned mentionSet
+	if env.Type == FrameMessage {
+		s.metrics.roomMessage(roomName)
+		if !env.History {
+			mentioned = parseMentions(env.Text, s.config().UserNames.ExtraChars)
+		}
+	}
+
+	s.mutex.Lock()
+	everyoneDenied := mentioned.everyone() && !s.mayMentionEveryoneLocked(env.From, roomName)
+	if everyoneDenied {
+		delete(mentioned, "here")
+		delete(mentioned, "everyone")
+	}
+	var highlighted []string
 	if roomClients, ok := s.rooms[roomName]; ok {
 		for _, client := range roomClients {
-			_, err := fmt.Fprintln(client.conn, message)
+			frame := env
+			if mentioned != nil && client.name() != env.From && mentioned.includes(client.name()) {
+				frame.Mention = true
+				highlighted = append(highlighted, client.name())
+			}
+			err := client.send(frame)
 			if err != nil {
-				log.Printf("Error sending message to %s in room %s: %v", client.name, roomName, err)
+				logErrorf("Error sending message to %s in room %s: %v", client.name(), roomName, err)
 			}
 		}
 	}
+	if sender, ok := s.usernames[env.From]; ok && everyoneDenied {
+		sender.systemf("Only moderators of room '%s' can mention everyone with @here or @everyone.", roomName)
+	}
+	var notified []string
+	if mentioned != nil {
+		notified = s.notifyMentionsLocked(roomName, env, mentioned, highlighted)
+	}
+	s.mutex.Unlock()
+	s.mentions.Add(notified, Mention{ID: env.ID, Room: roomName, From: env.From, Text: env.Text, Time: env.Time})
 }
 
 // sendWhisper sends a private message from senderClient to targetUsername.
 func (s *Server) sendWhisper(senderClient *Client, targetUsername, msg string) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	env := newEnvelope(FrameWhisper)
+	env.From = senderClient.name()
+	env.To = targetUsername
+	env.Text = msg
+	s.relayWhisper(senderClient, env)
+}
 
-	if senderClient.name == targetUsername {
-		fmt.Fprintln(senderClient.conn, "You cannot whisper to yourself.")
+// relayWhisper delivers a whisper to its target, on this node, another node or
+// in their mailbox, and echoes it to the sender. Encrypted whispers are never
+// mailed, since the key they were sealed for goes away with the recipient.
+func (s *Server) relayWhisper(senderClient *Client, env Envelope) {
+	s.mutex.Lock()
+	env.To = s.canonicalName(env.To) // Names match ignoring case, online or not
+	targetUsername := env.To
+	if senderClient.name() == targetUsername {
+		s.mutex.Unlock()
+		senderClient.errorf("You cannot whisper to yourself.")
 		return
 	}
-
 	targetClient, found := s.usernames[targetUsername]
 	if !found {
-		fmt.Fprintln(senderClient.conn, fmt.Sprintf("User '%s' not found.", targetUsername))
+		link, remote := s.remoteRoute(targetUsername)
+		if !remote {
+			s.mutex.Unlock() // The mailbox writes its file; don't hold up everyone else
+			if env.Encrypted {
+				senderClient.errorf("User '%s' is not online; encrypted whispers cannot wait in a mailbox.", targetUsername)
+			} else if !s.mailWhisper(senderClient, env) {
+				senderClient.errorf("User '%s' not found.", targetUsername)
+			}
+			return
+		}
+		defer s.mutex.Unlock()
+		// The target's node delivers it, or tells the sender they are gone
+		link.send(peerFrame{Type: peerDeliver, User: targetUsername, Frame: &env})
+		if err := senderClient.send(env); err != nil {
+			logErrorf("Error sending whisper confirmation to %s: %v", senderClient.name(), err)
+		}
+		s.awayReply(senderClient, targetUsername, s.remoteAway(targetUsername))
 		return
 	}
 
+	defer s.mutex.Unlock()
+
 	// Send to target
-	_, err := fmt.Fprintln(targetClient.conn, fmt.Sprintf("[Whisper from %s]: %s", senderClient.name, msg))
+	err := targetClient.send(env)
 	if err != nil {
-		log.Printf("Error sending whisper to %s: %v", targetUsername, err)
+		logErrorf("Error sending whisper to %s: %v", targetUsername, err)
+	} else {
+		s.metrics.whispers.Add(1)
 	}
 
 	// Send confirmation to sender
-	_, err = fmt.Fprintln(senderClient.conn, fmt.Sprintf("[Whisper to %s]: %s", targetUsername, msg))
+	err = senderClient.send(env)
 	if err != nil {
-		log.Printf("Error sending whisper confirmation to %s: %v", senderClient.name, err)
+		logErrorf("Error sending whisper confirmation to %s: %v", senderClient.name(), err)
 	}
+	s.awayReply(senderClient, targetUsername, targetClient.away)
 }
 
-// joinRoom handles a client joining a new room.
+// joinRoom handles /join. Joining a room makes it the client's active room;
+// the client stays in the rooms it was already in.
 func (s *Server) joinRoom(client *Client, newRoomName string) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
+	newRoomName = strings.TrimPrefix(newRoomName, "#")
 	if newRoomName == "" {
-		fmt.Fprintln(client.conn, "Room name cannot be empty.")
+		client.errorf("Room name cannot be empty.")
 		return
 	}
 
+	s.mutex.Lock()
 	if client.room == newRoomName {
-		fmt.Fprintln(client.conn, fmt.Sprintf("You are already in room '%s'.", newRoomName))
+		s.mutex.Unlock()
+		client.errorf("You are already in room '%s'.", newRoomName)
+		return
+	}
+	if client.rooms[newRoomName] {
+		client.setRoom(newRoomName)
+		member := peerUserOf(client)
+		s.mutex.Unlock()
+		s.peerBroadcast(member.frame(peerUserMove))
+		client.roomf(newRoomName, "You are now talking in room '%s'.", newRoomName)
+		return
+	}
+	if err := s.checkRoomName(newRoomName); err != nil {
+		s.mutex.Unlock()
+		client.errorf("Invalid room name: %v.", err)
+		return
+	}
+	if reason := s.joinDenied(client.name(), newRoomName); reason != "" {
+		s.mutex.Unlock()
+		client.errorf("%s", reason)
+		return
+	}
+
+	_, newRoomExists := s.rooms[newRoomName]
+	becameOwner := s.addToRoom(client, newRoomName)
+	client.setRoom(newRoomName)
+	member := peerUserOf(client)
+	s.mutex.Unlock()
+	s.peerBroadcast(member.frame(peerUserMove))
+	s.metrics.joins.Add(1)
+
+	// Broadcast after releasing the lock; broadcastMessageToRoom takes it itself
+	client.roomf(newRoomName, "You have joined room '%s'.", newRoomName)
+	env := newEnvelope(FrameJoin)
+	env.Room = newRoomName
+	env.From = client.name()
+	env.Text = fmt.Sprintf("%s has joined the room.", client.name())
+	s.broadcastMessageToRoom(newRoomName, env)
+	s.welcomeToRoom(client, becameOwner)
+	s.joinEvents(client.name(), newRoomName, !newRoomExists)
+	logDebugf("Client %s joined room %s.", client.name(), newRoomName)
+}
+
+// showMOTD sends the message of the day to a client that just logged in
+func (s *Server) showMOTD(client *Client) {
+	motd := strings.TrimRight(s.config().MOTD, "\n")
+	if motd == "" {
+		return
+	}
+	for _, line := range strings.Split(motd, "\n") {
+		client.systemf("%s", line)
+	}
+}
+
+// welcomeToRoom tells a client who just entered a room about its state and replays its history.
+func (s *Server) welcomeToRoom(client *Client, becameOwner bool) {
+	s.mutex.Lock()
+	topic := ""
+	if meta, ok := s.roomState.rooms[client.room]; ok {
+		topic = meta.Topic
+	}
+	s.mutex.Unlock()
+
+	if becameOwner {
+		client.systemf("You are now the owner of room '%s'.", client.room)
+	}
+	if topic != "" {
+		client.systemf("Topic of room '%s': %s", client.room, topic)
+	}
+	s.replayHistory(client)
+}
+
+// leaveRoom handles /leave [room]; without a room it leaves the active one.
+func (s *Server) leaveRoom(client *Client, roomName string) {
+	roomName = strings.TrimPrefix(roomName, "#")
+	if roomName == "" {
+		roomName = client.room
+	}
+	s.mutex.Lock()
+	member := client.rooms[roomName]
+	s.mutex.Unlock()
+	if !member {
+		client.errorf("You are not in room '%s'.", roomName)
 		return
 	}
+	if !s.partRoom(client, roomName) {
+		client.errorf("You cannot leave room '%s'; it is the only room you are in.", roomName)
+	}
+}
 
-	// Remove client from old room
-	if oldRoomClients, ok := s.rooms[client.room]; ok {
-		delete(oldRoomClients, client.name)
-		if len(oldRoomClients) == 0 {
-			delete(s.rooms, client.room) // Delete room if empty
+// partRoom takes client out of one of its rooms. If that was the active room,
+// another of its rooms becomes active, or the client goes back to the default
+// room if it has no other. It returns false, changing nothing, if the client
+// would be left with no room at all.
+func (s *Server) partRoom(client *Client, roomName string) bool {
+	s.mutex.Lock()
+	if !client.rooms[roomName] {
+		s.mutex.Unlock()
+		return true
+	}
+	fallback := ""
+	if len(client.rooms) == 1 {
+		defaultRoom := s.config().DefaultRoom
+		if roomName == defaultRoom || s.joinDenied(client.name(), defaultRoom) != "" {
+			s.mutex.Unlock()
+			return false
 		}
-		s.broadcastMessageToRoom(client.room, fmt.Sprintf("%s has left the room.", client.name))
+		fallback = defaultRoom
 	}
 
-	// Add client to new room
-	if _, ok := s.rooms[newRoomName]; !ok {
-		s.rooms[newRoomName] = make(map[string]*Client)
+	s.removeFromRoom(client, roomName)
+	_, roomExists := s.rooms[roomName]
+	becameOwner, fallbackExists := false, false
+	if fallback != "" {
+		_, fallbackExists = s.rooms[fallback]
+		becameOwner = s.addToRoom(client, fallback)
+	}
+	wasActive := client.room == roomName
+	if wasActive {
+		client.setRoom(client.roomNames()[0])
+	}
+	active := client.room
+	member := peerUserOf(client)
+	s.mutex.Unlock()
+	s.peerBroadcast(member.frame(peerUserMove))
+	s.metrics.leaves.Add(1)
+
+	// Broadcast after releasing the lock; broadcastMessageToRoom takes it itself
+	env := newEnvelope(FrameLeave)
+	env.Room = roomName
+	env.From = client.name()
+	env.Text = fmt.Sprintf("%s has left the room.", client.name())
+	s.broadcastMessageToRoom(roomName, env)
+	client.systemf("You have left room '%s'.", roomName)
+	s.leaveEvents(client.name(), roomName, !roomExists)
+	logDebugf("Client %s left room %s.", client.name(), roomName)
+
+	if fallback != "" {
+		s.metrics.joins.Add(1)
+		client.roomf(fallback, "You have joined room '%s'.", fallback)
+		env := newEnvelope(FrameJoin)
+		env.Room = fallback
+		env.From = client.name()
+		env.Text = fmt.Sprintf("%s has joined the room.", client.name())
+		s.broadcastMessageToRoom(fallback, env)
+		s.welcomeToRoom(client, becameOwner)
+		s.joinEvents(client.name(), fallback, !fallbackExists)
+	} else if wasActive {
+		client.roomf(active, "You are now talking in room '%s'.", active)
 	}
-	s.rooms[newRoomName][client.name] = client
-	client.room = newRoomName // Update client's room
+	return true
+}
 
-	fmt.Fprintln(client.conn, fmt.Sprintf("You have joined room '%s'.", newRoomName))
-	s.broadcastMessageToRoom(newRoomName, fmt.Sprintf("%s has joined the room.", client.name))
-	log.Printf("Client %s joined room %s.", client.name, newRoomName)
+// replayHistory sends the most recent messages of the client's room to the client.
+func (s *Server) replayHistory(client *Client) {
+	entries := s.history.Page(client.room, 0, s.config().HistoryReplay)
+	client.historyCursor = 0
+	if len(entries) == 0 {
+		return
+	}
+	client.historyCursor = entries[0].Seq
+	client.systemf("--- Last %d messages in room '%s' ---", len(entries), client.room)
+	s.sendHistory(client, entries)
+	client.systemf("--- End of history (use /history [n] for older messages) ---")
 }
 
-// leaveRoom handles a client leaving their current room.
-func (s *Server) leaveRoom(client *Client) {
-	// Simply call joinRoom to move to general
-	s.joinRoom(client, "general")
+// showHistory sends the next page of older messages of the client's room.
+func (s *Server) showHistory(client *Client, n int) {
+	entries := s.history.Page(client.room, client.historyCursor, n)
+	if len(entries) == 0 {
+		client.systemf("No older messages in room '%s'.", client.room)
+		return
+	}
+	client.historyCursor = entries[0].Seq
+	client.systemf("--- %d older messages in room '%s' ---", len(entries), client.room)
+	s.sendHistory(client, entries)
+	client.systemf("--- End of page ---")
+}
+
+// sendHistory writes stored room messages to the client.
+func (s *Server) sendHistory(client *Client, entries []HistoryEntry) {
+	for _, entry := range entries {
+		if err := client.send(historyEnvelope(entry)); err != nil {
+			logErrorf("Error sending history to %s: %v", client.name(), err)
+			return
+		}
+	}
 }
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait in these tests
+const testTimeout = 5 * time.Second
+
+// startTestServer starts a server on a free port with its data in a temporary
+// directory and no WebSocket gateway or admin API. configure may adjust the
+// configuration first. The server is shut down when the test ends.
+func startTestServer(t *testing.T, configure func(cfg *Config)) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.SetDataDir(t.TempDir())
+	cfg.WebSocketAddr = ""
+	cfg.AdminAddr = ""
+	cfg.LogLevel = LogError
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	s := NewServerWithConfig(cfg)
+	if err := s.Listen(":0"); err != nil {
+		t.Fatalf("Listen(\":0\") returned error: %v", err)
+	}
+	go s.Serve()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		s.Shutdown(ctx) // Tests that shut down themselves make this a no-op
+	})
+	return s
+}
+
+// testConn is a client connection to a test server
+type testConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dial connects to the chat port of s
+func dial(t *testing.T, s *Server) *testConn {
+	t.Helper()
+	port := s.Addr().(*net.TCPAddr).Port
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), testTimeout)
+	if err != nil {
+		t.Fatalf("Error connecting to the server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// loginJSON connects to s as a JSON client called name and waits until it is
+// in a room
+func loginJSON(t *testing.T, s *Server, name string) *testConn {
+	t.Helper()
+	c := dial(t, s)
+	c.sendFrame(Envelope{Type: FrameHello, From: name})
+	c.waitFrame(func(env Envelope) bool { return env.Type == FrameRoom })
+	return c
+}
+
+func (c *testConn) sendLine(line string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		c.t.Fatalf("Error sending %q: %v", line, err)
+	}
+}
+
+func (c *testConn) sendFrame(env Envelope) {
+	c.t.Helper()
+	data, err := json.Marshal(env)
+	if err != nil {
+		c.t.Fatalf("Error encoding frame: %v", err)
+	}
+	c.sendLine(string(data))
+}
+
+// readLine returns the next line from the server without its line break
+func (c *testConn) readLine() (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	line, err := c.reader.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// waitFor reads lines until one contains text and returns it
+func (c *testConn) waitFor(text string) string {
+	c.t.Helper()
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			c.t.Fatalf("Error waiting for %q: %v", text, err)
+		}
+		if strings.Contains(line, text) {
+			return line
+		}
+	}
+}
+
+// waitFrame reads frames until match accepts one and returns it. Lines that
+// are not frames, such as the name prompt, are skipped.
+func (c *testConn) waitFrame(match func(env Envelope) bool) Envelope {
+	c.t.Helper()
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			c.t.Fatalf("Error waiting for a frame: %v", err)
+		}
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		env, err := decodeEnvelope(line)
+		if err != nil {
+			c.t.Fatalf("Server sent an invalid frame %q: %v", line, err)
+		}
+		if match(env) {
+			return env
+		}
+	}
+}
+
+// waitUntil polls done until it returns true
+func waitUntil(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := startTestServer(t, nil)
+	loginJSON(t, s, "alice")
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"guest", []string{"bob"}, "You are in room 'general'."},
+		{"empty name", []string{""}, "Name cannot be empty."},
+		{"invalid name", []string{"bad name!"}, "Invalid name:"},
+		{"name in use", []string{"alice"}, "Name 'alice' is already taken."},
+		{"name in use in another case", []string{"ALICE"}, "Name 'ALICE' is already taken."},
+		{"too many attempts", []string{"", "", ""}, "Too many failed attempts. Disconnecting."},
+		{"register", []string{"/register carol secretpass1"}, "You are in room 'general'."},
+		{"login", []string{"/login carol secretpass1"}, "You are in room 'general'."},
+		{"login with a wrong password", []string{"/login carol wrongpass1"}, "login failed: invalid name or password."},
+		{"registered name", []string{"carol", "wrongpass1"}, "Wrong password for 'carol'."},
+		{"registered name in another case", []string{"Carol", "wrongpass1"}, "Wrong password for 'Carol'."},
+		{"register a name in another case", []string{"/register CAROL secretpass1"}, "register failed: name is already registered."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t, s)
+			for _, line := range tt.lines {
+				c.sendLine(line)
+			}
+			c.waitFor(tt.want)
+			c.conn.Close()
+
+			// Only alice is left once the server has dropped the connection
+			waitUntil(t, "the connection to be dropped", func() bool {
+				s.mutex.Lock()
+				defer s.mutex.Unlock()
+				return len(s.usernames) == 1
+			})
+		})
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	s := startTestServer(t, nil)
+	alice := loginJSON(t, s, "alice")
+	bob := loginJSON(t, s, "bob")
+
+	tests := []struct {
+		name       string
+		frame      Envelope
+		wantText   string
+		wantAction bool
+	}{
+		{"message", Envelope{Type: FrameMessage, Text: "hello"}, "hello", false},
+		{"action", Envelope{Type: FrameCommand, Text: "/me waves"}, "waves", true},
+		{"message that looks like a command", Envelope{Type: FrameMessage, Text: "/me is literal"}, "/me is literal", false},
+		{"message to a room", Envelope{Type: FrameMessage, Room: "general", Text: "hi room"}, "hi room", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice.sendFrame(tt.frame)
+			for who, c := range map[string]*testConn{"alice": alice, "bob": bob} {
+				env := c.waitFrame(func(env Envelope) bool { return env.Type == FrameMessage })
+				if env.From != "alice" || env.Room != "general" || env.Text != tt.wantText || env.Action != tt.wantAction {
+					t.Errorf("%s got %+v; expected %q from alice in general with action %t", who, env, tt.wantText, tt.wantAction)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownDrainsClients(t *testing.T) {
+	s := startTestServer(t, nil)
+	alice := loginJSON(t, s, "alice")
+	bob := loginJSON(t, s, "bob")
+
+	// In two rooms, bob is still told once
+	bob.sendFrame(Envelope{Type: FrameCommand, Text: "/join lobby"})
+	bob.waitFrame(func(env Envelope) bool {
+		return env.Type == FrameSystem && strings.Contains(env.Text, "owner of room 'lobby'")
+	})
+
+	// The message is still queued for bob when the shutdown starts
+	alice.sendFrame(Envelope{Type: FrameMessage, Text: "last words"})
+	alice.waitFrame(func(env Envelope) bool { return env.Type == FrameMessage })
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+
+	var texts []string
+	for {
+		line, err := bob.readLine()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading until the server closed the connection: %v", err)
+		}
+		if env, err := decodeEnvelope(line); err == nil && (env.Type == FrameMessage || env.Type == FrameSystem) {
+			texts = append(texts, env.Text)
+		}
+	}
+	expected := []string{"last words", "Server is shutting down. Goodbye!"}
+	if strings.Join(texts, "|") != strings.Join(expected, "|") {
+		t.Errorf("bob got %q before the connection closed; expected %q", texts, expected)
+	}
+
+	if err := s.Shutdown(ctx); err == nil {
+		t.Errorf("second Shutdown returned no error")
+	}
+	if _, err := net.DialTimeout("tcp", s.Addr().String(), time.Second); err == nil {
+		t.Errorf("server still accepts connections after Shutdown")
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority that issues client certificates in memory
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Error parsing CA certificate: %v", err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a client certificate for name
+func (ca *testCA) issue(t *testing.T, name string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating client key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Error creating client certificate: %v", err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertLogin(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	if err := GenerateSelfSignedCert(certFile, keyFile, []string{"127.0.0.1"}); err != nil {
+		t.Fatalf("GenerateSelfSignedCert returned error: %v", err)
+	}
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatalf("Error writing CA file: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		require  bool
+		cert     *tls.Certificate
+		wantName string // Name logged in as, or "" if the client is turned away
+	}{
+		{"certificate, optional", false, ca.issue(t, "alice"), "alice"},
+		{"certificate, required", true, ca.issue(t, "alice"), "alice"},
+		{"no certificate, optional", false, nil, "mallory"},
+		{"no certificate, required", true, nil, ""},
+		{"invalid name in certificate", false, ca.issue(t, "bad name"), ""},
+		{"certificate from another CA", false, otherCA.issue(t, "alice"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startTestServer(t, func(cfg *Config) {
+				cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile = certFile, keyFile, caFile
+				cfg.TLSRequireClientCert = tt.require
+			})
+			clientConfig := &tls.Config{InsecureSkipVerify: true}
+			if tt.cert != nil {
+				clientConfig.Certificates = []tls.Certificate{*tt.cert}
+			}
+			port := s.Addr().(*net.TCPAddr).Port
+			conn, err := tls.DialWithDialer(&net.Dialer{Timeout: testTimeout}, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), clientConfig)
+			if err != nil {
+				if tt.wantName == "" {
+					return // Refused during the handshake
+				}
+				t.Fatalf("Error connecting to the server: %v", err)
+			}
+			c := &testConn{t: t, conn: conn, reader: bufio.NewReader(conn)}
+			t.Cleanup(func() { conn.Close() })
+
+			c.sendFrame(Envelope{Type: FrameHello, From: "mallory"})
+			if tt.wantName == "" {
+				for {
+					if _, err := c.readLine(); err != nil {
+						break // Disconnected without logging in
+					}
+				}
+				s.mutex.Lock()
+				defer s.mutex.Unlock()
+				if n := len(s.usernames); n != 0 {
+					t.Errorf("%d clients are logged in; expected none", n)
+				}
+				return
+			}
+			c.waitFrame(func(env Envelope) bool { return env.Type == FrameRoom })
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			client, ok := s.usernames[tt.wantName]
+			if !ok {
+				t.Fatalf("%s is not logged in", tt.wantName)
+			}
+			if registered := tt.cert != nil; client.registered != registered {
+				t.Errorf("%s is registered: %t; expected %t", tt.wantName, client.registered, registered)
+			}
+		})
+	}
+}
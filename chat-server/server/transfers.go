@@ -0,0 +1,554 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxUploads       = 3                // Files a client may upload at the same time
+	maxFileNameRunes = 255              // Longest file name accepted by /send
+	transferSweep    = 10 * time.Second // How often expired offers are withdrawn
+	transferPrefix   = "chat-transfer-" // Names of the files the store writes start with this
+)
+
+var (
+	errNoOffers      = errors.New("no file offers")
+	errNoSuchOffer   = errors.New("no such file offer")
+	errTransfersFull = errors.New("transfer directory is over its quota")
+)
+
+// transfer is a file sent with /send. It is uploaded to the transfer directory
+// in full before it is offered, and deleted once every recipient has answered
+// and every download has finished, or when the offer expires.
+type transfer struct {
+	id        string
+	from      string
+	to        string // Recipient, or "" for a room
+	room      string // Room the file was sent to, or ""
+	name      string // Base name of the file, as given by the sender
+	size      int64
+	path      string
+	file      *os.File // Open while the upload is in progress
+	received  int64
+	offered   map[string]bool // Recipients who have not answered yet
+	downloads int             // Downloads in progress
+	expires   time.Time       // Zero until the upload is complete
+}
+
+// target describes where a transfer goes, for notices
+func (t *transfer) target() string {
+	if t.room != "" {
+		return "room '" + t.room + "'"
+	}
+	return t.to
+}
+
+// transferStore keeps the files waiting in the transfer directory. Transfers
+// only last as long as the process, so files left over from an earlier run
+// are deleted at start-up. The store only ever touches files whose names start
+// with transferPrefix; anything else in the directory is left alone.
+type transferStore struct {
+	dir    string
+	byID   map[string]*transfer
+	lastID int
+	used   int64 // Bytes announced by the transfers in byID
+	mutex  sync.Mutex
+}
+
+func newTransferStore(dir string) *transferStore {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			logErrorf("Error creating transfer directory %s: %v", dir, err)
+			dir = ""
+		}
+	}
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			logErrorf("Error reading transfer directory %s: %v", dir, err)
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), transferPrefix) {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if err := os.Remove(path); err != nil {
+				logErrorf("Error deleting old transfer file %s: %v", path, err)
+			}
+		}
+	}
+	return &transferStore{dir: dir, byID: make(map[string]*transfer)}
+}
+
+// create starts a transfer and opens the file its upload is written to. The
+// announced size counts against quota, the most the waiting files may take up
+// together (0 is unlimited), until the transfer is removed.
+func (ts *transferStore) create(from, to, room, name string, size, quota int64) (*transfer, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if quota > 0 && ts.used+size > quota {
+		return nil, errTransfersFull
+	}
+	ts.lastID++
+	id := strconv.Itoa(ts.lastID)
+	path := filepath.Join(ts.dir, transferPrefix+id)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	t := &transfer{id: id, from: from, to: to, room: room, name: name, size: size, path: path, file: file, offered: make(map[string]bool)}
+	ts.byID[id] = t
+	ts.used += size
+	return t, nil
+}
+
+// removeLocked deletes a transfer and its file. The caller must hold ts.mutex.
+func (ts *transferStore) removeLocked(t *transfer) {
+	if _, ok := ts.byID[t.id]; !ok {
+		return
+	}
+	delete(ts.byID, t.id)
+	ts.used -= t.size
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	if err := os.Remove(t.path); err != nil && !os.IsNotExist(err) {
+		logErrorf("Error deleting transfer file %s: %v", t.path, err)
+	}
+}
+
+// remove deletes a transfer and its file
+func (ts *transferStore) remove(t *transfer) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.removeLocked(t)
+}
+
+// releaseLocked deletes a complete transfer once nobody needs it any more.
+// The caller must hold ts.mutex.
+func (ts *transferStore) releaseLocked(t *transfer) {
+	if len(t.offered) == 0 && t.downloads == 0 {
+		ts.removeLocked(t)
+	}
+}
+
+// answer takes name's answer to an offer, starting a download if they accept.
+// An empty id picks the newest offer to name.
+func (ts *transferStore) answer(name, id string, accept bool) (*transfer, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	t := ts.byID[id]
+	if id == "" {
+		for _, candidate := range ts.byID {
+			if candidate.offered[name] && (t == nil || candidate.expires.After(t.expires)) {
+				t = candidate
+			}
+		}
+		if t == nil {
+			return nil, errNoOffers
+		}
+	}
+	if t == nil || !t.offered[name] {
+		return nil, errNoSuchOffer
+	}
+	delete(t.offered, name)
+	if accept {
+		t.downloads++
+	} else {
+		ts.releaseLocked(t)
+	}
+	return t, nil
+}
+
+// downloaded records that a download has ended
+func (ts *transferStore) downloaded(t *transfer) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	t.downloads--
+	ts.releaseLocked(t)
+}
+
+// expire withdraws the offers of complete transfers that have expired and
+// returns them. Files still being downloaded are deleted once that finishes.
+func (ts *transferStore) expire(now time.Time) []*transfer {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	var expired []*transfer
+	for _, t := range ts.byID {
+		if !t.expires.IsZero() && now.After(t.expires) && len(t.offered) > 0 {
+			expired = append(expired, t)
+			t.offered = make(map[string]bool)
+			ts.releaseLocked(t)
+		}
+	}
+	return expired
+}
+
+// withdraw drops the offers to name when its holder leaves or takes another
+// name, so whoever takes the name next cannot answer them
+func (ts *transferStore) withdraw(name string) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	for _, t := range ts.byID {
+		if t.offered[name] {
+			delete(t.offered, name)
+			ts.releaseLocked(t)
+		}
+	}
+}
+
+// pending lists the offers name has not answered yet, oldest first
+func (ts *transferStore) pending(name string) []*transfer {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	var offers []*transfer
+	for _, t := range ts.byID {
+		if t.offered[name] {
+			offers = append(offers, t)
+		}
+	}
+	sort.Slice(offers, func(i, j int) bool { return offers[i].expires.Before(offers[j].expires) })
+	return offers
+}
+
+// canReceiveFiles reports whether a client can download files. Text clients
+// and the web client only get a notice that a file was shared.
+func canReceiveFiles(client *Client) bool {
+	_, web := client.conn.(*wsConn)
+	return client.protocol == ProtocolJSON && !web
+}
+
+// fileError tells a client that the upload it asked for with id failed
+func fileError(client *Client, id, format string, args ...interface{}) {
+	env := newEnvelope(FrameError)
+	env.ID = id
+	env.Text = fmt.Sprintf(format, args...)
+	if err := client.send(env); err != nil {
+		logErrorf("Error sending notice to %s: %v", client.name(), err)
+	}
+}
+
+// offerFile starts an upload for a file frame from client. The reply carries
+// the ID the client chose, and so does an error if the upload is refused. It
+// runs on the client's reader, before the chunks that follow the offer.
+func (s *Server) offerFile(client *Client, env Envelope) {
+	cfg := s.config()
+	name := filepath.Base(strings.ReplaceAll(env.File, "\\", "/"))
+	switch {
+	case s.transfers.dir == "":
+		fileError(client, env.ID, "File transfers are turned off on this server.")
+		return
+	case env.ID == "" || len(env.ID) > 64 || client.uploads[env.ID] != nil:
+		fileError(client, env.ID, "A file frame needs an ID that is not in use by another of your uploads.")
+		return
+	case env.File == "" || name == "." || name == ".." || name == "/" || utf8.RuneCountInString(name) > maxFileNameRunes:
+		fileError(client, env.ID, "Invalid file name '%s'.", env.File)
+		return
+	case env.Size < 0 || env.Size > cfg.MaxFileSize:
+		fileError(client, env.ID, "%s is too large; the limit is %s.", name, formatSize(cfg.MaxFileSize))
+		return
+	case len(client.uploads) >= maxUploads:
+		fileError(client, env.ID, "You can upload %s at a time.", pluralize(maxUploads, "file"))
+		return
+	case (env.To == "") == (env.Room == ""):
+		fileError(client, env.ID, "A file goes either to a user or to a room.")
+		return
+	}
+
+	room := strings.TrimPrefix(env.Room, "#")
+	s.mutex.Lock()
+	target, local := s.usernames[env.To]
+	member := client.rooms[room]
+	s.mutex.Unlock()
+	switch {
+	case room != "" && !member:
+		fileError(client, env.ID, "You are not in room '%s'.", room)
+		return
+	case env.To == client.name():
+		fileError(client, env.ID, "You cannot send a file to yourself.")
+		return
+	case env.To != "" && !local:
+		if _, remote := s.remoteRoute(env.To); remote {
+			fileError(client, env.ID, "%s is connected to another node; files can only be sent to users on this one.", env.To)
+		} else {
+			fileError(client, env.ID, "User '%s' not found.", env.To)
+		}
+		return
+	case env.To != "" && !canReceiveFiles(target):
+		fileError(client, env.ID, "%s's client cannot receive files.", env.To)
+		return
+	}
+
+	t, err := s.transfers.create(client.name(), env.To, room, name, env.Size, cfg.MaxTransferBytes)
+	if errors.Is(err, errTransfersFull) {
+		fileError(client, env.ID, "The server has no room for %s right now; try again later.", name)
+		return
+	}
+	if err != nil {
+		logErrorf("Error creating transfer file: %v", err)
+		fileError(client, env.ID, "The server could not store %s.", name)
+		return
+	}
+	if client.uploads == nil {
+		client.uploads = make(map[string]*transfer)
+	}
+	client.uploads[env.ID] = t
+	logDebugf("%s is uploading %s (%s) for %s", client.name(), name, formatSize(env.Size), t.target())
+
+	reply := newEnvelope(FrameFile)
+	reply.ID = env.ID
+	reply.To, reply.Room = env.To, room
+	reply.File, reply.Size = name, env.Size
+	reply.Text = fmt.Sprintf("Uploading %s (%s) for %s...", name, formatSize(env.Size), t.target())
+	if err := client.send(reply); err != nil {
+		logErrorf("Error sending upload go-ahead to %s: %v", client.name(), err)
+	}
+	if env.Size == 0 {
+		s.finishUpload(client, env.ID, t)
+	}
+}
+
+// receiveChunk appends a chunk to one of client's uploads
+func (s *Server) receiveChunk(client *Client, env Envelope) {
+	t := client.uploads[env.ID]
+	if t == nil {
+		logDebugf("Dropping chunk of unknown upload '%s' from %s", env.ID, client.name())
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(env.Data)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("invalid base64 data")
+	case len(data) > FileChunkSize:
+		err = fmt.Errorf("chunks may carry at most %d bytes", FileChunkSize)
+	case t.received+int64(len(data)) > t.size:
+		err = fmt.Errorf("more data than the %d bytes announced", t.size)
+	default:
+		_, err = t.file.Write(data)
+	}
+	if err != nil {
+		delete(client.uploads, env.ID)
+		s.transfers.remove(t)
+		fileError(client, env.ID, "Upload of %s failed: %v.", t.name, err)
+		return
+	}
+	t.received += int64(len(data))
+	if t.received == t.size {
+		s.finishUpload(client, env.ID, t)
+	}
+}
+
+// finishUpload offers a complete upload to its recipients. Room members whose
+// client cannot download files are only told about it.
+func (s *Server) finishUpload(client *Client, id string, t *transfer) {
+	delete(client.uploads, id)
+	s.transfers.mutex.Lock()
+	err := t.file.Close()
+	t.file = nil
+	s.transfers.mutex.Unlock()
+	if err != nil {
+		logErrorf("Error writing transfer file %s: %v", t.path, err)
+		s.transfers.remove(t)
+		fileError(client, id, "The server could not store %s.", t.name)
+		return
+	}
+
+	offer := newEnvelope(FrameFile)
+	offer.ID = t.id
+	offer.From, offer.To, offer.Room = t.from, t.to, t.room
+	offer.File, offer.Size = t.name, t.size
+	offer.Text = fmt.Sprintf("%s wants to send you %s (%s). Type /accept %s or /decline %s.", t.from, t.name, formatSize(t.size), t.id, t.id)
+	if t.room != "" {
+		offer.Text = fmt.Sprintf("%s shared %s (%s) in room '%s'. Type /accept %s to download it.", t.from, t.name, formatSize(t.size), t.room, t.id)
+	}
+
+	var recipients []*Client
+	s.mutex.Lock()
+	if t.room != "" {
+		for _, member := range s.rooms[t.room] {
+			if member != client {
+				recipients = append(recipients, member)
+			}
+		}
+	} else if target, ok := s.usernames[t.to]; ok {
+		recipients = append(recipients, target)
+	}
+	// Still under s.mutex, so a recipient leaving now has its offer withdrawn
+	s.transfers.mutex.Lock()
+	for _, recipient := range recipients {
+		if canReceiveFiles(recipient) {
+			t.offered[recipient.name()] = true
+		}
+	}
+	t.expires = time.Now().Add(s.config().TransferExpiry)
+	offered := len(t.offered)
+	s.transfers.releaseLocked(t)
+	s.transfers.mutex.Unlock()
+	s.mutex.Unlock()
+
+	for _, recipient := range recipients {
+		if !canReceiveFiles(recipient) {
+			recipient.systemf("%s shared %s (%s) in room '%s'; use a client that can receive files to download it.", t.from, t.name, formatSize(t.size), t.room)
+			continue
+		}
+		if err := recipient.send(offer); err != nil {
+			logErrorf("Error sending file offer to %s: %v", recipient.name(), err)
+		}
+	}
+	if offered == 0 {
+		client.errorf("Nobody who can receive files is there to take %s; it was deleted.", t.name)
+		return
+	}
+	client.systemf("Uploaded %s and offered it to %s.", t.name, t.target())
+	logInfof("%s offered %s (%s) to %s", t.from, t.name, formatSize(t.size), t.target())
+}
+
+// abandonUploads deletes the unfinished uploads of a client that disconnected
+func (s *Server) abandonUploads(client *Client) {
+	for id, t := range client.uploads {
+		delete(client.uploads, id)
+		s.transfers.remove(t)
+	}
+}
+
+// answerOffer handles /accept and /decline. Accepted files are streamed to
+// the client in chunk frames.
+func (s *Server) answerOffer(client *Client, id string, accept bool) {
+	if accept && !canReceiveFiles(client) {
+		client.errorf("Your client cannot receive files.")
+		return
+	}
+	id = strings.TrimSpace(id)
+	t, err := s.transfers.answer(client.name(), id, accept)
+	switch {
+	case errors.Is(err, errNoOffers):
+		client.errorf("There are no file offers for you.")
+		return
+	case err != nil:
+		client.errorf("There is no file offer '%s' for you.", id)
+		return
+	}
+
+	answer := "declined"
+	if accept {
+		answer = "accepted"
+		go s.sendFile(client, t)
+	} else {
+		client.systemf("Declined %s from %s.", t.name, t.from)
+	}
+	s.mutex.Lock()
+	sender, online := s.usernames[t.from]
+	s.mutex.Unlock()
+	if online {
+		sender.systemf("%s %s %s.", client.name(), answer, t.name)
+	}
+}
+
+// sendFile streams a transfer to a client that accepted it. The first chunk
+// also carries the file name, size and sender. It waits while the client's
+// queue is filling up, so a download neither crowds out chat lines nor loses
+// chunks to the overflow policy.
+func (s *Server) sendFile(client *Client, t *transfer) {
+	defer s.transfers.downloaded(t)
+
+	file, err := os.Open(t.path)
+	if err != nil {
+		logErrorf("Error opening transfer file %s: %v", t.path, err)
+		client.errorf("The server could not read %s.", t.name)
+		return
+	}
+	defer file.Close()
+
+	buf := make([]byte, FileChunkSize)
+	for sent := int64(0); ; {
+		n, err := file.Read(buf)
+		chunk := newEnvelope(FrameChunk)
+		chunk.ID = t.id
+		chunk.Data = base64.StdEncoding.EncodeToString(buf[:n])
+		if sent == 0 {
+			chunk.From, chunk.File, chunk.Size = t.from, t.name, t.size
+		}
+		if n > 0 || sent == 0 {
+			if !client.waitForRoom() || client.send(chunk) != nil {
+				return // Disconnected
+			}
+		}
+		sent += int64(n)
+		if err != nil || sent >= t.size {
+			logDebugf("Sent %s (%s) to %s", t.name, formatSize(sent), client.name())
+			return
+		}
+	}
+}
+
+// waitForRoom blocks while the client's outbound queue is more than half
+// full. It returns false once the client is gone.
+func (c *Client) waitForRoom() bool {
+	for len(c.out.queue) > cap(c.out.queue)/2 {
+		select {
+		case <-c.out.done:
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// showOffers lists the file offers a client has not answered yet
+func (s *Server) showOffers(client *Client) {
+	offers := s.transfers.pending(client.name())
+	if len(offers) == 0 {
+		client.systemf("There are no file offers for you.")
+		return
+	}
+	client.systemf("--- %s ---", pluralize(len(offers), "file offer"))
+	for _, t := range offers {
+		client.systemf("%s: %s (%s) from %s, until %s", t.id, t.name, formatSize(t.size), t.from, t.expires.Format("15:04"))
+	}
+}
+
+// sweepTransfers withdraws expired offers until the server shuts down
+func (s *Server) sweepTransfers() {
+	ticker := time.NewTicker(transferSweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case now := <-ticker.C:
+			for _, t := range s.transfers.expire(now) {
+				logDebugf("Offer of %s from %s expired", t.name, t.from)
+				s.mutex.Lock()
+				sender, online := s.usernames[t.from]
+				s.mutex.Unlock()
+				if online {
+					sender.systemf("Your offer of %s to %s expired.", t.name, t.target())
+				}
+			}
+		}
+	}
+}
+
+// formatSize formats a byte count for people
+func formatSize(n int64) string {
+	switch {
+	case n < 1024:
+		return pluralize(int(n), "byte")
+	case n < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	}
+}
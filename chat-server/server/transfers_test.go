@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransferQuota(t *testing.T) {
+	ts := newTransferStore(t.TempDir())
+
+	steps := []struct {
+		size    int64
+		wantErr error
+	}{
+		{40, nil},
+		{60, nil}, // Exactly at the quota
+		{1, errTransfersFull},
+		{0, nil},
+	}
+	var created []*transfer
+	for i, step := range steps {
+		tr, err := ts.create("alice", "bob", "", "file", step.size, 100)
+		if !errors.Is(err, step.wantErr) {
+			t.Fatalf("step %d: create of %d bytes returned %v; expected %v", i, step.size, err, step.wantErr)
+		}
+		if tr != nil {
+			created = append(created, tr)
+		}
+	}
+
+	ts.remove(created[0])
+	ts.remove(created[0]) // Removing twice frees the space once
+	if ts.used != 60 {
+		t.Errorf("store uses %d bytes after a removal; expected 60", ts.used)
+	}
+	if _, err := ts.create("alice", "bob", "", "file", 40, 100); err != nil {
+		t.Errorf("create after freeing space returned error: %v", err)
+	}
+	if _, err := ts.create("alice", "bob", "", "file", 1000, 0); err != nil {
+		t.Errorf("create without a quota returned error: %v", err)
+	}
+}
+
+func TestTransferDeletion(t *testing.T) {
+	tests := []struct {
+		name string
+		act  func(t *testing.T, ts *transferStore, tr *transfer)
+	}{
+		{"declined by everyone", func(t *testing.T, ts *transferStore, tr *transfer) {
+			ts.answer("bob", tr.id, false)
+			ts.answer("carol", "", false)
+		}},
+		{"downloaded by everyone", func(t *testing.T, ts *transferStore, tr *transfer) {
+			ts.answer("bob", tr.id, true)
+			ts.answer("carol", tr.id, true)
+			ts.downloaded(tr)
+			ts.downloaded(tr)
+		}},
+		{"recipients left", func(t *testing.T, ts *transferStore, tr *transfer) {
+			ts.withdraw("bob")
+			ts.withdraw("carol")
+		}},
+		{"expired", func(t *testing.T, ts *transferStore, tr *transfer) {
+			if expired := ts.expire(time.Now().Add(2 * time.Hour)); len(expired) != 1 {
+				t.Errorf("expire withdrew %d offers; expected 1", len(expired))
+			}
+		}},
+		{"expired during a download", func(t *testing.T, ts *transferStore, tr *transfer) {
+			ts.answer("bob", tr.id, true)
+			ts.expire(time.Now().Add(2 * time.Hour))
+			if _, err := os.Stat(tr.path); err != nil {
+				t.Errorf("file was deleted during a download: %v", err)
+			}
+			ts.downloaded(tr)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTransferStore(t.TempDir())
+			tr, err := ts.create("alice", "", "lobby", "file", 5, 0)
+			if err != nil {
+				t.Fatalf("create returned error: %v", err)
+			}
+			tr.file.WriteString("hello")
+			tr.file.Close()
+			tr.file = nil
+			tr.offered = map[string]bool{"bob": true, "carol": true}
+			tr.expires = time.Now().Add(time.Hour)
+
+			tt.act(t, ts, tr)
+			if _, err := os.Stat(tr.path); !os.IsNotExist(err) {
+				t.Errorf("transfer file still exists: %v", err)
+			}
+			if len(ts.byID) != 0 || ts.used != 0 {
+				t.Errorf("store still holds %d transfers and %d bytes", len(ts.byID), ts.used)
+			}
+		})
+	}
+}
+
+func TestTransferAnswer(t *testing.T) {
+	ts := newTransferStore(t.TempDir())
+	older, _ := ts.create("alice", "bob", "", "old", 1, 0)
+	newer, _ := ts.create("alice", "bob", "", "new", 1, 0)
+	for i, tr := range []*transfer{older, newer} {
+		tr.offered["bob"] = true
+		tr.expires = time.Now().Add(time.Duration(i+1) * time.Hour)
+	}
+
+	tests := []struct {
+		name, who, id string
+		want          *transfer
+		wantErr       error
+	}{
+		{"newest offer", "bob", "", newer, nil},
+		{"answered already", "bob", newer.id, nil, errNoSuchOffer},
+		{"by ID", "bob", older.id, older, nil},
+		{"none left", "bob", "", nil, errNoOffers},
+		{"someone else's offer", "carol", older.id, nil, errNoSuchOffer},
+		{"unknown ID", "bob", "99", nil, errNoSuchOffer},
+	}
+	for _, tt := range tests {
+		got, err := ts.answer(tt.who, tt.id, false)
+		if got != tt.want || !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: answer returned %v, %v; expected %v, %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestTransferStartupCleanup(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, transferPrefix+"7")
+	other := filepath.Join(dir, "notes.txt")
+	for _, path := range []string{leftover, other} {
+		if err := os.WriteFile(path, []byte("x"), 0o600); err != nil {
+			t.Fatalf("Error writing %s: %v", path, err)
+		}
+	}
+
+	newTransferStore(dir)
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("leftover transfer file was not deleted: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("unrelated file was touched: %v", err)
+	}
+}
+
+func TestOfferWithdrawn(t *testing.T) {
+	tests := []struct {
+		name  string
+		leave func(t *testing.T, s *Server, bob *testConn)
+	}{
+		{"recipient disconnects", func(t *testing.T, s *Server, bob *testConn) {
+			bob.conn.Close()
+			waitUntil(t, "bob to be gone", func() bool {
+				s.mutex.Lock()
+				defer s.mutex.Unlock()
+				_, online := s.usernames["bob"]
+				return !online
+			})
+		}},
+		{"recipient changes name", func(t *testing.T, s *Server, bob *testConn) {
+			bob.sendFrame(Envelope{Type: FrameCommand, Text: "/nick robert"})
+			bob.waitFor("bob is now known as robert.")
+			bob.sendFrame(Envelope{Type: FrameCommand, Text: "/accept"})
+			bob.waitFor("There are no file offers for you.")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startTestServer(t, func(cfg *Config) { cfg.CommandRate, cfg.MessageRate = 0, 0 })
+			alice := loginJSON(t, s, "alice")
+			bob := loginJSON(t, s, "bob")
+
+			alice.sendFrame(Envelope{Type: FrameFile, ID: "up1", To: "bob", File: "notes.txt", Size: 5})
+			alice.waitFrame(func(env Envelope) bool { return env.Type == FrameFile && env.ID == "up1" })
+			alice.sendFrame(Envelope{Type: FrameChunk, ID: "up1", Data: base64.StdEncoding.EncodeToString([]byte("hello"))})
+			offer := bob.waitFrame(func(env Envelope) bool { return env.Type == FrameFile })
+
+			tt.leave(t, s, bob)
+			s.transfers.mutex.Lock()
+			left := len(s.transfers.byID)
+			s.transfers.mutex.Unlock()
+			if left != 0 {
+				t.Errorf("store holds %d transfers; expected the withdrawn one to be deleted", left)
+			}
+
+			// Another guest taking the name finds nothing to accept
+			mallory := loginJSON(t, s, "bob")
+			mallory.sendFrame(Envelope{Type: FrameCommand, Text: "/accept " + offer.ID})
+			env := mallory.waitFrame(func(env Envelope) bool { return env.Type == FrameError || env.Type == FrameChunk })
+			if env.Type != FrameError || !strings.HasPrefix(env.Text, "There is no file offer") {
+				t.Errorf("the new bob got %+v; expected no offer", env)
+			}
+		})
+	}
+}
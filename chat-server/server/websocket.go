@@ -0,0 +1,340 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes (RFC 6455, section 5.2)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+const (
+	wsGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessageSize = 64 * 1024 // Largest message accepted from a browser
+
+	// HTTP listeners drop clients that are slow to send request headers or
+	// keep idle connections open. Hijacked WebSockets are not affected.
+	httpHeaderTimeout = 10 * time.Second
+	httpIdleTimeout   = 2 * time.Minute
+)
+
+var errWSProtocol = errors.New("websocket protocol error")
+
+//go:embed static/index.html
+var webClientHTML []byte
+
+// startWebSocket serves the bundled web client and the WebSocket endpoint on addr,
+// over HTTPS when tlsConfig is not nil.
+func (s *Server) startWebSocket(addr string, tlsConfig *tls.Config) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(webClientHTML)
+	})
+	mux.HandleFunc("/ws", s.handleWebSocket)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("starting WebSocket gateway: %v", err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	httpServer := &http.Server{Handler: mux, ReadHeaderTimeout: httpHeaderTimeout, IdleTimeout: httpIdleTimeout}
+
+	s.mutex.Lock()
+	s.wsServer = httpServer
+	s.wsAddr = listener.Addr()
+	s.mutex.Unlock()
+
+	logInfof("WebSocket gateway started on %s (TLS: %t)", listener.Addr(), tlsConfig != nil)
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logInfof("WebSocket gateway stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// handleWebSocket upgrades an HTTP request and hands the connection to handleConnection.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	if !s.originAllowed(r) {
+		logWarnf("Refused WebSocket from %s opened by page %s", r.RemoteAddr, r.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	if !s.acquireIP(r.RemoteAddr) {
+		http.Error(w, "Too many connections from your address", http.StatusTooManyRequests)
+		return
+	}
+	handedOff := false
+	defer func() {
+		if !handedOff { // handleConnection releases the address itself
+			s.releaseIP(r.RemoteAddr)
+		}
+	}()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		logErrorf("Error hijacking WebSocket connection: %v", err)
+		return
+	}
+
+	accept := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		logErrorf("Error completing WebSocket handshake: %v", err)
+		conn.Close()
+		return
+	}
+
+	handedOff = true
+	s.handleConnection(&wsConn{Conn: conn, reader: rw.Reader})
+}
+
+// originAllowed reports whether the page that opened a WebSocket may use it.
+// Browsers send the page's origin, and would present a client certificate to
+// any site that connects, so only the bundled web client and the configured
+// origins are let in. Clients that are not browsers send no Origin.
+func (s *Server) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return slices.Contains(s.config().AllowedOrigins, origin)
+}
+
+// headerContainsToken reports whether a comma-separated header contains token (case-insensitive)
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn adapts a WebSocket connection to net.Conn so browsers are served by
+// the same code as TCP clients. Each inbound message is read as one line and
+// each Write is sent as one text message.
+type wsConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	pending   []byte // Unread part of the current inbound message
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+// Read returns inbound messages as newline-terminated lines
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+			msg = append(msg, '\n')
+		}
+		c.pending = msg
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends p as a single text message
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpText, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame and closes the underlying connection
+func (c *wsConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		c.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(wsOpClose, []byte{0x03, 0xE8}) // 1000: normal closure
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// readMessage reads frames until a complete data message has arrived,
+// answering control frames along the way.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.Close()
+			return nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if started {
+				return nil, c.fail()
+			}
+			started = true
+		case wsOpContinuation:
+			if !started {
+				return nil, c.fail()
+			}
+		default:
+			return nil, c.fail()
+		}
+
+		if len(msg)+len(payload) > wsMaxMessageSize {
+			return nil, c.fail()
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// readFrame reads and unmasks one frame
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	if header[0]&0x70 != 0 || !masked { // No extensions negotiated; clients must mask
+		err = c.fail()
+		return
+	}
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxMessageSize || (opcode >= wsOpClose && (length > 125 || !fin)) {
+		err = c.fail()
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// writeFrame sends one unfragmented, unmasked frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := make([]byte, 0, 10)
+	header = append(header, 0x80|opcode)
+	switch n := len(payload); {
+	case n <= 125:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	_, err := c.Conn.Write(append(header, payload...))
+	return err
+}
+
+// fail closes the connection with a protocol error status
+func (c *wsConn) fail() error {
+	c.closeOnce.Do(func() {
+		c.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(wsOpClose, []byte{0x03, 0xEA}) // 1002: protocol error
+		c.Conn.Close()
+	})
+	return errWSProtocol
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// recordConn is a net.Conn that keeps what is written to it
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+	closed  bool
+}
+
+func (c *recordConn) Write(p []byte) (int, error)      { return c.written.Write(p) }
+func (c *recordConn) Close() error                     { c.closed = true; return nil }
+func (c *recordConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *recordConn) RemoteAddr() net.Addr             { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+// clientFrame encodes a frame the way a browser sends it, masked
+func clientFrame(fin bool, opcode byte, payload string) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+func TestWebSocketRead(t *testing.T) {
+	long := string(bytes.Repeat([]byte("a"), 300))
+	unmasked := []byte{0x80 | wsOpText, 2, 'h', 'i'}
+
+	tests := []struct {
+		name     string
+		frames   [][]byte
+		want     string
+		wantErr  error
+		wantSent []byte // What the server answers, if anything
+	}{
+		{"text", [][]byte{clientFrame(true, wsOpText, "hello")}, "hello\n", nil, nil},
+		{"16-bit length", [][]byte{clientFrame(true, wsOpText, long)}, long + "\n", nil, nil},
+		{"line break kept", [][]byte{clientFrame(true, wsOpText, "hello\n")}, "hello\n", nil, nil},
+		{"fragmented", [][]byte{
+			clientFrame(false, wsOpText, "hel"),
+			clientFrame(false, wsOpContinuation, "lo "),
+			clientFrame(true, wsOpContinuation, "there"),
+		}, "hello there\n", nil, nil},
+		{"ping between fragments", [][]byte{
+			clientFrame(false, wsOpText, "hel"),
+			clientFrame(true, wsOpPing, "p"),
+			clientFrame(true, wsOpContinuation, "lo"),
+		}, "hello\n", nil, []byte{0x80 | wsOpPong, 1, 'p'}},
+		{"close", [][]byte{clientFrame(true, wsOpClose, "\x03\xe8")}, "", io.EOF, []byte{0x80 | wsOpClose, 2, 0x03, 0xE8}},
+		{"unmasked", [][]byte{unmasked}, "", errWSProtocol, []byte{0x80 | wsOpClose, 2, 0x03, 0xEA}},
+		{"continuation first", [][]byte{clientFrame(true, wsOpContinuation, "x")}, "", errWSProtocol, nil},
+		{"second message inside the first", [][]byte{
+			clientFrame(false, wsOpText, "a"),
+			clientFrame(true, wsOpText, "b"),
+		}, "", errWSProtocol, nil},
+		{"fragmented ping", [][]byte{clientFrame(false, wsOpPing, "p")}, "", errWSProtocol, nil},
+		{"unknown opcode", [][]byte{clientFrame(true, 0x3, "x")}, "", errWSProtocol, nil},
+		{"too large", [][]byte{clientFrame(true, wsOpText, string(make([]byte, wsMaxMessageSize+1)))}, "", errWSProtocol, nil},
+		{"too large in fragments", [][]byte{
+			clientFrame(false, wsOpText, string(make([]byte, wsMaxMessageSize))),
+			clientFrame(true, wsOpContinuation, "x"),
+		}, "", errWSProtocol, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := &recordConn{}
+			conn := &wsConn{Conn: raw, reader: bufio.NewReader(bytes.NewReader(bytes.Join(tt.frames, nil)))}
+
+			got, err := io.ReadAll(io.LimitReader(conn, int64(len(tt.want))))
+			if tt.wantErr == nil {
+				if err != nil || string(got) != tt.want {
+					t.Errorf("read %q, %v; expected %q", got, err, tt.want)
+				}
+			} else {
+				_, err = conn.Read(make([]byte, 1))
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("read returned error %v; expected %v", err, tt.wantErr)
+				}
+				if !raw.closed {
+					t.Errorf("connection was left open after %v", tt.wantErr)
+				}
+			}
+			if tt.wantSent != nil && !bytes.Equal(raw.written.Bytes(), tt.wantSent) {
+				t.Errorf("server sent % x; expected % x", raw.written.Bytes(), tt.wantSent)
+			}
+		})
+	}
+}
+
+func TestWebSocketWrite(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		wantHeader []byte
+	}{
+		{"short", 5, []byte{0x81, 5}},
+		{"7-bit limit", 125, []byte{0x81, 125}},
+		{"16-bit length", 126, []byte{0x81, 126, 0, 126}},
+		{"64-bit length", 70000, []byte{0x81, 127, 0, 0, 0, 0, 0, 1, 0x11, 0x70}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := &recordConn{}
+			conn := &wsConn{Conn: raw}
+			payload := bytes.Repeat([]byte("x"), tt.size)
+			if n, err := conn.Write(payload); n != tt.size || err != nil {
+				t.Fatalf("Write returned %d, %v; expected %d, nil", n, err, tt.size)
+			}
+			sent := raw.written.Bytes()
+			if !bytes.HasPrefix(sent, tt.wantHeader) || !bytes.Equal(sent[len(tt.wantHeader):], payload) {
+				t.Errorf("sent header % x; expected % x followed by the payload", sent[:min(len(sent), 10)], tt.wantHeader)
+			}
+		})
+	}
+}